@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"mime"
+	"net/http"
+)
+
+var maxRequestBodySize int64 = 64 << 10 // Limit the size of JSON request bodies to 64KB
+
+// writeJSONResponse sends v as a JSON response with the given status code
+func writeJSONResponse(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Error writing JSON response: %v", err)
+	}
+}
+
+// writeJSONError sends an error message as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSONResponse(w, status, map[string]string{"error": message})
+}
+
+// decodeJSONBody reads the JSON body of a POST request into v, answering the request itself on failure
+func decodeJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return false
+	}
+	return readJSONBody(w, r, v)
+}
+
+// readJSONBody reads a JSON request body into v, answering the request itself on failure.
+// Other sites can post forms, but not JSON without a preflight, so requests must say they are
+// JSON and come from an allowed origin; otherwise a cross-site form could log a victim in.
+func readJSONBody(w http.ResponseWriter, r *http.Request, v interface{}) bool {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeJSONError(w, http.StatusUnsupportedMediaType, "content type must be application/json")
+		return false
+	}
+	if !originAllowed(r) {
+		writeJSONError(w, http.StatusForbidden, "origin not allowed")
+		return false
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+		return false
+	}
+	return true
+}
@@ -0,0 +1,333 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	guestMode         = envBool("GUEST_MODE", true)                   // Allow anonymous users to pick a name
+	sessionLifetime   = envDuration("SESSION_LIFETIME", 24*time.Hour) // Validity of a login session
+	sessionSecret     = loadSessionSecret()
+	sessionCookieName = "gochat_session"
+	minPasswordLength = 8
+	maxPasswordLength = 72 // bcrypt ignores anything longer
+)
+
+// Account is a registered user
+type Account struct {
+	Username     string    `json:"username"`
+	PasswordHash []byte    `json:"password_hash,omitempty"` // Empty for single sign-on users
+	Provider     string    `json:"provider,omitempty"`      // Identity provider of single sign-on users
+	Subject      string    `json:"subject,omitempty"`       // Subject of the user at the identity provider
+	Roles        []Role    `json:"roles,omitempty"`         // Roles granted by an admin
+	Created      time.Time `json:"created"`
+}
+
+var errAccountNotFound = errors.New("account not found")
+
+// accountStore keeps accounts in memory and persists them to a JSON file
+type accountStore struct {
+	mu       sync.Mutex
+	path     string
+	accounts map[string]*Account // By lowercased username
+}
+
+var accounts = newAccountStore(filepath.Join(dataDir, "accounts.json"))
+
+func newAccountStore(path string) *accountStore {
+	return &accountStore{path: path, accounts: make(map[string]*Account)}
+}
+
+// load reads the accounts persisted by a previous run
+func (s *accountStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return loadJSONFile(s.path, &s.accounts)
+}
+
+// get returns a copy of an account
+func (s *accountStore) get(username string) (Account, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, exists := s.accounts[strings.ToLower(username)]
+	if !exists {
+		return Account{}, false
+	}
+	return *account, true
+}
+
+// create registers a new account and persists the store
+func (s *accountStore) create(account *Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := strings.ToLower(account.Username)
+	if _, exists := s.accounts[key]; exists {
+		return errUsernameTaken
+	}
+	s.accounts[key] = account
+	if err := saveJSONFile(s.path, s.accounts); err != nil {
+		delete(s.accounts, key)
+		return err
+	}
+	return nil
+}
+
+// setRole grants or revokes a role of an account and persists the store
+func (s *accountStore) setRole(username string, role Role, granted bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	account, exists := s.accounts[strings.ToLower(username)]
+	if !exists {
+		return errAccountNotFound
+	}
+	previous := account.Roles
+	var roles []Role
+	for _, existing := range account.Roles {
+		if existing != role {
+			roles = append(roles, existing)
+		}
+	}
+	if granted {
+		roles = append(roles, role)
+	}
+	account.Roles = roles
+	if err := saveJSONFile(s.path, s.accounts); err != nil {
+		account.Roles = previous
+		return err
+	}
+	return nil
+}
+
+// roleGrants lists the accounts that were granted roles
+func (s *accountStore) roleGrants() []roleGrant {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	grants := []roleGrant{}
+	for _, account := range s.accounts {
+		if len(account.Roles) > 0 {
+			grants = append(grants, roleGrant{Username: account.Username, Roles: account.Roles})
+		}
+	}
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Username < grants[j].Username })
+	return grants
+}
+
+// linkExternal returns the account of a single sign-on user, creating it on first login.
+// A name already used by another account is refused.
+func (s *accountStore) linkExternal(username, provider, subject string) error {
+	s.mu.Lock()
+	existing, exists := s.accounts[strings.ToLower(username)]
+	s.mu.Unlock()
+	if exists {
+		if existing.Provider != provider || existing.Subject != subject {
+			return errUsernameTaken
+		}
+		return nil
+	}
+	return s.create(&Account{Username: username, Provider: provider, Subject: subject, Created: time.Now().UTC()})
+}
+
+// Session is the identity carried by the signed session cookie
+type Session struct {
+	Username string   `json:"u"`
+	Provider string   `json:"p,omitempty"` // Set for single sign-on sessions
+	Roles    []string `json:"r,omitempty"` // Roles granted by the identity provider
+	Expires  int64    `json:"exp"`
+}
+
+// loadSessionSecret reads the key that signs session cookies. Without SESSION_SECRET
+// a random key is used, so sessions do not survive a restart.
+func loadSessionSecret() []byte {
+	if secret := envString("SESSION_SECRET", ""); secret != "" {
+		return []byte(secret)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		log.Fatalf("Error generating session secret: %v", err)
+	}
+	return secret
+}
+
+func signPayload(payload string) string {
+	mac := hmac.New(sha256.New, sessionSecret)
+	mac.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signJSON encodes v into a tamper-proof cookie value of the form <payload>.<signature>
+func signJSON(v interface{}) (string, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	return payload + "." + signPayload(payload), nil
+}
+
+// verifyJSON checks the signature of a value made by signJSON and decodes it into v
+func verifyJSON(value string, v interface{}) error {
+	payload, signature, found := strings.Cut(value, ".")
+	if !found || !hmac.Equal([]byte(signature), []byte(signPayload(payload))) {
+		return errors.New("invalid signature")
+	}
+	data, err := base64.RawURLEncoding.DecodeString(payload)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// encodeSession signs a session into a cookie value
+func encodeSession(session Session) (string, error) {
+	return signJSON(session)
+}
+
+// decodeSession verifies the signature and expiry of a cookie value
+func decodeSession(value string) (*Session, error) {
+	var session Session
+	if err := verifyJSON(value, &session); err != nil {
+		return nil, err
+	}
+	if time.Now().Unix() > session.Expires {
+		return nil, errors.New("session expired")
+	}
+	return &session, nil
+}
+
+// sessionFromRequest returns the session of a request, or nil for anonymous requests
+func sessionFromRequest(r *http.Request) *Session {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return nil
+	}
+	session, err := decodeSession(cookie.Value)
+	if err != nil {
+		return nil
+	}
+	return session
+}
+
+// startSession sets the session cookie for a user
+func startSession(w http.ResponseWriter, r *http.Request, session Session) error {
+	expires := time.Now().Add(sessionLifetime)
+	session.Expires = expires.Unix()
+	value, err := encodeSession(session)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     "/",
+		Expires:  expires,
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+type credentialsRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+func handleRegister(w http.ResponseWriter, r *http.Request) {
+	if ssoRequired {
+		writeJSONError(w, http.StatusForbidden, "Please sign in with single sign-on.")
+		return
+	}
+	var req credentialsRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	username, err := validateUsername(req.Username)
+	if err != nil {
+		writeJSONError(w, http.StatusBadRequest, usernameErrorText(err, username))
+		return
+	}
+	if len(req.Password) < minPasswordLength || len(req.Password) > maxPasswordLength {
+		writeJSONError(w, http.StatusBadRequest, "Passwords are 8 to 72 characters long.")
+		return
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
+	if err != nil {
+		log.Printf("Error hashing password: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "could not create account")
+		return
+	}
+	err = accounts.create(&Account{Username: username, PasswordHash: hash, Created: time.Now().UTC()})
+	if err == errUsernameTaken {
+		writeJSONError(w, http.StatusConflict, usernameErrorText(err, username))
+		return
+	}
+	if err != nil {
+		log.Printf("Error saving account: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "could not create account")
+		return
+	}
+
+	if err := startSession(w, r, Session{Username: username}); err != nil {
+		log.Printf("Error starting session: %v", err)
+	}
+	writeJSONResponse(w, http.StatusCreated, map[string]string{"username": username})
+}
+
+func handleLogin(w http.ResponseWriter, r *http.Request) {
+	if ssoRequired {
+		writeJSONError(w, http.StatusForbidden, "Please sign in with single sign-on.")
+		return
+	}
+	var req credentialsRequest
+	if !decodeJSONBody(w, r, &req) {
+		return
+	}
+	account, exists := accounts.get(strings.TrimSpace(req.Username))
+	if !exists || len(account.PasswordHash) == 0 ||
+		bcrypt.CompareHashAndPassword(account.PasswordHash, []byte(req.Password)) != nil {
+		writeJSONError(w, http.StatusUnauthorized, "Invalid username or password.")
+		return
+	}
+
+	if err := startSession(w, r, Session{Username: account.Username}); err != nil {
+		log.Printf("Error starting session: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "could not start session")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]string{"username": account.Username})
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	writeJSONResponse(w, http.StatusOK, map[string]string{})
+}
+
+// handleSession tells the frontend who is logged in and whether guests may join, along with
+// the CSRF token to open the WebSocket with
+func handleSession(w http.ResponseWriter, r *http.Request) {
+	response := map[string]interface{}{"guest_mode": guestMode && !ssoRequired, "sso": oidcEnabled(), "sso_required": ssoRequired}
+	if session := sessionFromRequest(r); session != nil {
+		response["username"] = session.Username
+		response["csrf_token"] = csrfTokenFor(r)
+	}
+	writeJSONResponse(w, http.StatusOK, response)
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTempAccounts swaps the account store for an empty one persisted in a temporary directory
+func useTempAccounts(t *testing.T) {
+	original := accounts
+	accounts = newAccountStore(filepath.Join(t.TempDir(), "accounts.json"))
+	t.Cleanup(func() { accounts = original })
+}
+
+// postJSON sends a JSON body to an API handler and returns the recorded response
+func postJSON(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/api", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	handler(w, req)
+	return w
+}
+
+func sessionCookie(t *testing.T, w *httptest.ResponseRecorder) *http.Cookie {
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == sessionCookieName {
+			return cookie
+		}
+	}
+	t.Fatal("Expected a session cookie")
+	return nil
+}
+
+func TestRegisterAndLogin(t *testing.T) {
+	useTempAccounts(t)
+
+	w := postJSON(handleRegister, `{"username": "Erin", "password": "correct horse"}`)
+	assert.Equal(t, http.StatusCreated, w.Code)
+	assert.True(t, sessionCookie(t, w).HttpOnly, "Expected the session cookie to be HTTP-only")
+
+	account, exists := accounts.get("erin")
+	assert.True(t, exists)
+	assert.NotContains(t, string(account.PasswordHash), "correct horse", "Expected the password to be hashed")
+
+	w = postJSON(handleRegister, `{"username": "ERIN", "password": "another password"}`)
+	assert.Equal(t, http.StatusConflict, w.Code, "Expected usernames to be unique whatever the case")
+	w = postJSON(handleRegister, `{"username": "Frank", "password": "short"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+
+	w = postJSON(handleLogin, `{"username": "erin", "password": "wrong password"}`)
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+	w = postJSON(handleLogin, `{"username": "erin", "password": "correct horse"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	session, err := decodeSession(sessionCookie(t, w).Value)
+	assert.NoError(t, err)
+	assert.Equal(t, "Erin", session.Username)
+
+	// The store survives a restart
+	reloaded := newAccountStore(accounts.path)
+	assert.NoError(t, reloaded.load())
+	_, exists = reloaded.get("Erin")
+	assert.True(t, exists)
+}
+
+func TestSessionTampering(t *testing.T) {
+	value, err := encodeSession(Session{Username: "Erin", Expires: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+
+	forged, err := encodeSession(Session{Username: "Admin", Expires: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	payload, _, _ := strings.Cut(forged, ".")
+	_, signature, _ := strings.Cut(value, ".")
+	_, err = decodeSession(payload + "." + signature)
+	assert.Error(t, err, "Expected a payload with another signature to be rejected")
+
+	expired, err := encodeSession(Session{Username: "Erin", Expires: time.Now().Add(-time.Minute).Unix()})
+	assert.NoError(t, err)
+	_, err = decodeSession(expired)
+	assert.Error(t, err, "Expected expired sessions to be rejected")
+}
+
+func TestUpgradeRequiresLoginWithoutGuestMode(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	guestMode = false
+	defer func() { guestMode = true }()
+	wsURL := startTestServer(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	w := postJSON(handleRegister, `{"username": "Grace", "password": "long enough"}`)
+	cookie := sessionCookie(t, w)
+	ws, _, err := websocket.DefaultDialer.Dial(withCSRF(wsURL, cookie.Value), http.Header{"Cookie": {cookie.String()}})
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer ws.Close()
+
+	sendTestMessage(t, ws, Message{Username: "Mallory", Message: "hello"})
+	assert.Equal(t, Message{Type: "joined", Username: "Grace", Room: lobbyRoom}, readTestMessage(t, ws))
+	assert.Equal(t, "Grace", readTestMessage(t, ws).Username, "Expected the account name to replace the client-supplied one")
+}
+
+func TestGuestsCannotTakeRegisteredNames(t *testing.T) {
+	useTempAccounts(t)
+	postJSON(handleRegister, `{"username": "Heidi", "password": "long enough"}`)
+
+	ws := dialTestClient(t, startTestServer(t))
+	assert.NoError(t, ws.WriteJSON(Message{Type: "join", Username: "heidi"}))
+	assert.Equal(t, "username_registered", readTestMessage(t, ws).Code)
+}
+
+func TestLoginRejectsGet(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleLogin(w, httptest.NewRequest(http.MethodGet, "/api/login", bytes.NewReader(nil)))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
+
+func TestCrossSiteFormsCannotLogIn(t *testing.T) {
+	useTempAccounts(t)
+	body := `{"username": "Mallory", "password": "long enough"}`
+
+	req := httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/plain")
+	w := httptest.NewRecorder()
+	handleRegister(w, req)
+	assert.Equal(t, http.StatusUnsupportedMediaType, w.Code, "Expected forms to be refused")
+	assert.Empty(t, w.Result().Cookies())
+
+	req = httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Origin", "https://evil.example")
+	w = httptest.NewRecorder()
+	handleRegister(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code, "Expected other origins to be refused")
+
+	req = httptest.NewRequest(http.MethodPost, "/api/register", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	req.Header.Set("Origin", "http://"+req.Host)
+	w = httptest.NewRecorder()
+	handleRegister(w, req)
+	assert.Equal(t, http.StatusCreated, w.Code, w.Body.String())
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// trustedProxies are the load balancers and ingresses allowed to tell us the address of the client,
+// in the one header they write. Other forwarding headers may come from the client and are ignored.
+var (
+	trustedProxies = parseCIDRs(envList("TRUSTED_PROXIES"))
+	clientIPHeader = http.CanonicalHeaderKey(envString("CLIENT_IP_HEADER", "X-Forwarded-For")) // X-Forwarded-For, Forwarded or X-Real-IP
+)
+
+// parseCIDRs reads networks such as "10.0.0.0/8"; a plain address stands for itself
+func parseCIDRs(entries []string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil {
+				bits := 128
+				if ip.To4() != nil {
+					ip, bits = ip.To4(), 32
+				}
+				entry = fmt.Sprintf("%s/%d", ip, bits)
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid trusted proxy %q: %v", entry, err)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHop reads an address as written in forwarding headers: "1.2.3.4", "1.2.3.4:80", "[::1]:80" or "::1"
+func parseHop(value string) net.IP {
+	value = strings.Trim(strings.TrimSpace(value), `"`)
+	if host, _, err := net.SplitHostPort(value); err == nil {
+		value = host
+	}
+	ip := net.ParseIP(strings.Trim(value, "[]"))
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip
+}
+
+// forwardedFor returns the addresses of the Forwarded header (RFC 7239), client first
+func forwardedFor(header http.Header) []string {
+	var hops []string
+	for _, value := range header.Values("Forwarded") {
+		for _, element := range strings.Split(value, ",") {
+			for _, pair := range strings.Split(element, ";") {
+				if name, address, found := strings.Cut(strings.TrimSpace(pair), "="); found && strings.EqualFold(name, "for") {
+					hops = append(hops, address)
+				}
+			}
+		}
+	}
+	return hops
+}
+
+// forwardingChain returns the addresses a request passed through according to the header our
+// proxies write, client first
+func forwardingChain(header http.Header) []string {
+	switch clientIPHeader {
+	case "Forwarded":
+		return forwardedFor(header)
+	case "X-Forwarded-For":
+		var hops []string
+		for _, value := range header.Values("X-Forwarded-For") {
+			hops = append(hops, strings.Split(value, ",")...)
+		}
+		return hops
+	default: // A header holding a single address, such as X-Real-IP
+		if address := header.Get(clientIPHeader); address != "" {
+			return []string{address}
+		}
+	}
+	return nil
+}
+
+// clientIP returns the address of the client behind a request. Forwarding headers are only
+// believed when they were added by a trusted proxy: the chain is walked back from the
+// connecting address, and the first hop that is not a trusted proxy is the client.
+func clientIP(r *http.Request) (string, bool) {
+	remote := parseHop(r.RemoteAddr)
+	if remote == nil {
+		return "", false
+	}
+	client := remote
+	chain := forwardingChain(r.Header)
+	for i := len(chain) - 1; i >= 0 && isTrustedProxy(client); i-- {
+		hop := parseHop(chain[i])
+		if hop == nil {
+			break // Garbage, e.g. "unknown": keep the last address we can vouch for
+		}
+		client = hop
+	}
+	return client.String(), true
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useTrustedProxies sets the trusted proxies for the duration of a test
+func useTrustedProxies(t *testing.T, entries ...string) {
+	original := trustedProxies
+	trustedProxies = parseCIDRs(entries)
+	t.Cleanup(func() { trustedProxies = original })
+}
+
+func TestClientIP(t *testing.T) {
+	useTrustedProxies(t, "10.0.0.0/8", "192.0.2.1", "2001:db8::/32")
+
+	cases := []struct {
+		name    string
+		source  string // Configured header, X-Forwarded-For when empty
+		remote  string
+		headers map[string][]string
+		want    string
+	}{
+		{"direct", "", "203.0.113.9:5000", nil, "203.0.113.9"},
+		{"untrusted hop cannot spoof", "", "203.0.113.9:5000", map[string][]string{"X-Forwarded-For": {"1.1.1.1"}}, "203.0.113.9"},
+		{"trusted proxy", "", "10.1.2.3:80", map[string][]string{"X-Forwarded-For": {"198.51.100.7"}}, "198.51.100.7"},
+		{"spoofed entry before the client", "", "10.1.2.3:80", map[string][]string{"X-Forwarded-For": {"6.6.6.6, 198.51.100.7, 10.9.9.9"}}, "198.51.100.7"},
+		{"repeated headers", "", "10.1.2.3:80", map[string][]string{"X-Forwarded-For": {"6.6.6.6", "198.51.100.7"}}, "198.51.100.7"},
+		{"single trusted address", "X-Real-IP", "192.0.2.1:443", map[string][]string{"X-Real-IP": {"198.51.100.8"}}, "198.51.100.8"},
+		{"forwarded header", "Forwarded", "10.1.2.3:80", map[string][]string{"Forwarded": {`for=6.6.6.6, for="[2001:db8:cafe::17]:4711";proto=https, for=198.51.100.9;by=10.0.0.1`}}, "198.51.100.9"},
+		{"ipv6 client through trusted ipv6 proxy", "forwarded", "[2001:db8::1]:443", map[string][]string{"Forwarded": {`for="[2001:db9::17]:4711"`}}, "2001:db9::17"},
+		{"garbage hop", "", "10.1.2.3:80", map[string][]string{"X-Forwarded-For": {"198.51.100.7, unknown"}}, "10.1.2.3"},
+		{"only proxies", "", "10.1.2.3:80", map[string][]string{"X-Forwarded-For": {"10.4.4.4"}}, "10.4.4.4"},
+
+		// Headers the proxy does not write come from the client
+		{"forged forwarded header", "", "10.1.2.3:80", map[string][]string{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"203.0.113.9"}}, "203.0.113.9"},
+		{"forged real ip", "", "10.1.2.3:80", map[string][]string{"X-Real-IP": {"198.51.100.1"}}, "10.1.2.3"},
+		{"forged forwarded-for", "Forwarded", "10.1.2.3:80", map[string][]string{"Forwarded": {"for=203.0.113.9"}, "X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.9"},
+	}
+	original := clientIPHeader
+	defer func() { clientIPHeader = original }()
+	for _, c := range cases {
+		clientIPHeader = "X-Forwarded-For"
+		if c.source != "" {
+			clientIPHeader = http.CanonicalHeaderKey(c.source)
+		}
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.RemoteAddr = c.remote
+		for name, values := range c.headers {
+			for _, value := range values {
+				req.Header.Add(name, value)
+			}
+		}
+		ip, ok := clientIP(req)
+		assert.True(t, ok, c.name)
+		assert.Equal(t, c.want, ip, c.name)
+	}
+}
+
+func TestParseCIDRsSkipsInvalidEntries(t *testing.T) {
+	networks := parseCIDRs([]string{"10.0.0.0/8", "not-an-ip", "::1", "172.16.0.0/33"})
+	if assert.Len(t, networks, 2) {
+		assert.Equal(t, "10.0.0.0/8", networks[0].String())
+		assert.Equal(t, "::1/128", networks[1].String())
+	}
+}
+
+func TestBansUseTheForwardedAddress(t *testing.T) {
+	useTempModeration(t)
+	useTrustedProxies(t, "127.0.0.1")
+	assert.NoError(t, moderation.add(Sanction{Kind: sanctionBan, Target: "198.51.100.66", By: "Max", Until: time.Now().Add(time.Hour)}))
+
+	request := func(forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+		req.RemoteAddr = "127.0.0.1:4321"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		handleConnections(w, req)
+		return w.Code
+	}
+	assert.Equal(t, http.StatusForbidden, request("198.51.100.66"))
+	assert.NotEqual(t, http.StatusForbidden, request("198.51.100.67"), "Expected other users behind the proxy to get in")
+}
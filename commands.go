@@ -0,0 +1,366 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ArgSpec describes one argument of a command
+type ArgSpec struct {
+	Name     string
+	Required bool
+	Rest     bool           // Takes the remaining text verbatim (only valid as the last argument)
+	Pattern  *regexp.Regexp // Optional validation of the argument
+}
+
+// Command is a slash command available in the chat
+type Command struct {
+	Name        string
+	Aliases     []string
+	Args        []ArgSpec
+	Permission  Permission // Needed to run the command, empty for everyone
+	Help        string
+	PrivateForm bool // Accepts "/name!" to force a private conversation
+	Run         func(ctx *CommandContext)
+}
+
+// CommandContext is passed to a command when it runs
+type CommandContext struct {
+	Client  *Client
+	Command *Command
+	Text    string            // The full message as typed
+	Args    map[string]string // Arguments by name; missing optional arguments are empty
+	Private bool              // The command was invoked with a trailing "!"
+}
+
+// reply sends a system message to the client that ran the command
+func (ctx *CommandContext) reply(format string, args ...interface{}) {
+	ctx.Client.notify(fmt.Sprintf(format, args...))
+}
+
+var (
+	commands       = make(map[string]*Command) // Commands by name and alias
+	commandPattern = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+)
+
+// registerCommand adds a command to the registry; clashing names are a programming error
+func registerCommand(cmd *Command) {
+	for _, name := range append([]string{cmd.Name}, cmd.Aliases...) {
+		if !commandPattern.MatchString(name) {
+			panic(fmt.Sprintf("invalid command name %q", name))
+		}
+		if _, exists := commands[name]; exists {
+			panic(fmt.Sprintf("command %q registered twice", name))
+		}
+		commands[name] = cmd
+	}
+}
+
+// usage renders the synopsis of a command, e.g. "/join <room>"
+func (cmd *Command) usage() string {
+	var b strings.Builder
+	b.WriteString("/" + cmd.Name)
+	for _, arg := range cmd.Args {
+		name := arg.Name
+		if arg.Rest {
+			name += "..."
+		}
+		if arg.Required {
+			b.WriteString(" <" + name + ">")
+		} else {
+			b.WriteString(" [" + name + "]")
+		}
+	}
+	return b.String()
+}
+
+// token is a word of a command line with its position in the original text
+type token struct {
+	value string
+	start int
+}
+
+// tokenize splits a command line on whitespace. Double quotes group words
+// and a backslash escapes the next character inside quotes. A quote that is
+// never closed, as in 6'2" tall, is an ordinary character.
+func tokenize(text string) []token {
+	literal := make(map[int]bool) // Offsets of the quotes that are kept as characters
+	for {
+		tokens, open := splitTokens(text, literal)
+		if open < 0 {
+			return tokens
+		}
+		literal[open] = true
+	}
+}
+
+// splitTokens does the work of tokenize. It returns the offset of the quote left open, or -1.
+func splitTokens(text string, literal map[int]bool) ([]token, int) {
+	var tokens []token
+	var current strings.Builder
+	inToken, inQuotes, escaped := false, false, false
+	start, open := 0, -1
+
+	for i, r := range text {
+		switch {
+		case escaped:
+			current.WriteRune(r)
+			escaped = false
+		case inQuotes && r == '\\':
+			escaped = true
+		case r == '"' && !literal[i]:
+			if !inToken {
+				inToken, start = true, i
+			}
+			inQuotes = !inQuotes
+			if inQuotes {
+				open = i
+			}
+		case !inQuotes && (r == ' ' || r == '\t' || r == '\n'):
+			if inToken {
+				tokens = append(tokens, token{value: current.String(), start: start})
+				current.Reset()
+				inToken = false
+			}
+		default:
+			if !inToken {
+				inToken, start = true, i
+			}
+			current.WriteRune(r)
+		}
+	}
+	if inQuotes {
+		return nil, open
+	}
+	if inToken {
+		tokens = append(tokens, token{value: current.String(), start: start})
+	}
+	return tokens, -1
+}
+
+// parseCommand resolves a command line against the registry and validates its arguments
+func parseCommand(text string) (*CommandContext, error) {
+	tokens := tokenize(text)
+	if len(tokens) == 0 || !strings.HasPrefix(tokens[0].value, "/") {
+		return nil, fmt.Errorf("not a command")
+	}
+
+	name := strings.ToLower(strings.TrimPrefix(tokens[0].value, "/"))
+	ctx := &CommandContext{Text: text, Args: make(map[string]string)}
+	if strings.HasSuffix(name, "!") {
+		name = strings.TrimSuffix(name, "!")
+		ctx.Private = true
+	}
+
+	cmd, exists := commands[name]
+	if !exists || (ctx.Private && !cmd.PrivateForm) {
+		return nil, fmt.Errorf("unknown command /%s. Type /help for the list of commands", name)
+	}
+	ctx.Command = cmd
+
+	args := tokens[1:]
+	for i, spec := range cmd.Args {
+		if i >= len(args) {
+			if spec.Required {
+				return nil, fmt.Errorf("usage: %s", cmd.usage())
+			}
+			break
+		}
+		value := args[i].value
+		if spec.Rest {
+			value = strings.TrimSpace(text[args[i].start:])
+		}
+		if spec.Pattern != nil && !spec.Pattern.MatchString(value) {
+			return nil, fmt.Errorf("invalid %s %q. Usage: %s", spec.Name, value, cmd.usage())
+		}
+		ctx.Args[spec.Name] = value
+		if spec.Rest {
+			return ctx, nil
+		}
+	}
+	if len(args) > len(cmd.Args) {
+		return nil, fmt.Errorf("too many arguments. Usage: %s", cmd.usage())
+	}
+	return ctx, nil
+}
+
+// dispatchCommand runs a slash command on behalf of a client
+func dispatchCommand(client *Client, text string) {
+	ctx, err := parseCommand(text)
+	if err != nil {
+		client.notify(capitalize(err.Error()))
+		return
+	}
+	if !client.can(ctx.Command.Permission) {
+		client.notify("You are not allowed to use /" + ctx.Command.Name)
+		return
+	}
+	ctx.Client = client
+	ctx.Command.Run(ctx)
+}
+
+func capitalize(text string) string {
+	if text == "" {
+		return text
+	}
+	return strings.ToUpper(text[:1]) + text[1:]
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "help",
+		Aliases: []string{"commands"},
+		Args:    []ArgSpec{{Name: "command"}},
+		Help:    "List the available commands, or show the details of one command",
+		Run:     runHelp,
+	})
+	registerCommand(&Command{
+		Name: "reset",
+		Help: "Start a new conversation with the bots",
+		Run: func(ctx *CommandContext) {
+			ctx.Client.sessionID = fmt.Sprintf("session-%d", time.Now().UnixNano())
+			ctx.reply("Your bot conversations were reset")
+		},
+	})
+	registerCommand(&Command{
+		Name:    "botevent",
+		Aliases: []string{"event"},
+		Args:    []ArgSpec{{Name: "bot", Required: true}, {Name: "event", Required: true}},
+		Help:    "Trigger a custom event on a bot, e.g. /botevent bot1 order.status",
+		Run:     runBotEvent,
+	})
+	registerBotCommands()
+}
+
+func runHelp(ctx *CommandContext) {
+	if name := strings.TrimPrefix(strings.ToLower(ctx.Args["command"]), "/"); name != "" {
+		cmd, exists := commands[strings.TrimSuffix(name, "!")]
+		if !exists || !ctx.Client.can(cmd.Permission) {
+			ctx.reply("Unknown command /%s", name)
+			return
+		}
+		help := cmd.usage() + "\n" + cmd.Help
+		if len(cmd.Aliases) > 0 {
+			help += "\nAliases: /" + strings.Join(cmd.Aliases, ", /")
+		}
+		if cmd.PrivateForm {
+			help += "\nUse /" + cmd.Name + "! to keep the conversation private"
+		}
+		ctx.reply("%s", help)
+		return
+	}
+
+	var lines []string
+	for name, cmd := range commands {
+		if name != cmd.Name || !ctx.Client.can(cmd.Permission) {
+			continue // Skip aliases and commands the client cannot run
+		}
+		lines = append(lines, cmd.usage()+" - "+cmd.Help)
+	}
+	sort.Strings(lines)
+	ctx.reply("Available commands:\n%s\nType /help <command> for details.", strings.Join(lines, "\n"))
+}
+
+// registerBotCommands registers a /botN command for every Dialogflow agent
+func registerBotCommands() {
+	for botCommand := range botAgentMap {
+		registerCommand(&Command{
+			Name:        strings.TrimPrefix(botCommand, "/"),
+			Args:        []ArgSpec{{Name: "query", Rest: true}},
+			Help:        "Ask the " + botNames[botCommand] + " bot. Without a query the bot greets you",
+			Permission:  botPermission(botCommand),
+			PrivateForm: true,
+			Run:         runBotQuery,
+		})
+	}
+}
+
+// botReplyTemplate returns the message every reply of a bot conversation is based on
+func botReplyTemplate(client *Client, private bool) Message {
+	reply := Message{Username: "Bot", Room: client.room}
+	if private {
+		reply.Private = true
+		reply.recipient = authorID(client)
+	}
+	return reply
+}
+
+// isPrivateBotConversation reports whether a bot conversation may only be seen by the asking user
+func isPrivateBotConversation(botCommand string, forced bool) bool {
+	return forced || botVisibility[botCommand] == botPrivate
+}
+
+// echoBotQuery shows a bot query to the room with the same visibility as the replies. Queries are
+// chat messages too, so they pass the spam checks and content filters first. It returns the arguments
+// of the filtered query, which are what the bot gets, and whether the query may go to the bot at all.
+// Bots cannot wait for a moderator, so queries a filter flags are refused, as edits are.
+func echoBotQuery(ctx *CommandContext, reply Message) (map[string]string, bool) {
+	if checkSpam(ctx.Client, ctx.Text) {
+		return nil, false
+	}
+	result := filterMessage(ctx.Client, ctx.Text)
+	if result.Action == filterReject || result.Action == filterFlag {
+		ctx.Client.writeJSON(Message{Type: "error", Code: "message_rejected", Username: "System", Message: "Your message was not sent: " + result.Reason, Room: ctx.Client.room})
+		return nil, false
+	}
+	filtered, err := parseCommand(result.Text)
+	if err != nil || filtered.Command != ctx.Command {
+		ctx.Client.writeJSON(Message{Type: "error", Code: "message_rejected", Username: "System", Message: "Your message was not sent: the filters changed the command", Room: ctx.Client.room})
+		return nil, false
+	}
+	echo := reply
+	echo.Username = ctx.Client.username
+	echo.Message = result.Text
+	broadcast <- echo
+	return filtered.Args, true
+}
+
+func runBotQuery(ctx *CommandContext) {
+	botCommand := "/" + ctx.Command.Name
+	if !allowBotQuery(ctx.Client) {
+		return
+	}
+	reply := botReplyTemplate(ctx.Client, isPrivateBotConversation(botCommand, ctx.Private))
+	args, ok := echoBotQuery(ctx, reply)
+	if !ok {
+		return
+	}
+
+	// A bare "/botN" starts the conversation with the agent's welcome event instead
+	agentID := botAgentMap[botCommand]
+	var botResponses []string
+	var err error
+	if query := args["query"]; query == "" {
+		botResponses, err = sendBotEvent(ctx.Client.sessionID, botWelcomeEvent, agentID)
+	} else {
+		botResponses, err = sendBotText(ctx.Client.sessionID, query, agentID)
+	}
+	broadcastBotResponses(reply, botResponses, err)
+}
+
+func runBotEvent(ctx *CommandContext) {
+	botCommand := "/" + strings.TrimPrefix(ctx.Args["bot"], "/")
+	agentID, exists := botAgentMap[botCommand]
+	if !exists {
+		ctx.reply("Invalid bot %q. Type /help to see the bots.", ctx.Args["bot"])
+		return
+	}
+	if !ctx.Client.can(botPermission(botCommand)) {
+		ctx.reply("You are not allowed to use %s", botCommand)
+		return
+	}
+	if !allowBotQuery(ctx.Client) {
+		return
+	}
+	reply := botReplyTemplate(ctx.Client, isPrivateBotConversation(botCommand, false))
+	args, ok := echoBotQuery(ctx, reply)
+	if !ok {
+		return
+	}
+
+	botResponses, err := sendBotEvent(ctx.Client.sessionID, args["event"], agentID)
+	broadcastBotResponses(reply, botResponses, err)
+}
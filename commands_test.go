@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTokenize(t *testing.T) {
+	values := func(tokens []token) []string {
+		var values []string
+		for _, tok := range tokens {
+			values = append(values, tok.value)
+		}
+		return values
+	}
+	tokens := tokenize(`/kick  "Jane Doe" spamming \n`)
+	assert.Equal(t, []string{"/kick", "Jane Doe", "spamming", `\n`}, values(tokens))
+	assert.Equal(t, 7, tokens[1].start, "Expected token offsets into the original text")
+
+	assert.Equal(t, []string{"/join", `"lobby`}, values(tokenize(`/join "lobby`)), "Expected an unterminated quote to be kept")
+	assert.Equal(t, []string{"/kick", "Jane Doe", `6'2"`, "tall"}, values(tokenize(`/kick "Jane Doe" 6'2" tall`)))
+}
+
+func TestUnbalancedQuotesInCommands(t *testing.T) {
+	ctx, err := parseCommand(`/bot1 I am 6'2" tall`)
+	assert.NoError(t, err)
+	assert.Equal(t, `I am 6'2" tall`, ctx.Args["query"], "Expected the query to reach the bot as typed")
+
+	ctx, err = parseCommand(`/nick Bob "the builder`)
+	assert.NoError(t, err)
+	assert.Equal(t, `Bob "the builder`, ctx.Args["name"])
+
+	_, err = parseCommand(`/join "lobby`)
+	assert.Error(t, err, "Expected the quote to be part of the room name")
+}
+
+func TestParseBotCommands(t *testing.T) {
+	ctx, err := parseCommand("/bot1   Where is   my flight?")
+	assert.NoError(t, err)
+	assert.Equal(t, "bot1", ctx.Command.Name)
+	assert.Equal(t, "Where is   my flight?", ctx.Args["query"], "Expected the query to be kept verbatim")
+	assert.False(t, ctx.Private)
+
+	ctx, err = parseCommand("/BOT7!")
+	assert.NoError(t, err)
+	assert.True(t, ctx.Private, "Expected /botN! to request a private conversation")
+	assert.Empty(t, ctx.Args["query"])
+
+	_, err = parseCommand("/botany is fun")
+	assert.Error(t, err, "Expected /botany not to be mistaken for a bot command")
+	_, err = parseCommand("/join! lobby")
+	assert.Error(t, err, "Expected the private form to be limited to bots")
+}
+
+func TestParseBotTenCommand(t *testing.T) {
+	botAgentMap["/bot10"] = "test-agent"
+	botNames["/bot10"] = "Test"
+	registerCommand(&Command{Name: "bot10", Args: []ArgSpec{{Name: "query", Rest: true}}, Run: runBotQuery})
+	defer func() {
+		delete(botAgentMap, "/bot10")
+		delete(botNames, "/bot10")
+		delete(commands, "bot10")
+	}()
+
+	ctx, err := parseCommand("/bot10 hi")
+	assert.NoError(t, err)
+	assert.Equal(t, "bot10", ctx.Command.Name)
+	assert.Equal(t, "hi", ctx.Args["query"])
+}
+
+func TestParseCommandArguments(t *testing.T) {
+	_, err := parseCommand("/join")
+	assert.EqualError(t, err, "usage: /join <room>")
+	_, err = parseCommand("/join Not-A-Room")
+	assert.Error(t, err, "Expected the room pattern to be enforced")
+	_, err = parseCommand("/join a b")
+	assert.Error(t, err, "Expected extra arguments to be rejected")
+
+	ctx, err := parseCommand("/j support")
+	assert.NoError(t, err)
+	assert.Equal(t, "join", ctx.Command.Name, "Expected aliases to resolve")
+	assert.Equal(t, "support", ctx.Args["room"])
+}
+
+func TestHelpCommand(t *testing.T) {
+	ws := joinTestClient(t, startTestServer(t), "Alice")
+
+	sendTestMessage(t, ws, Message{Username: "Alice", Message: "/help"})
+	msg := readTestMessage(t, ws)
+	assert.Equal(t, "System", msg.Username)
+	assert.Contains(t, msg.Message, "/join <room> - Switch to another room")
+	assert.Contains(t, msg.Message, "/bot2 [query...] - Ask the Small Talk bot")
+	assert.NotContains(t, msg.Message, "/bot7", "Expected guests not to see the bots they cannot use")
+	assert.NotContains(t, msg.Message, "/roombot")
+
+	sendTestMessage(t, ws, Message{Username: "Alice", Message: "/help /j"})
+	msg = readTestMessage(t, ws)
+	assert.Contains(t, msg.Message, "/join <room>")
+	assert.Contains(t, msg.Message, "Aliases: /j")
+
+	sendTestMessage(t, ws, Message{Username: "Alice", Message: "/nope"})
+	assert.Equal(t, "Unknown command /nope. Type /help for the list of commands", readTestMessage(t, ws).Message)
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Sources of the Dialogflow service account key, in order of precedence
+var (
+	credentialsEnvVar     = "DIALOGFLOW_CREDENTIALS"                                 // Base64-encoded key
+	credentialsFile       = envString("DIALOGFLOW_CREDENTIALS_FILE", "")             // Mounted key file, e.g. a Kubernetes secret
+	secretStoreDir        = envString("SECRET_STORE_DIR", "")                        // Local secret store: one file per secret
+	credentialsSecret     = envString("DIALOGFLOW_CREDENTIALS_SECRET", "dialogflow") // Name of the key in the secret store
+	secretReloadInterval  = envDuration("SECRET_RELOAD_INTERVAL", 30*time.Second)    // How often files are checked for rotation
+	errNoCredentialSource = fmt.Errorf("no Dialogflow credentials configured: set DIALOGFLOW_CREDENTIALS_FILE, %s or SECRET_STORE_DIR", credentialsEnvVar)
+)
+
+// credentialProvider supplies the service account key of the bots. Keys are secrets:
+// they must never be logged, so errors and String only ever name the source.
+type credentialProvider interface {
+	credentials() ([]byte, error)
+	String() string
+}
+
+// botCredentials is set at startup by loadCredentialProvider
+var botCredentials credentialProvider
+
+// staticCredentials is a key read once, from an environment variable
+type staticCredentials struct {
+	source string
+	key    []byte
+}
+
+func (c *staticCredentials) credentials() ([]byte, error) { return c.key, nil }
+func (c *staticCredentials) String() string               { return c.source }
+
+// watchedFile caches the contents of a file and reads it again when it changes, so rotated secrets are picked up
+type watchedFile struct {
+	path string
+
+	mu       sync.Mutex
+	contents []byte
+	modTime  time.Time
+}
+
+// read returns the contents of the file, loading them on first use
+func (f *watchedFile) read() ([]byte, error) {
+	f.mu.Lock()
+	loaded := f.contents != nil
+	f.mu.Unlock()
+	if !loaded {
+		if _, err := f.reloadIfChanged(); err != nil {
+			return nil, err
+		}
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.contents, nil
+}
+
+// reloadIfChanged reads the file again if it was modified, reporting whether it did.
+// On error the previous contents are kept.
+func (f *watchedFile) reloadIfChanged() (bool, error) {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.contents != nil && info.ModTime().Equal(f.modTime) {
+		return false, nil
+	}
+	contents, err := os.ReadFile(f.path)
+	if err != nil {
+		return false, err
+	}
+	f.contents, f.modTime = contents, info.ModTime()
+	return true, nil
+}
+
+func (f *watchedFile) credentials() ([]byte, error) { return f.read() }
+func (f *watchedFile) String() string               { return "file " + f.path }
+
+// secretStore is a local stand-in for a secret manager: a directory holding one file per
+// secret, named after it. Secrets are rotated by replacing their file.
+type secretStore struct {
+	dir string
+
+	mu      sync.Mutex
+	secrets map[string]*watchedFile
+}
+
+func newSecretStore(dir string) *secretStore {
+	return &secretStore{dir: dir, secrets: make(map[string]*watchedFile)}
+}
+
+// access returns the current value of a secret
+func (s *secretStore) access(name string) ([]byte, error) {
+	if name == "" || name != filepath.Base(name) || name[0] == '.' {
+		return nil, fmt.Errorf("invalid secret name %q", name)
+	}
+	s.mu.Lock()
+	secret, exists := s.secrets[name]
+	if !exists {
+		secret = &watchedFile{path: filepath.Join(s.dir, name)}
+		s.secrets[name] = secret
+	}
+	s.mu.Unlock()
+	value, err := secret.read()
+	if err != nil {
+		return nil, fmt.Errorf("secret %s not found in %s", name, s.dir)
+	}
+	return value, nil
+}
+
+// rotate reloads the secrets whose files changed
+func (s *secretStore) rotate() {
+	s.mu.Lock()
+	var secrets []*watchedFile
+	for _, secret := range s.secrets {
+		secrets = append(secrets, secret)
+	}
+	s.mu.Unlock()
+	for _, secret := range secrets {
+		watchForRotation(secret)
+	}
+}
+
+// storedCredentials reads the key from the secret store
+type storedCredentials struct {
+	store *secretStore
+	name  string
+}
+
+func (c *storedCredentials) credentials() ([]byte, error) { return c.store.access(c.name) }
+func (c *storedCredentials) String() string {
+	return fmt.Sprintf("secret %s in %s", c.name, c.store.dir)
+}
+
+// watchForRotation reloads a file if it changed, logging its name but never its contents
+func watchForRotation(file *watchedFile) {
+	reloaded, err := file.reloadIfChanged()
+	if err != nil {
+		log.Printf("Error reloading %s, keeping the previous value: %v", file.path, err)
+	} else if reloaded {
+		log.Printf("Reloaded rotated secret from %s", file.path)
+	}
+}
+
+// loadCredentialProvider picks the configured source of the bot credentials and checks
+// that it holds a service account key. It fails when no source is configured.
+func loadCredentialProvider() (credentialProvider, error) {
+	var provider credentialProvider
+	var watch func()
+	switch {
+	case os.Getenv(credentialsEnvVar) != "":
+		key, err := base64.StdEncoding.DecodeString(os.Getenv(credentialsEnvVar))
+		if err != nil {
+			return nil, fmt.Errorf("%s is not valid base64", credentialsEnvVar)
+		}
+		provider = &staticCredentials{source: "environment variable " + credentialsEnvVar, key: key}
+	case credentialsFile != "":
+		file := &watchedFile{path: credentialsFile}
+		provider, watch = file, func() { watchForRotation(file) }
+	case secretStoreDir != "":
+		store := newSecretStore(secretStoreDir)
+		provider, watch = &storedCredentials{store: store, name: credentialsSecret}, store.rotate
+	default:
+		return nil, errNoCredentialSource
+	}
+
+	key, err := provider.credentials()
+	if err != nil {
+		return nil, err
+	}
+	if err := checkServiceAccountKey(key); err != nil {
+		return nil, fmt.Errorf("%s: %v", provider, err)
+	}
+	if watch != nil {
+		go func() {
+			for range time.Tick(secretReloadInterval) {
+				watch()
+			}
+		}()
+	}
+	return provider, nil
+}
+
+// checkServiceAccountKey makes sure a key looks like a service account key, without quoting it in errors
+func checkServiceAccountKey(key []byte) error {
+	var fields struct {
+		Type string `json:"type"`
+	}
+	if err := json.NewDecoder(bytes.NewReader(key)).Decode(&fields); err != nil {
+		return errors.New("credentials are not valid JSON")
+	}
+	if fields.Type == "" {
+		return errors.New("credentials have no type; expected a service account key")
+	}
+	return nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// editWindow is how long authors may edit or delete their own messages; moderators may at any time
+var editWindow = envDuration("EDIT_WINDOW", 15*time.Minute)
+
+var (
+	errMessageDeleted   = errors.New("message was deleted")
+	errChangeForbidden  = errors.New("not allowed to change message")
+	errEditWindowClosed = errors.New("edit window closed")
+)
+
+// authorID identifies who sent a message more lastingly than a display name, which guests give
+// up when they leave or change it: the account, or for guests the connection
+func authorID(client *Client) string {
+	if client.account != "" {
+		return "account:" + strings.ToLower(client.account)
+	}
+	return "guest:" + client.id
+}
+
+// mayChange checks that a client may edit or delete a stored message
+func mayChange(client *Client, stored *Message, moderator bool) error {
+	if stored.Deleted {
+		return errMessageDeleted
+	}
+	if moderator {
+		return nil
+	}
+	if stored.author == "" || stored.author != authorID(client) {
+		return errChangeForbidden
+	}
+	if time.Since(time.UnixMilli(stored.Time)) > editWindow {
+		return errEditWindowClosed
+	}
+	return nil
+}
+
+// changeMessage handles an edit or delete frame for a message of the room of the client.
+// The room sees the new text, or a delete frame; deleted messages stay in the history as tombstones.
+func changeMessage(client *Client, msg Message) {
+	moderator := client.can(permMessages)
+	if msg.Type == "edit" && !moderator && !client.can(permSend) {
+		client.notify("You are not allowed to send messages")
+		return
+	}
+
+	// Edits pass the content filters of the room like new messages; held messages cannot wait for review here
+	text := ""
+	if msg.Type == "edit" {
+		if strings.TrimSpace(msg.Message) == "" {
+			client.writeJSON(Message{Type: "error", Code: "message_empty", Username: "System", Message: "Send a delete frame to remove a message", Room: client.room})
+			return
+		}
+		result := filterMessage(client, msg.Message)
+		if result.Action == filterReject || result.Action == filterFlag {
+			client.writeJSON(Message{Type: "error", Code: "message_rejected", Username: "System", Message: "Your edit was not saved: " + result.Reason, Room: client.room})
+			return
+		}
+		text = result.Text
+	}
+
+	now := time.Now().UnixMilli()
+	changed, err := history.update(client.room, msg.ID, func(stored *Message) error {
+		if err := mayChange(client, stored, moderator); err != nil {
+			return err
+		}
+		if msg.Type == "edit" {
+			stored.Message, stored.HTML, stored.Edited = text, renderMarkdown(text), now
+		} else {
+			stored.Message, stored.HTML, stored.Reactions, stored.Deleted = "", "", nil, true
+		}
+		return nil
+	})
+	switch {
+	case errors.Is(err, errMessageNotFound), errors.Is(err, errMessageDeleted):
+		client.writeJSON(Message{Type: "error", Code: "message_not_found", Username: "System", Message: "There is no such message in this room", Room: client.room})
+		return
+	case errors.Is(err, errChangeForbidden):
+		client.writeJSON(Message{Type: "error", Code: "message_forbidden", Username: "System", Message: "You can only change your own messages", Room: client.room})
+		return
+	case errors.Is(err, errEditWindowClosed):
+		client.writeJSON(Message{Type: "error", Code: "edit_window_closed", Username: "System", Message: "Messages can only be changed for " + editWindow.String() + " after sending them", Room: client.room})
+		return
+	}
+
+	if changed.author != authorID(client) {
+		writeAudit(AuditEntry{Actor: client.username, Action: msg.Type, Target: changed.Username, Reason: fmt.Sprintf("message #%d in %s", changed.ID, changed.Room)})
+	}
+	frame := Message{Type: msg.Type, ID: changed.ID, Username: changed.Username, Room: changed.Room, Time: changed.Time, ParentID: changed.ParentID}
+	if msg.Type == "edit" {
+		frame.Message, frame.HTML, frame.Edited = changed.Message, changed.HTML, changed.Edited
+	} else {
+		frame.Deleted = true
+	}
+	broadcast <- frame
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuthorsEditAndDeleteTheirMessages(t *testing.T) {
+	useTempAccounts(t)
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	alice := joinTestClient(t, wsURL, "Alice")
+	bob := joinTestClient(t, wsURL, "Bob")
+	sendTestMessage(t, alice, Message{Message: "my pasword is hunter2"})
+	sent := readTestMessage(t, bob)
+	readTestMessage(t, alice)
+
+	sendTestMessage(t, bob, Message{Type: "edit", ID: sent.ID, Message: "mine now"})
+	assert.Equal(t, "message_forbidden", readTestMessage(t, bob).Code, "Expected others' messages to be refused")
+
+	sendTestMessage(t, alice, Message{Type: "edit", ID: sent.ID, Message: "my **password**"})
+	edit := readTestMessage(t, bob)
+	assert.Equal(t, "edit", edit.Type)
+	assert.Equal(t, sent.ID, edit.ID)
+	assert.Equal(t, "Alice", edit.Username)
+	assert.Equal(t, "my **password**", edit.Message)
+	assert.Contains(t, edit.HTML, "<strong>password</strong>")
+	assert.NotZero(t, edit.Edited)
+	assert.Equal(t, "edit", readTestMessage(t, alice).Type, "Expected the author to see the edit too")
+
+	sendTestMessage(t, alice, Message{Type: "delete", ID: sent.ID})
+	assert.Equal(t, Message{Type: "delete", ID: sent.ID, Time: sent.Time, Username: "Alice", Room: lobbyRoom, Deleted: true}, readTestMessage(t, bob))
+	readTestMessage(t, alice)
+
+	// The tombstone keeps the place of the message, without its text
+	stored := history.messages(lobbyRoom, 0, 10)
+	if assert.Len(t, stored, 1) {
+		assert.True(t, stored[0].Deleted)
+		assert.Empty(t, stored[0].Message)
+		assert.Empty(t, stored[0].HTML)
+	}
+	sendTestMessage(t, alice, Message{Type: "edit", ID: sent.ID, Message: "back"})
+	assert.Equal(t, "message_not_found", readTestMessage(t, alice).Code, "Expected tombstones to stay deleted")
+	sendTestMessage(t, alice, Message{Type: "delete", ID: 999})
+	assert.Equal(t, "message_not_found", readTestMessage(t, alice).Code)
+}
+
+func TestGuestsKeepTheirMessagesAfterReset(t *testing.T) {
+	useTempAccounts(t)
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	alice := joinTestClient(t, wsURL, "Alice")
+	sendTestMessage(t, alice, Message{Message: "helo"})
+	sent := readTestMessage(t, alice)
+
+	sendTestMessage(t, alice, Message{Message: "/reset"})
+	assert.Equal(t, "Your bot conversations were reset", readTestMessage(t, alice).Message)
+	sendTestMessage(t, alice, Message{Type: "edit", ID: sent.ID, Message: "hello"})
+	assert.Equal(t, "edit", readTestMessage(t, alice).Type, "Expected a new bot conversation to keep the authorship")
+}
+
+func TestEditWindowAndModerators(t *testing.T) {
+	useTempAccounts(t)
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	originalWindow := editWindow
+	editWindow = 50 * time.Millisecond
+	defer func() { editWindow = originalWindow }()
+
+	erin := joinTestClient(t, wsURL, "Erin")
+	mod := joinTestAccount(t, wsURL, "Mod", roleModerator)
+	sendTestMessage(t, erin, Message{Message: "first"})
+	sent := readTestMessage(t, erin)
+	readTestMessage(t, mod)
+	time.Sleep(60 * time.Millisecond)
+
+	sendTestMessage(t, erin, Message{Type: "delete", ID: sent.ID})
+	assert.Equal(t, "edit_window_closed", readTestMessage(t, erin).Code)
+
+	sendTestMessage(t, mod, Message{Type: "delete", ID: sent.ID})
+	assert.Equal(t, "delete", readTestMessage(t, erin).Type, "Expected moderators to delete at any time")
+	readTestMessage(t, mod)
+
+	entries, err := readAudit(10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "Mod", entries[0].Actor)
+		assert.Equal(t, "delete", entries[0].Action)
+		assert.Equal(t, "Erin", entries[0].Target)
+	}
+	assert.Empty(t, history.unread("Mod"), "Expected no counts without a marker")
+	history.markRead(lobbyRoom, "Mod", sent.ID)
+	assert.Equal(t, map[string]int{lobbyRoom: 0}, history.unread("Mod"))
+}
+
+func TestEditsPassTheContentFilters(t *testing.T) {
+	useTempAccounts(t)
+	useTempFilters(t, &FilterConfig{Default: []*FilterRule{{Type: "words", Words: []string{"darn"}, Action: filterReject}}})
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	frank := joinTestClient(t, wsURL, "Frank")
+	sendTestMessage(t, frank, Message{Message: "hello"})
+	sent := readTestMessage(t, frank)
+	sendTestMessage(t, frank, Message{Type: "edit", ID: sent.ID, Message: "darn"})
+	assert.Equal(t, "message_rejected", readTestMessage(t, frank).Code)
+	sendTestMessage(t, frank, Message{Type: "edit", ID: sent.ID, Message: "  "})
+	assert.Equal(t, "message_empty", readTestMessage(t, frank).Code)
+	assert.Equal(t, "hello", history.messages(lobbyRoom, 0, 1)[0].Message)
+}
+
+func TestAuthorshipOutlivesDisplayNames(t *testing.T) {
+	useTempAccounts(t)
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	first := joinTestClient(t, wsURL, "Olga")
+	sendTestMessage(t, first, Message{Message: "my secret"})
+	sent := readTestMessage(t, first)
+	first.Close()
+	time.Sleep(20 * time.Millisecond) // The name is released on disconnect
+
+	impostor := joinTestClient(t, wsURL, "Olga")
+	sendTestMessage(t, impostor, Message{Type: "delete", ID: sent.ID})
+	assert.Equal(t, "message_forbidden", readTestMessage(t, impostor).Code, "Expected a guest taking a freed name to not own its messages")
+
+	// Accounts keep their messages across connections
+	paul := joinTestAccount(t, wsURL, "Paul")
+	sendTestMessage(t, paul, Message{Message: "typo"})
+	typo := readTestMessage(t, paul)
+	paul.Close()
+	again := joinTestAccount(t, wsURL, "Paul")
+	sendTestMessage(t, again, Message{Type: "edit", ID: typo.ID, Message: "fixed"})
+	assert.Equal(t, "fixed", readTestMessage(t, again).Message)
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// FilterAction is what a content filter does with a message that matches it
+type FilterAction string
+
+const (
+	filterAllow  FilterAction = "allow"  // Deliver the message without running the remaining filters
+	filterMask   FilterAction = "mask"   // Hide the matching parts and keep filtering
+	filterReject FilterAction = "reject" // Refuse the message
+	filterFlag   FilterAction = "flag"   // Hold the message for a moderator to review
+)
+
+// Kinds of filter rules
+const (
+	filterWords = "words" // Word list, matched after undoing leet speak
+	filterRegex = "regex" // Regular expression
+	filterLinks = "links" // Links posted by guests and recently registered users
+	filterCaps  = "caps"  // Messages written mostly in capitals
+)
+
+// FilterRule is one filter of a chain, as configured in the filter file
+type FilterRule struct {
+	Type         string       `json:"type"`
+	Action       FilterAction `json:"action"`
+	Words        []string     `json:"words,omitempty"`          // words
+	Pattern      string       `json:"pattern,omitempty"`        // regex
+	NewUserAge   string       `json:"new_user_age,omitempty"`   // links: accounts younger than this are new, e.g. "24h"
+	MaxCapsRatio float64      `json:"max_caps_ratio,omitempty"` // caps: share of capital letters allowed
+	MinLength    int          `json:"min_length,omitempty"`     // caps: shorter messages are not checked
+
+	words      map[string]bool
+	regex      *regexp.Regexp
+	newUserAge time.Duration
+}
+
+// FilterConfig holds the default filter chain and the chains of rooms that override it
+type FilterConfig struct {
+	Default []*FilterRule            `json:"default"`
+	Rooms   map[string][]*FilterRule `json:"rooms,omitempty"`
+}
+
+var (
+	filterConfigPath = envString("FILTER_CONFIG", filepath.Join(dataDir, "filters.json"))
+	filtersMu        sync.Mutex
+	filters          = defaultFilterConfig()
+)
+
+// defaultFilterConfig is used until a filter file is saved: no links from new users and no shouting
+func defaultFilterConfig() *FilterConfig {
+	config := &FilterConfig{Default: []*FilterRule{
+		{Type: filterLinks, Action: filterReject, NewUserAge: "24h"},
+		{Type: filterCaps, Action: filterMask, MaxCapsRatio: 0.7, MinLength: 12},
+	}}
+	if err := config.compile(); err != nil {
+		panic(err)
+	}
+	return config
+}
+
+// compile validates the rules and prepares them for matching
+func (c *FilterConfig) compile() error {
+	chains := map[string][]*FilterRule{"default": c.Default}
+	for room, rules := range c.Rooms {
+		if !roomNamePattern.MatchString(room) {
+			return fmt.Errorf("invalid room %q", room)
+		}
+		chains[room] = rules
+	}
+	for chain, rules := range chains {
+		for i, rule := range rules {
+			if err := rule.compile(); err != nil {
+				return fmt.Errorf("%s filter %d: %v", chain, i+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (r *FilterRule) compile() error {
+	switch r.Action {
+	case filterAllow, filterMask, filterReject, filterFlag:
+	default:
+		return fmt.Errorf("unknown action %q", r.Action)
+	}
+	switch r.Type {
+	case filterWords:
+		r.words = make(map[string]bool)
+		for _, word := range r.Words {
+			if normalized := normalizeLeet(word); normalized != "" {
+				r.words[normalized] = true
+			}
+		}
+	case filterRegex:
+		regex, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return err
+		}
+		r.regex = regex
+	case filterLinks:
+		age, err := time.ParseDuration(r.NewUserAge)
+		if r.NewUserAge != "" && err != nil {
+			return fmt.Errorf("invalid new_user_age: %v", err)
+		}
+		r.newUserAge = age
+	case filterCaps:
+		if r.MaxCapsRatio <= 0 || r.MaxCapsRatio > 1 {
+			return fmt.Errorf("max_caps_ratio must be between 0 and 1")
+		}
+	default:
+		return fmt.Errorf("unknown type %q", r.Type)
+	}
+	return nil
+}
+
+// loadFilters reads the filter file, keeping the defaults if there is none
+func loadFilters() error {
+	config := &FilterConfig{}
+	if err := loadJSONFile(filterConfigPath, config); err != nil {
+		return err
+	}
+	if config.Default == nil && config.Rooms == nil {
+		return nil
+	}
+	if err := config.compile(); err != nil {
+		return fmt.Errorf("%s: %v", filterConfigPath, err)
+	}
+	filtersMu.Lock()
+	filters = config
+	filtersMu.Unlock()
+	return nil
+}
+
+// filterChain returns the rules applying to a room
+func filterChain(room string) []*FilterRule {
+	filtersMu.Lock()
+	defer filtersMu.Unlock()
+	if rules, exists := filters.Rooms[roomName(room)]; exists {
+		return rules
+	}
+	return filters.Default
+}
+
+// filterResult is the outcome of running a message through a filter chain
+type filterResult struct {
+	Action FilterAction // allow, reject or flag; masks only change Text
+	Text   string
+	Reason string
+}
+
+// filterMessage runs a chat message through the filters of the client's room
+func filterMessage(client *Client, text string) filterResult {
+	result := filterResult{Action: filterAllow, Text: text}
+	for _, rule := range filterChain(client.room) {
+		masked, reason := rule.match(client, result.Text)
+		if reason == "" {
+			continue
+		}
+		switch rule.Action {
+		case filterAllow:
+			return result
+		case filterMask:
+			result.Text = masked
+		case filterReject, filterFlag:
+			result.Action, result.Reason = rule.Action, reason
+			return result
+		}
+	}
+	return result
+}
+
+// match reports why a message matches the rule, with its matching parts masked.
+// The reason is empty when the message does not match.
+func (r *FilterRule) match(client *Client, text string) (string, string) {
+	switch r.Type {
+	case filterWords:
+		matched := false
+		masked := filterWordPattern.ReplaceAllStringFunc(text, func(word string) string {
+			if !inWordList(r.words, word) {
+				return word
+			}
+			matched = true
+			return strings.Repeat("*", len([]rune(word)))
+		})
+		if matched {
+			return masked, "blocked word"
+		}
+	case filterRegex:
+		if r.regex.MatchString(text) {
+			return r.regex.ReplaceAllStringFunc(text, func(match string) string {
+				return strings.Repeat("*", len([]rune(match)))
+			}), "blocked pattern"
+		}
+	case filterLinks:
+		if filterLinkPattern.MatchString(text) && isNewUser(client, r.newUserAge) {
+			return filterLinkPattern.ReplaceAllString(text, "[link removed]"), "links from new users"
+		}
+	case filterCaps:
+		letters, capitals := 0, 0
+		for _, c := range text {
+			if unicode.IsLetter(c) {
+				letters++
+				if unicode.IsUpper(c) {
+					capitals++
+				}
+			}
+		}
+		if letters >= r.MinLength && float64(capitals) > r.MaxCapsRatio*float64(letters) {
+			return strings.ToLower(text), "too many capitals"
+		}
+	}
+	return text, ""
+}
+
+var (
+	filterWordPattern = regexp.MustCompile(`[\p{L}\p{N}@$]+`)
+	filterLinkPattern = regexp.MustCompile(`(?i)\b(?:[a-z][a-z0-9+.-]*://|www\.)\S+|\b[a-z0-9-]+(?:\.[a-z0-9-]+)*\.(?:com|net|org|io|co|ru|xyz|info|biz|ly|gg|me)\b\S*`)
+	leetReplacer      = strings.NewReplacer("0", "o", "1", "i", "3", "e", "4", "a", "5", "s", "7", "t", "8", "b", "@", "a", "$", "s")
+)
+
+// normalizeLeet maps a word to the form word lists are kept in: lowercase, with leet speak undone ("$h1t" is "shit")
+func normalizeLeet(word string) string {
+	return leetReplacer.Replace(strings.ToLower(word))
+}
+
+// collapseRuns shortens every run of 3 or more equal letters to keep letters. Shorter runs are
+// left alone, as plenty of words have double letters.
+func collapseRuns(word string, keep int) string {
+	runes := []rune(word)
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		j := i
+		for j < len(runes) && runes[j] == runes[i] {
+			j++
+		}
+		n := j - i
+		if n >= 3 {
+			n = keep
+		}
+		b.WriteString(strings.Repeat(string(runes[i]), n))
+		i = j
+	}
+	return b.String()
+}
+
+// inWordList reports whether a word of a message is on a list. The word is compared as written,
+// and with stretched letters shortened to one or two ("shiiit" is "shit", "hellllo" is "hello").
+func inWordList(words map[string]bool, word string) bool {
+	normalized := normalizeLeet(word)
+	return words[normalized] || words[collapseRuns(normalized, 1)] || words[collapseRuns(normalized, 2)]
+}
+
+// isNewUser reports whether a client is a guest or registered less than age ago
+func isNewUser(client *Client, age time.Duration) bool {
+	if client.account == "" {
+		return true
+	}
+	account, exists := accounts.get(client.account)
+	return !exists || time.Since(account.Created) < age
+}
+
+// handleAdminFilters shows (GET) or replaces (PUT) the filter configuration
+func handleAdminFilters(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		filtersMu.Lock()
+		defer filtersMu.Unlock()
+		writeJSONResponse(w, http.StatusOK, filters)
+	case http.MethodPut:
+		config := &FilterConfig{}
+		if !readJSONBody(w, r, config) {
+			return
+		}
+		if err := config.compile(); err != nil {
+			writeJSONError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		if err := saveJSONFile(filterConfigPath, config); err != nil {
+			log.Printf("Error saving filters: %v", err)
+			writeJSONError(w, http.StatusInternalServerError, "could not save filters")
+			return
+		}
+		filtersMu.Lock()
+		filters = config
+		filtersMu.Unlock()
+		writeAudit(AuditEntry{Actor: sessionFromRequest(r).Username, Action: "filters", Target: "config"})
+		writeJSONResponse(w, http.StatusOK, config)
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useTempFilters installs a filter configuration, persisted in a temporary directory, for the duration of a test
+func useTempFilters(t *testing.T, config *FilterConfig) {
+	if err := config.compile(); err != nil {
+		t.Fatalf("Invalid filter config: %v", err)
+	}
+	originalFilters, originalPath, originalReviews := filters, filterConfigPath, reviews
+	dir := t.TempDir()
+	filters, filterConfigPath = config, filepath.Join(dir, "filters.json")
+	reviews = newReviewQueue(filepath.Join(dir, "review.json"))
+	t.Cleanup(func() { filters, filterConfigPath, reviews = originalFilters, originalPath, originalReviews })
+}
+
+func TestNormalizeLeet(t *testing.T) {
+	assert.Equal(t, "shit", normalizeLeet("$H1T"))
+	assert.Equal(t, "asses", normalizeLeet("@55e5"))
+	assert.Equal(t, "shit", collapseRuns("shiiiit", 1))
+	assert.Equal(t, "hello", collapseRuns("hellllo", 2))
+	assert.Equal(t, "assess", collapseRuns("assess", 1), "Expected double letters to be kept")
+}
+
+func TestWordListsKeepDoubleLetters(t *testing.T) {
+	rule := &FilterRule{Type: filterWords, Words: []string{"ass", "shit"}, Action: filterMask}
+	assert.NoError(t, rule.compile())
+	for _, text := range []string{"as I said", "but hell no", "pass the salt"} {
+		masked, reason := rule.match(nil, text)
+		assert.Empty(t, reason, text)
+		assert.Equal(t, text, masked)
+	}
+	masked, _ := rule.match(nil, "what an a$$ and shiiiit, asssss")
+	assert.Equal(t, "what an *** and *******, ******", masked)
+}
+
+func TestFilterChain(t *testing.T) {
+	useTempAccounts(t)
+	useTempFilters(t, &FilterConfig{
+		Default: []*FilterRule{
+			{Type: filterRegex, Pattern: `(?i)^!release`, Action: filterAllow},
+			{Type: filterWords, Words: []string{"darn", "heck"}, Action: filterMask},
+			{Type: filterRegex, Pattern: `\b\d{4}[ -]?\d{4}[ -]?\d{4}[ -]?\d{4}\b`, Action: filterReject},
+			{Type: filterLinks, NewUserAge: "24h", Action: filterFlag},
+			{Type: filterCaps, MaxCapsRatio: 0.5, MinLength: 8, Action: filterMask},
+		},
+		Rooms: map[string][]*FilterRule{"anything-goes": {}},
+	})
+	guest := &Client{room: lobbyRoom}
+
+	result := filterMessage(guest, "Oh d4rn, what the HEEECK")
+	assert.Equal(t, filterResult{Action: filterAllow, Text: "Oh ****, what the ******"}, result, "Expected leet speak and repeats to be caught")
+	assert.Equal(t, "darning socks", filterMessage(guest, "darning socks").Text, "Expected whole words only")
+
+	result = filterMessage(guest, "my card is 4111 1111 1111 1111")
+	assert.Equal(t, filterReject, result.Action)
+	assert.Equal(t, "blocked pattern", result.Reason)
+
+	assert.Equal(t, filterFlag, filterMessage(guest, "see https://example.org/x").Action, "Expected links from guests to be held")
+	assert.Equal(t, filterFlag, filterMessage(guest, "visit cheap-pills.xyz now").Action)
+	assert.Equal(t, "!release the HECK notes", filterMessage(guest, "!release the HECK notes").Text, "Expected allow to skip the remaining filters")
+
+	assert.Equal(t, "stop shouting please", filterMessage(guest, "STOP SHOUTING please").Text)
+	assert.Equal(t, "OK", filterMessage(guest, "OK").Text, "Expected short messages to be left alone")
+
+	// Accounts older than the threshold may post links
+	assert.NoError(t, accounts.create(&Account{Username: "Old", Created: time.Now().Add(-48 * time.Hour)}))
+	assert.NoError(t, accounts.create(&Account{Username: "New", Created: time.Now()}))
+	assert.Equal(t, filterAllow, filterMessage(&Client{account: "Old", room: lobbyRoom}, "see https://example.org").Action)
+	assert.Equal(t, filterFlag, filterMessage(&Client{account: "New", room: lobbyRoom}, "see https://example.org").Action)
+
+	// Rooms may override the default chain
+	assert.Equal(t, "darn", filterMessage(&Client{room: "anything-goes"}, "darn").Text)
+}
+
+func TestFilterConfigValidation(t *testing.T) {
+	for _, config := range []*FilterConfig{
+		{Default: []*FilterRule{{Type: "words", Action: "delete"}}},
+		{Default: []*FilterRule{{Type: "unknown", Action: filterMask}}},
+		{Default: []*FilterRule{{Type: filterRegex, Pattern: "(", Action: filterReject}}},
+		{Default: []*FilterRule{{Type: filterCaps, MaxCapsRatio: 2, Action: filterMask}}},
+		{Default: []*FilterRule{{Type: filterLinks, NewUserAge: "a day", Action: filterReject}}},
+		{Rooms: map[string][]*FilterRule{"Bad Room": {}}},
+	} {
+		assert.Error(t, config.compile())
+	}
+}
+
+func TestFlaggedMessagesAreHeldForReview(t *testing.T) {
+	useTempModeration(t)
+	useTempFilters(t, &FilterConfig{Default: []*FilterRule{{Type: filterWords, Words: []string{"crypto"}, Action: filterFlag}}})
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	mod := joinTestAccount(t, wsURL, "Quinn", roleModerator)
+	user := joinTestClient(t, wsURL, "Rita")
+
+	sendTestMessage(t, user, Message{Message: "buy CRYPT0 now"})
+	assert.Equal(t, "Your message is held for review by a moderator", readTestMessage(t, user).Message)
+	assert.Equal(t, "Message #1 from Rita in lobby is held for review (blocked word). Use /approve 1 or /reject 1", readTestMessage(t, mod).Message)
+
+	sendTestMessage(t, mod, Message{Message: "/review"})
+	assert.Contains(t, readTestMessage(t, mod).Message, "#1 Rita in lobby (blocked word): buy CRYPT0 now")
+
+	sendTestMessage(t, user, Message{Message: "/approve 1"})
+	assert.Equal(t, "You are not allowed to use /approve", readTestMessage(t, user).Message)
+
+	sendTestMessage(t, mod, Message{Message: "/approve #1"})
+	delivered := readTestMessage(t, user)
+	assert.Equal(t, "Rita", delivered.Username)
+	assert.Equal(t, "buy CRYPT0 now", delivered.Message)
+	assert.Empty(t, reviews.pending())
+	notices := []string{readTestMessage(t, mod).Message, readTestMessage(t, mod).Message}
+	assert.ElementsMatch(t, []string{"buy CRYPT0 now", "Message #1 was delivered"}, notices)
+
+	sendTestMessage(t, mod, Message{Message: "/reject 1"})
+	assert.Equal(t, "No message #1 is held for review", readTestMessage(t, mod).Message)
+}
+
+func TestRejectedMessagesGetAnErrorFrame(t *testing.T) {
+	useTempFilters(t, &FilterConfig{Default: []*FilterRule{{Type: filterRegex, Pattern: "(?i)free money", Action: filterReject}}})
+	startTestHub(t)
+	ws := joinTestClient(t, startTestServer(t), "Sam")
+
+	sendTestMessage(t, ws, Message{Message: "FREE MONEY here"})
+	msg := readTestMessage(t, ws)
+	assert.Equal(t, "message_rejected", msg.Code)
+	assert.Equal(t, "Your message was not sent: blocked pattern", msg.Message)
+}
+
+func TestAdminFiltersAPI(t *testing.T) {
+	useTempFilters(t, defaultFilterConfig())
+	useTempModeration(t) // The change is audited
+	put := func(body string) *httptest.ResponseRecorder {
+		value, err := encodeSession(Session{Username: "Boss", Expires: time.Now().Add(time.Hour).Unix()})
+		assert.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPut, "/api/admin/filters", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+		w := httptest.NewRecorder()
+		handleAdminFilters(w, req)
+		return w
+	}
+
+	assert.Equal(t, http.StatusBadRequest, put(`{"default": [{"type": "regex", "pattern": "(", "action": "reject"}]}`).Code)
+	w := put(`{"default": [], "rooms": {"support": [{"type": "words", "words": ["darn"], "action": "mask"}]}}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.Equal(t, "****", filterMessage(&Client{room: "support"}, "darn").Text)
+	assert.Equal(t, "darn", filterMessage(&Client{room: lobbyRoom}, "darn").Text)
+
+	// The configuration survives a restart
+	filters = defaultFilterConfig()
+	assert.NoError(t, loadFilters())
+	assert.Equal(t, "****", filterMessage(&Client{room: "support"}, "darn").Text)
+}
+
+func TestBotQueriesPassTheFilters(t *testing.T) {
+	useTempFilters(t, &FilterConfig{Default: []*FilterRule{
+		{Type: filterWords, Words: []string{"darn"}, Action: filterMask},
+		{Type: filterRegex, Pattern: "(?i)free money", Action: filterReject},
+		{Type: filterRegex, Pattern: "(?i)cancer", Action: filterFlag},
+	}})
+	startTestHub(t)
+	var asked []string
+	stubBots(t, func(sessionID, input, agentID string) ([]string, error) {
+		asked = append(asked, input)
+		return []string{"answer"}, nil
+	})
+	ws := joinTestClient(t, startTestServer(t), "Tina")
+
+	sendTestMessage(t, ws, Message{Message: "/bot2 free money please"})
+	assert.Equal(t, "message_rejected", readTestMessage(t, ws).Code)
+	sendTestMessage(t, ws, Message{Message: "/bot2! do I have cancer"})
+	assert.Equal(t, "message_rejected", readTestMessage(t, ws).Code, "Expected flagged queries to be refused rather than held")
+	assert.Empty(t, reviews.pending(), "Expected a private query never to reach the review queue")
+
+	sendTestMessage(t, ws, Message{Message: "/bot2 darn it"})
+	assert.Equal(t, "/bot2 **** it", readTestMessage(t, ws).Message, "Expected the echo to be masked")
+	assert.Equal(t, "answer", readTestMessage(t, ws).Message)
+	assert.Equal(t, []string{"**** it"}, asked, "Expected only the masked query to reach the bot")
+	assert.Equal(t, "/bot2 **** it", history.messages(lobbyRoom, 0, 2)[0].Message, "Expected the masked echo in the history")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// securedTestMux serves the page, the static files and an API like main does
+func securedTestMux() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/", http.HandlerFunc(serveHome))
+	mux.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	mux.Handle("/api/session", http.HandlerFunc(handleSession))
+	return withSecurityHeaders(mux)
+}
+
+func TestSecurityHeadersOnEveryRoute(t *testing.T) {
+	handler := securedTestMux()
+	for _, path := range []string{"/", "/static/js/scripts.js", "/api/session", "/missing"} {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		csp := w.Header().Get("Content-Security-Policy")
+		assert.Contains(t, csp, "script-src 'self'", path)
+		assert.NotContains(t, csp, "unsafe-inline", path)
+		assert.Contains(t, csp, "frame-ancestors 'none'", path)
+		assert.Contains(t, csp, "report-uri /api/csp-report", path)
+		assert.Equal(t, "nosniff", w.Header().Get("X-Content-Type-Options"), path)
+		assert.Equal(t, "strict-origin-when-cross-origin", w.Header().Get("Referrer-Policy"), path)
+		assert.Contains(t, w.Header().Get("Permissions-Policy"), "camera=()", path)
+	}
+}
+
+func TestCSPReportOnlyMode(t *testing.T) {
+	originalPolicy, originalReportOnly := cspPolicy, cspReportOnly
+	cspPolicy, cspReportOnly = "default-src 'self';", true
+	t.Cleanup(func() { cspPolicy, cspReportOnly = originalPolicy, originalReportOnly })
+
+	w := httptest.NewRecorder()
+	securedTestMux().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Empty(t, w.Header().Get("Content-Security-Policy"))
+	assert.Equal(t, "default-src 'self'; report-uri /api/csp-report", w.Header().Get("Content-Security-Policy-Report-Only"))
+	assert.Equal(t, "DENY", w.Header().Get("X-Frame-Options"), "Expected framing to stay refused while only reporting")
+}
+
+func TestPageHasNoInlineCode(t *testing.T) {
+	page, err := os.ReadFile("static/index.html")
+	if !assert.NoError(t, err) {
+		return
+	}
+	html := string(page)
+	assert.False(t, regexp.MustCompile(`(?i)\son[a-z]+\s*=`).MatchString(html), "Expected no inline event handlers")
+	assert.False(t, regexp.MustCompile(`(?i)\sstyle\s*=`).MatchString(html), "Expected no inline styles")
+	assert.False(t, regexp.MustCompile(`(?i)<style`).MatchString(html), "Expected no style elements")
+	for _, script := range regexp.MustCompile(`(?is)<script[^>]*>(.*?)</script>`).FindAllStringSubmatch(html, -1) {
+		assert.Contains(t, script[0], `src="/static/`, "Expected scripts to be loaded from files")
+		assert.Empty(t, strings.TrimSpace(script[1]), "Expected no inline scripts")
+	}
+	assert.NotContains(t, html, "javascript:")
+}
+
+func TestCSPReportEndpoint(t *testing.T) {
+	post := func(contentType, body string) int {
+		req := httptest.NewRequest(http.MethodPost, "/api/csp-report", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		w := httptest.NewRecorder()
+		handleCSPReport(w, req)
+		return w.Code
+	}
+	before := metrics.get("csp_violations")
+
+	assert.Equal(t, http.StatusNoContent, post("application/csp-report",
+		`{"csp-report": {"document-uri": "https://chat.example.com/", "violated-directive": "script-src", "blocked-uri": "inline"}}`))
+	assert.Equal(t, http.StatusNoContent, post("application/reports+json",
+		`[{"type": "csp-violation", "body": {"documentURL": "https://chat.example.com/", "effectiveDirective": "img-src", "blockedURL": "https://evil.test/x.png"}},
+		  {"type": "deprecation", "body": {}}]`))
+	assert.Equal(t, before+2, metrics.get("csp_violations"))
+
+	assert.Equal(t, http.StatusBadRequest, post("application/csp-report", "not json"))
+	w := httptest.NewRecorder()
+	handleCSPReport(w, httptest.NewRequest(http.MethodGet, "/api/csp-report", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, w.Code)
+}
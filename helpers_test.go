@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// startTestHub runs handleMessages on a fresh broadcast channel and an empty history for the duration of a test
+func startTestHub(t *testing.T) {
+	original, originalHistory := broadcast, history
+	broadcast = make(chan Message)
+	history = newHistoryStore(filepath.Join(t.TempDir(), "history.json"))
+	done := make(chan struct{})
+	go func() {
+		handleMessages()
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(broadcast)
+		<-done
+		history.flush() // Before the temporary directory goes
+		broadcast, history = original, originalHistory
+	})
+}
+
+// startTestServer serves handleConnections and returns its WebSocket URL. Every test starts
+// with full rate limit buckets, as all test clients share an address and the lobby.
+func startTestServer(t *testing.T) string {
+	rateMu.Lock()
+	for _, scope := range []*rateScope{connectionLimits, userLimits, ipLimits, roomLimits, botLimits} {
+		scope.buckets = make(map[string]*tokenBucket)
+	}
+	penalties = make(map[string]*penaltyBox)
+	rateMu.Unlock()
+	server := httptest.NewServer(http.HandlerFunc(handleConnections))
+	t.Cleanup(server.Close)
+	return "ws" + server.URL[len("http"):]
+}
+
+// dialTestClient opens a WebSocket connection that is closed when the test ends
+func dialTestClient(t *testing.T, wsURL string) *websocket.Conn {
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect WebSocket: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+// joinTestClient dials the server and binds a username, consuming the join acknowledgement
+func joinTestClient(t *testing.T, wsURL, username string) *websocket.Conn {
+	ws := dialTestClient(t, wsURL)
+	sendTestMessage(t, ws, Message{Type: "join", Username: username})
+	if ack := readTestMessage(t, ws); ack.Type != "joined" {
+		t.Fatalf("Failed to join as %s: %s", username, ack.Message)
+	}
+	return ws
+}
+
+// withCSRF adds the CSRF token of a session cookie to a WebSocket URL
+func withCSRF(wsURL, sessionCookie string) string {
+	return wsURL + "?csrf=" + url.QueryEscape(csrfToken(sessionCookie))
+}
+
+// joinTestAccount connects as a logged-in user holding the given roles, consuming the join acknowledgement
+func joinTestAccount(t *testing.T, wsURL, username string, roles ...Role) *websocket.Conn {
+	var roleNames []string
+	for _, role := range roles {
+		roleNames = append(roleNames, string(role))
+	}
+	value, err := encodeSession(Session{Username: username, Roles: roleNames, Expires: time.Now().Add(time.Hour).Unix()})
+	if err != nil {
+		t.Fatalf("Failed to encode session: %v", err)
+	}
+	ws, _, err := websocket.DefaultDialer.Dial(withCSRF(wsURL, value), http.Header{"Cookie": {sessionCookieName + "=" + value}})
+	if err != nil {
+		t.Fatalf("Failed to connect WebSocket: %v", err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	if ack := readTestMessage(t, ws); ack.Type != "joined" {
+		t.Fatalf("Failed to join as %s: %s", username, ack.Message)
+	}
+	return ws
+}
+
+// sendTestMessage writes a message and gives the server a moment to handle it
+func sendTestMessage(t *testing.T, ws *websocket.Conn, msg Message) {
+	if err := ws.WriteJSON(msg); err != nil {
+		t.Fatalf("Failed to send message: %v", err)
+	}
+	time.Sleep(10 * time.Millisecond)
+}
+
+// readTestMessage reads the next message, skipping presence frames, failing the test after a timeout
+func readTestMessage(t *testing.T, ws *websocket.Conn) Message {
+	for {
+		if msg := readTestFrame(t, ws); msg.Type != "presence" {
+			return msg
+		}
+	}
+}
+
+// readTestFrame reads the next frame of any type, failing the test after a timeout
+func readTestFrame(t *testing.T, ws *websocket.Conn) Message {
+	var msg Message
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := ws.ReadJSON(&msg); err != nil {
+		t.Fatalf("Failed to read message: %v", err)
+	}
+	return msg
+}
+
+// stubBots replaces the Dialogflow calls with canned replies for the duration of a test
+func stubBots(t *testing.T, reply func(sessionID, input, agentID string) ([]string, error)) {
+	originalText, originalEvent := sendBotText, sendBotEvent
+	sendBotText, sendBotEvent = reply, reply
+	t.Cleanup(func() { sendBotText, sendBotEvent = originalText, originalEvent })
+}
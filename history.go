@@ -0,0 +1,271 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	historyLimit     = envInt("HISTORY_LIMIT", 500)                     // Messages kept per room
+	historySaveDelay = envDuration("HISTORY_SAVE_DELAY", 2*time.Second) // Changes are written together at most this often
+)
+
+// historyStore keeps the recent chat messages of every room and how far each user read them,
+// and persists them to a JSON file. Saving is batched in the background, so a busy room does
+// not wait for the disk on every message.
+type historyStore struct {
+	mu      sync.Mutex
+	saveMu  sync.Mutex // Held while writing, so snapshots reach the disk in order
+	path    string
+	dirty   bool                        // Changed since the last save, guarded by mu
+	pending *time.Timer                 // Scheduled save, guarded by mu
+	NextID  int64                       `json:"next_id"`
+	Rooms   map[string][]*Message       `json:"rooms"`
+	Markers map[string]map[string]int64 `json:"markers"` // Last message read, by room and lowercased username
+	Authors map[int64]string            `json:"authors"` // Who sent each message, by ID; never sent to clients
+
+	// Who reacted to each message, by ID and emoji, in the order of the users of the reaction
+	Reactors map[int64]map[string][]string `json:"reactors"`
+}
+
+var errMessageNotFound = errors.New("message not found")
+
+var history = newHistoryStore(filepath.Join(dataDir, "history.json"))
+
+func newHistoryStore(path string) *historyStore {
+	return &historyStore{path: path, NextID: 1, Rooms: make(map[string][]*Message), Markers: make(map[string]map[string]int64),
+		Authors: make(map[int64]string), Reactors: make(map[int64]map[string][]string)}
+}
+
+// load reads the history persisted by a previous run
+func (h *historyStore) load() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return loadJSONFile(h.path, h)
+}
+
+// saveLocked schedules a save of the store; the caller holds h.mu
+func (h *historyStore) saveLocked() {
+	h.dirty = true
+	if h.pending == nil {
+		h.pending = time.AfterFunc(historySaveDelay, h.flush)
+	}
+}
+
+// flush writes pending changes to disk now. A failed save is only logged, since the messages
+// were delivered anyway; the next change tries again.
+func (h *historyStore) flush() {
+	h.saveMu.Lock()
+	defer h.saveMu.Unlock()
+	h.mu.Lock()
+	if h.pending != nil {
+		h.pending.Stop()
+		h.pending = nil
+	}
+	if !h.dirty {
+		h.mu.Unlock()
+		return
+	}
+	h.dirty = false
+	data, err := json.Marshal(h)
+	h.mu.Unlock()
+	if err == nil {
+		err = writeFileAtomic(h.path, data)
+	}
+	if err != nil {
+		log.Printf("Error saving message history: %v", err)
+	}
+}
+
+// record numbers a chat message and keeps it in the history of its room
+func (h *historyStore) record(msg Message) Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	msg.Room = roomName(msg.Room)
+	msg.ID = h.NextID
+	msg.Time = time.Now().UnixMilli()
+	h.NextID++
+	if msg.ParentID != 0 {
+		h.addReplyLocked(&msg)
+	}
+	if msg.author != "" {
+		h.Authors[msg.ID] = msg.author
+	}
+	stored := msg
+	messages := append(h.Rooms[msg.Room], &stored)
+	if len(messages) > historyLimit {
+		for _, dropped := range messages[:len(messages)-historyLimit] {
+			delete(h.Authors, dropped.ID)
+			delete(h.Reactors, dropped.ID)
+		}
+		messages = messages[len(messages)-historyLimit:]
+	}
+	h.Rooms[msg.Room] = messages
+	h.saveLocked()
+	return msg
+}
+
+// update applies a change to a message of a room and persists it, returning the changed message.
+// The change may refuse by returning an error, which is passed on.
+func (h *historyStore) update(room string, id int64, change func(*Message) error) (Message, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room = roomName(room)
+	i, found := h.findLocked(room, id)
+	if !found {
+		return Message{}, errMessageNotFound
+	}
+	stored := h.Rooms[room]
+	changed := *stored[i]
+	changed.author = h.Authors[id]
+	changed.Reactions = nil
+	for _, reaction := range stored[i].Reactions {
+		reaction.authors = make([]string, len(reaction.Users)) // Reactions from before identities were kept match nobody
+		copy(reaction.authors, h.Reactors[id][reaction.Emoji])
+		changed.Reactions = append(changed.Reactions, reaction)
+	}
+	if err := change(&changed); err != nil {
+		return Message{}, err
+	}
+	// Who reacted is only kept in Reactors, like the authors of messages
+	kept := changed
+	kept.Reactions = nil
+	delete(h.Reactors, id)
+	for _, reaction := range changed.Reactions {
+		if h.Reactors[id] == nil {
+			h.Reactors[id] = make(map[string][]string)
+		}
+		h.Reactors[id][reaction.Emoji] = reaction.authors
+		reaction.authors = nil
+		kept.Reactions = append(kept.Reactions, reaction)
+	}
+	stored[i] = &kept
+	h.saveLocked()
+	return changed, nil
+}
+
+// knows reports whether a room has any history, e.g. from before a restart
+func (h *historyStore) knows(room string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, exists := h.Rooms[roomName(room)]
+	return exists
+}
+
+// messages returns copies of up to limit messages of a room older than before (all when 0), oldest first
+func (h *historyStore) messages(room string, before int64, limit int) []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	page := []Message{}
+	stored := h.Rooms[roomName(room)]
+	end := len(stored)
+	if before > 0 {
+		end = sort.Search(len(stored), func(i int) bool { return stored[i].ID >= before })
+	}
+	for _, msg := range stored[max(0, end-limit):end] {
+		page = append(page, *msg)
+	}
+	return page
+}
+
+// markRead moves the read marker of a user forward to a message of the room, reporting whether it moved
+func (h *historyStore) markRead(room, username string, id int64) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room, user := roomName(room), strings.ToLower(username)
+	stored := h.Rooms[room]
+	if len(stored) == 0 || id <= 0 || id > stored[len(stored)-1].ID || id <= h.Markers[room][user] {
+		return false
+	}
+	if h.Markers[room] == nil {
+		h.Markers[room] = make(map[string]int64)
+	}
+	h.Markers[room][user] = id
+	h.saveLocked()
+	return true
+}
+
+// Receipt is how far a user read a room
+type Receipt struct {
+	Username string `json:"username"`
+	LastRead int64  `json:"last_read"`
+}
+
+// receipts returns the read markers of a room, sorted by name
+func (h *historyStore) receipts(room string) []Receipt {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	receipts := []Receipt{}
+	for user, id := range h.Markers[roomName(room)] {
+		receipts = append(receipts, Receipt{Username: user, LastRead: id})
+	}
+	sort.Slice(receipts, func(i, j int) bool { return receipts[i].Username < receipts[j].Username })
+	return receipts
+}
+
+// unread counts the messages of others that were not deleted after the read marker of a user, in every room the user read
+func (h *historyStore) unread(username string) map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	user := strings.ToLower(username)
+	counts := make(map[string]int)
+	for room, markers := range h.Markers {
+		marker, exists := markers[user]
+		if !exists {
+			continue
+		}
+		counts[room] = 0
+		for _, msg := range h.Rooms[room] {
+			if msg.ID > marker && !msg.Deleted && !strings.EqualFold(msg.Username, username) {
+				counts[room]++
+			}
+		}
+	}
+	return counts
+}
+
+// markRead handles a read frame: the marker of the client moves forward and the room sees the receipt
+func markRead(client *Client, id int64) {
+	if history.markRead(client.room, client.username, id) {
+		broadcast <- Message{Type: "read", Username: client.username, Room: roomName(client.room), ID: id, exceptSender: true}
+	}
+}
+
+// sendUnread tells a client that just joined how many messages it missed in the rooms it read before
+func sendUnread(client *Client) {
+	if counts := history.unread(client.username); len(counts) > 0 {
+		client.writeJSON(Message{Type: "unread", Username: "System", Room: client.room, Unread: counts})
+	}
+}
+
+// handleUnread returns the unread counts of the logged-in user
+func handleUnread(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	session := sessionFromRequest(r)
+	if session == nil {
+		writeJSONError(w, http.StatusUnauthorized, "login required")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, history.unread(session.Username))
+}
+
+// handleRoomMessages returns a page of the history of a room: ?before=<id>&limit=<n>
+func handleRoomMessages(w http.ResponseWriter, r *http.Request, room string) {
+	before, _ := strconv.ParseInt(r.URL.Query().Get("before"), 10, 64)
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 || limit > 100 {
+		limit = 50
+	}
+	writeJSONResponse(w, http.StatusOK, history.messages(room, before, limit))
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useTestHistoryStore returns an empty history in a temporary directory, saved before the directory goes
+func useTestHistoryStore(t *testing.T) *historyStore {
+	store := newHistoryStore(filepath.Join(t.TempDir(), "history.json"))
+	t.Cleanup(store.flush)
+	return store
+}
+
+func TestHistorySavesAreBatched(t *testing.T) {
+	originalDelay := historySaveDelay
+	historySaveDelay = 50 * time.Millisecond
+	defer func() { historySaveDelay = originalDelay }()
+	store := useTestHistoryStore(t)
+
+	for i := 0; i < 20; i++ {
+		store.record(Message{Username: "Ann", Message: "hello"})
+	}
+	_, err := os.Stat(store.path)
+	assert.True(t, os.IsNotExist(err), "Expected no write for every message")
+
+	time.Sleep(200 * time.Millisecond)
+	restarted := newHistoryStore(store.path)
+	assert.NoError(t, restarted.load())
+	assert.Len(t, restarted.messages(lobbyRoom, 0, 50), 20, "Expected the batch to be saved after the delay")
+}
+
+func TestHistoryNumbersAndKeepsRoomMessages(t *testing.T) {
+	store := useTestHistoryStore(t)
+	originalLimit := historyLimit
+	historyLimit = 3
+	defer func() { historyLimit = originalLimit }()
+
+	var ids []int64
+	for _, text := range []string{"one", "two", "three", "four"} {
+		msg := store.record(Message{Username: "Ann", Message: text})
+		assert.Equal(t, lobbyRoom, msg.Room)
+		assert.NotZero(t, msg.Time)
+		ids = append(ids, msg.ID)
+	}
+	assert.Equal(t, []int64{1, 2, 3, 4}, ids)
+
+	page := store.messages(lobbyRoom, 0, 10)
+	if assert.Len(t, page, 3, "Expected the oldest message to be dropped") {
+		assert.Equal(t, "two", page[0].Message)
+	}
+	page = store.messages(lobbyRoom, 4, 1)
+	if assert.Len(t, page, 1) {
+		assert.Equal(t, "three", page[0].Message)
+	}
+
+	// The history and the markers survive a restart
+	assert.True(t, store.markRead(lobbyRoom, "Bob", 3))
+	store.flush()
+	restarted := newHistoryStore(store.path)
+	assert.NoError(t, restarted.load())
+	assert.Len(t, restarted.messages(lobbyRoom, 0, 10), 3)
+	assert.Equal(t, []Receipt{{Username: "bob", LastRead: 3}}, restarted.receipts(lobbyRoom))
+	assert.Equal(t, int64(5), restarted.record(Message{Username: "Ann", Message: "five"}).ID)
+}
+
+func TestReadMarkersOnlyMoveForward(t *testing.T) {
+	store := useTestHistoryStore(t)
+	for i := 0; i < 3; i++ {
+		store.record(Message{Username: "Agent", Message: "hello", Room: "support"})
+	}
+	store.record(Message{Username: "Customer", Message: "hi", Room: "support"})
+
+	assert.False(t, store.markRead("support", "Customer", 9), "Expected unknown messages to be refused")
+	assert.False(t, store.markRead("lobby", "Customer", 1), "Expected rooms without history to be refused")
+	assert.True(t, store.markRead("support", "Customer", 2))
+	assert.False(t, store.markRead("support", "customer", 1), "Expected markers to never move back")
+	assert.Equal(t, map[string]int{"support": 1}, store.unread("Customer"), "Expected own messages to not count")
+	assert.Empty(t, store.unread("Agent"), "Expected no counts for rooms never read")
+}
+
+func TestReadReceiptsInChat(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	agent := joinTestAccount(t, wsURL, "Agent")
+	customer := joinTestClient(t, wsURL, "Customer")
+	sendTestMessage(t, agent, Message{Message: "How can I help?"})
+	msg := readTestMessage(t, customer)
+	assert.NotZero(t, msg.ID)
+	assert.Equal(t, msg.ID, readTestMessage(t, agent).ID, "Expected every member to see the same message ID")
+
+	sendTestMessage(t, customer, Message{Type: "read", ID: msg.ID})
+	assert.Equal(t, Message{Type: "read", Username: "Customer", Room: lobbyRoom, ID: msg.ID}, readTestMessage(t, agent))
+	sendTestMessage(t, customer, Message{Type: "read", ID: msg.ID}) // Nothing new
+	sendTestMessage(t, customer, Message{Message: "My order is late"})
+	assert.Equal(t, "My order is late", readTestMessage(t, agent).Message, "Expected no receipt for a marker that did not move")
+	assert.Equal(t, "My order is late", readTestMessage(t, customer).Message, "Expected no receipt for the reader")
+
+	// The agent reconnects and learns what it missed
+	sendTestMessage(t, agent, Message{Type: "read", ID: msg.ID})
+	readTestMessage(t, customer) // Receipt
+	agent.Close()
+	sendTestMessage(t, customer, Message{Message: "Hello?"})
+	again := joinTestAccount(t, wsURL, "Agent")
+	assert.Equal(t, Message{Type: "unread", Username: "System", Room: lobbyRoom, Unread: map[string]int{lobbyRoom: 2}}, readTestMessage(t, again))
+}
+
+func TestReceiptAndUnreadEndpoints(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	history.record(Message{Username: "Agent", Message: "Hi", Room: lobbyRoom})
+	history.record(Message{Username: "Agent", Message: "Still there?", Room: lobbyRoom})
+	history.markRead(lobbyRoom, "Customer", 1)
+
+	w := httptest.NewRecorder()
+	handleRooms(w, httptest.NewRequest(http.MethodGet, "/api/rooms/lobby/receipts", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.JSONEq(t, `{"room": "lobby", "receipts": [{"username": "customer", "last_read": 1}]}`, w.Body.String())
+
+	w = httptest.NewRecorder()
+	handleRooms(w, httptest.NewRequest(http.MethodGet, "/api/rooms/lobby/messages?before=2", nil))
+	var messages []Message
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &messages))
+	if assert.Len(t, messages, 1) {
+		assert.Equal(t, "Hi", messages[0].Message)
+	}
+
+	w = httptest.NewRecorder()
+	handleUnread(w, httptest.NewRequest(http.MethodGet, "/api/unread", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	value, err := encodeSession(Session{Username: "Customer", Expires: 4102444800})
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/api/unread", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+	w = httptest.NewRecorder()
+	handleUnread(w, req)
+	assert.JSONEq(t, `{"lobby": 1}`, w.Body.String())
+}
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"fmt"
 	"log"
-	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -18,18 +20,74 @@ import (
 )
 
 var upgrader = websocket.Upgrader{
-	CheckOrigin: func(r *http.Request) bool {
-		return true
-	},
+	CheckOrigin: originAllowed, // Checked again here in case handleConnections is bypassed
 }
 
-var clients = make(map[*websocket.Conn]bool)
+var clients = make(map[*websocket.Conn]*Client)
+var clientsMu sync.Mutex
 var broadcast = make(chan Message)
 
 // Message represents a chat message
 type Message struct {
-	Username string `json:"username"`
-	Message  string `json:"message"`
+	Type       string         `json:"type,omitempty"` // Frame type, empty for a chat message
+	ID         int64          `json:"id,omitempty"`   // Number of a chat message in the history, or the message a frame refers to
+	Time       int64          `json:"time,omitempty"` // When the server accepted a chat message, in Unix milliseconds
+	Username   string         `json:"username"`
+	Message    string         `json:"message"`        // Plain text, for every client
+	HTML       string         `json:"html,omitempty"` // Message rendered from its Markdown, safe to insert as HTML
+	Room       string         `json:"room,omitempty"`
+	Private    bool           `json:"private,omitempty"`
+	Code       string         `json:"code,omitempty"`        // Machine-readable reason of an error frame
+	RetryAfter int            `json:"retry_after,omitempty"` // Seconds to wait after a rate_limited error
+	Status     string         `json:"status,omitempty"`      // Presence in presence frames: online, away or offline
+	Unread     map[string]int `json:"unread,omitempty"`      // Unread messages by room in unread frames
+	Edited     int64          `json:"edited,omitempty"`      // When a chat message was last edited, in Unix milliseconds
+	Deleted    bool           `json:"deleted,omitempty"`     // The message was deleted and only its tombstone is kept
+	Emoji      string         `json:"emoji,omitempty"`       // Emoji toggled by a react frame
+	Reactions  []Reaction     `json:"reactions,omitempty"`   // Reactions to a chat message, or the changed one in reaction frames
+	ParentID   int64          `json:"parent_id,omitempty"`   // Message a reply belongs under, in its thread
+	Thread     *Thread        `json:"thread,omitempty"`      // Summary of the replies to a message
+
+	recipient    string // Identity of the connections that receive a private message, see authorID
+	author       string // Identity of the sender of a chat message, see authorID
+	exceptSender bool   // Not delivered to the connections of Username, e.g. their own typing frames
+}
+
+// Client holds the state of a single WebSocket connection
+type Client struct {
+	conn      *websocket.Conn
+	id        string // Random identity of the connection, kept for its lifetime
+	ip        string
+	sessionID string // Dialogflow session of the bot conversations, renewed by /reset
+	room      string
+	username  string
+	account   string         // Username of the logged-in account, empty for guests
+	session   *Session       // Login session, nil for guests
+	roles     []Role         // What the client is allowed to do, guarded by clientsMu
+	away      bool           // The page reported being idle, guarded by clientsMu
+	threads   map[int64]bool // Threads followed from any room, guarded by clientsMu
+	typing    *typingState   // Set while the user is typing, guarded by typingMu
+	writeMu   sync.Mutex     // gorilla/websocket allows only one concurrent writer
+}
+
+// writeJSON sends a frame, giving up on clients that stop reading after writeTimeout
+func (c *Client) writeJSON(v interface{}) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteJSON(v)
+}
+
+func (c *Client) writeText(text string) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return c.conn.WriteMessage(websocket.TextMessage, []byte(text))
+}
+
+// notify sends a system message to this client only
+func (c *Client) notify(text string) error {
+	return c.writeJSON(Message{Username: "System", Message: text, Room: c.room})
 }
 
 var botAgentMap = map[string]string{
@@ -44,11 +102,89 @@ var botAgentMap = map[string]string{
 	"/bot9": "1e0d311c-73b5-4770-828d-83a6d3a4a9df", // Car Rental
 }
 
+const (
+	botPublic  = "public"  // Bot conversations are visible to the whole room
+	botPrivate = "private" // Bot conversations are only visible to the asking user
+)
+
+// Visibility of each bot's conversations; bots that are not listed are public
+var botVisibility = map[string]string{
+	"/bot4": botPrivate, // Financial Services
+	"/bot5": botPrivate, // Payment Arrangement
+	"/bot6": botPrivate, // Order and Account Management
+	"/bot7": botPrivate, // Healthcare
+}
+
+// Display names of the bots, used by /help
+var botNames = map[string]string{
+	"/bot1": "Travel - Flight Information",
+	"/bot2": "Small Talk",
+	"/bot3": "Telecommunications",
+	"/bot4": "Financial Services",
+	"/bot5": "Payment Arrangement",
+	"/bot6": "Order and Account Management",
+	"/bot7": "Healthcare",
+	"/bot8": "Baggage Claim",
+	"/bot9": "Car Rental",
+}
+
+var (
+	botWelcomeEvent  = "sys.welcome" // Event sent when a bot is started without any text
+	maxBotEventChain = 3             // Limit on follow-up events requested by webhook payloads
+)
+
+// Indirections over the Dialogflow calls so tests can stub them
+var (
+	sendBotText  = queryDialogflow
+	sendBotEvent = queryDialogflowEvent
+)
+
 func main() {
-	// Register routes without secure headers
+	// Register routes; withSecurityHeaders adds the security headers to all of them
 	http.Handle("/", http.HandlerFunc(serveHome))
 	http.Handle("/ws", http.HandlerFunc(handleConnections))
 	http.Handle("/static/", http.StripPrefix("/static/", http.FileServer(http.Dir("static"))))
+	http.Handle("/api/register", http.HandlerFunc(handleRegister))
+	http.Handle("/api/login", http.HandlerFunc(handleLogin))
+	http.Handle("/api/logout", http.HandlerFunc(handleLogout))
+	http.Handle("/api/session", http.HandlerFunc(handleSession))
+	http.Handle("/api/csp-report", http.HandlerFunc(handleCSPReport))
+	http.Handle("/api/rooms/", http.HandlerFunc(handleRooms))
+	http.Handle("/api/unread", http.HandlerFunc(handleUnread))
+	http.Handle("/api/admin/roles", requireClientCert(requirePermission(permAdminRead, handleAdminRoles)))
+	http.Handle("/api/admin/audit", requireClientCert(requirePermission(permAdminRead, handleAdminAudit)))
+	http.Handle("/api/admin/filters", requireClientCert(requirePermission(permFilters, handleAdminFilters)))
+	http.Handle("/api/admin/review", requireClientCert(requirePermission(permReview, handleAdminReview)))
+	http.Handle("/api/admin/metrics", requireClientCert(requirePermission(permAdminRead, handleAdminMetrics)))
+	http.Handle("/auth/login", http.HandlerFunc(handleOIDCLogin))
+	http.Handle("/auth/callback", http.HandlerFunc(handleOIDCCallback))
+
+	if err := accounts.load(); err != nil {
+		log.Fatalf("Error loading accounts: %v", err)
+	}
+	loadAdminUsers()
+	if err := moderation.load(); err != nil {
+		log.Fatalf("Error loading bans and mutes: %v", err)
+	}
+	if err := loadFilters(); err != nil {
+		log.Fatalf("Error loading content filters: %v", err)
+	}
+	if err := reviews.load(); err != nil {
+		log.Fatalf("Error loading review queue: %v", err)
+	}
+	if err := history.load(); err != nil {
+		log.Fatalf("Error loading message history: %v", err)
+	}
+	go flushOnShutdown()
+	provider, err := loadCredentialProvider()
+	if err != nil {
+		log.Fatalf("Error loading bot credentials: %v", err)
+	}
+	botCredentials = provider
+	log.Printf("Using bot credentials from %s", provider)
+	if os.Getenv("SESSION_SECRET") == "" {
+		log.Println("SESSION_SECRET is not set; sessions will not survive a restart")
+	}
 
 	go handleMessages()
 
@@ -56,58 +192,113 @@ func main() {
 	if port == "" {
 		port = "8080" // Default to 8080 if no port is specified
 	}
-	log.Println("Server starting on port:", port)
-	err := http.ListenAndServe(":"+port, nil)
+	server := &http.Server{Addr: ":" + port, Handler: withHSTS(withSecurityHeaders(http.DefaultServeMux))}
+	if tlsEnabled() {
+		log.Println("Server starting with TLS on port:", port)
+		err = serveTLS(server, port)
+	} else {
+		log.Println("Server starting on port:", port)
+		err = server.ListenAndServe()
+	}
 	if err != nil {
 		log.Fatalf("Error starting server: %v", err)
 	}
 }
 
+// flushOnShutdown writes the history changes that are still waiting when the server is stopped
+func flushOnShutdown() {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
+	history.flush()
+	os.Exit(0)
+}
+
 func serveHome(w http.ResponseWriter, r *http.Request) {
 	http.ServeFile(w, r, "static/index.html")
 }
 
 var (
-	messageRateLimit  = 100 * time.Millisecond // Minimum 100ms between messages
-	clientLastMessage = make(map[*websocket.Conn]time.Time)
-	maxMessageSize    = 1024            // Limit the size of incoming messages to 1KB
-	messageCharLimit  = 500             // Limit the character length of a message
-	connectionTimeout = 5 * time.Minute // Timeout for read operations
+	maxMessageSize    = 1024             // Limit the size of incoming messages to 1KB
+	messageCharLimit  = 500              // Limit the character length of a message
+	connectionTimeout = 5 * time.Minute  // Timeout for read operations
+	writeTimeout      = 10 * time.Second // Timeout for writing a frame to a client that stopped reading
 )
 
-// Rate limiter for messages
-func canSendMessage(conn *websocket.Conn) bool {
-	lastMessageTime, exists := clientLastMessage[conn]
-	if !exists || time.Since(lastMessageTime) > messageRateLimit {
-		clientLastMessage[conn] = time.Now()
-		return true
-	}
-	return false
-}
+var ipConnectionCount = make(map[string]int)
+var ipConnectionMu sync.Mutex
+var maxConnectionsPerIP = 8 // Limit to 8 connections per IP
 
-// Sanitize user messages (example: trim spaces, remove unwanted characters)
-func sanitizeMessage(input string) string {
-	// Add specific sanitization logic as needed
-	return input // Here we simply return the input; customize as necessary
+// trackConnection counts a connection of an address and reports whether the address is within
+// the limit. Every call is matched by untrackConnection, even when the connection is refused.
+func trackConnection(ip string) bool {
+	ipConnectionMu.Lock()
+	defer ipConnectionMu.Unlock()
+	ipConnectionCount[ip]++
+	return ipConnectionCount[ip] <= maxConnectionsPerIP
 }
 
-var ipConnectionCount = make(map[string]int)
-var maxConnectionsPerIP = 8 // Limit to 8 connections per IP
+// untrackConnection forgets a connection counted by trackConnection
+func untrackConnection(ip string) {
+	ipConnectionMu.Lock()
+	defer ipConnectionMu.Unlock()
+	ipConnectionCount[ip]--
+	if ipConnectionCount[ip] <= 0 {
+		delete(ipConnectionCount, ip)
+	}
+}
 
 func handleConnections(w http.ResponseWriter, r *http.Request) {
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
+	ip, ok := clientIP(r) // The address of the user, even behind trusted proxies
+	if !ok {
 		http.Error(w, "Invalid client address", http.StatusBadRequest)
 		return
 	}
 
+	// Other websites must not open sockets with the cookies of our users
+	if !originAllowed(r) {
+		metrics.inc("upgrade_rejected_origin")
+		log.Printf("Rejected WebSocket from %s with origin %q", ip, r.Header.Get("Origin"))
+		http.Error(w, "Forbidden: Origin not allowed", http.StatusForbidden)
+		return
+	}
+
+	// Only logged-in users may connect unless guests are allowed
+	session := sessionFromRequest(r)
+	if ssoRequired && (session == nil || session.Provider != oidcProviderName) {
+		metrics.inc("upgrade_rejected_auth")
+		http.Error(w, "Unauthorized: Please sign in with single sign-on", http.StatusUnauthorized)
+		return
+	}
+	if session == nil && !guestMode {
+		metrics.inc("upgrade_rejected_auth")
+		http.Error(w, "Unauthorized: Please log in", http.StatusUnauthorized)
+		return
+	}
+	if !csrfValid(r) {
+		metrics.inc("upgrade_rejected_csrf")
+		log.Printf("Rejected WebSocket from %s without a valid CSRF token", ip)
+		http.Error(w, "Forbidden: Invalid CSRF token", http.StatusForbidden)
+		return
+	}
+
+	// Banned users and addresses are turned away before the upgrade
+	sessionUser := ""
+	if session != nil {
+		sessionUser = session.Username
+	}
+	if sanction, banned := activeBan(sessionUser, ip); banned {
+		metrics.inc("upgrade_rejected_ban")
+		http.Error(w, "Forbidden: "+sanction.banText(), http.StatusForbidden)
+		return
+	}
+
 	// Increment the count for this IP
-	ipConnectionCount[ip]++
-	defer func() {
-		ipConnectionCount[ip]--
-	}()
+	withinLimit := trackConnection(ip)
+	defer untrackConnection(ip)
 
-	if ipConnectionCount[ip] > maxConnectionsPerIP {
+	if !withinLimit {
+		metrics.inc("upgrade_rejected_connections")
 		http.Error(w, "Bad Request: Too many connections", http.StatusTooManyRequests)
 		return
 	}
@@ -119,11 +310,34 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close() // Ensure the connection is closed when the function exits
 
-	clients[conn] = true // Add the new client to the list of active connections
-	log.Println("New client connected")
-	defer delete(clients, conn) // Remove the client when they disconnect
-
 	sessionID := fmt.Sprintf("session-%d", time.Now().UnixNano()) // Create a unique session ID
+	client := &Client{conn: conn, id: randomToken(), ip: ip, sessionID: sessionID, room: lobbyRoom, account: sessionUser, session: session, roles: rolesFor(session)}
+
+	clientsMu.Lock()
+	clients[conn] = client // Add the new client to the list of active connections
+	clientsMu.Unlock()
+
+	// The authenticated identity replaces any client-supplied username
+	if session != nil {
+		if _, err := claimUsername(client, session.Username); err != nil {
+			log.Printf("Error binding account %s: %v", session.Username, err)
+		} else {
+			client.writeJSON(Message{Type: "joined", Username: client.username, Room: client.room})
+			sendUnread(client)
+			enterRoom(client)
+		}
+	}
+	log.Printf("New client connected from %s", ip)
+	defer func() { // Remove the client when they disconnect
+		releaseUsername(client)
+		forgetConnection(client)
+		clientsMu.Lock()
+		delete(clients, conn)
+		name, room := client.username, client.room
+		clientsMu.Unlock()
+		stopTyping(client)
+		leaveRoom(client, name, room)
+	}()
 
 	// Configure WebSocket read limits and timeout
 	conn.SetReadLimit(int64(maxMessageSize))                // Set max message size
@@ -145,91 +359,232 @@ func handleConnections(w http.ResponseWriter, r *http.Request) {
 		}
 
 		// Check if the user is sending messages too quickly
-		if !canSendMessage(conn) {
-			conn.WriteMessage(websocket.TextMessage, []byte("You are sending messages too quickly. Please slow down."))
+		if !allowFrame(client) {
 			continue
 		}
 
 		// Check for excessive message length
 		if len(msg.Message) > messageCharLimit {
-			log.Printf("Message too long from user: %s", msg.Username)
-			conn.WriteMessage(websocket.TextMessage, []byte("Message is too long. Limit to 500 characters."))
+			log.Printf("Message too long from user: %s", client.username)
+			client.writeText("Message is too long. Limit to 500 characters.")
 			continue
 		}
 
 		// Sanitize the message content
 		msg.Message = sanitizeMessage(msg.Message)
 
-		// Broadcast the user's message to all clients
-		broadcast <- Message{Username: msg.Username, Message: msg.Message}
-
-		// Check if the message is a bot command (e.g., "/bot1 Hello!")
-		if len(msg.Message) >= 5 && msg.Message[:4] == "/bot" {
-			botPrefix := msg.Message[:5] // Extract the bot command (e.g., "/bot1")
-			agentID, exists := botAgentMap[botPrefix]
-			if !exists {
-				// If the bot command is invalid, notify the user
-				broadcast <- Message{Username: "Bot", Message: "Invalid bot command. Use /bot1 to /bot9."}
+		// The first frame binds the username of the connection. Older pages send a
+		// "joined" chat message instead of a join frame, which is not shown either.
+		if client.username == "" {
+			if !joinChat(client, msg.Username) || msg.Type == "join" || msg.Message == "joined" {
+				if sanction, banned := activeBan(client.username, ip); banned {
+					client.disconnect("banned", sanction.banText())
+					break
+				}
 				continue
 			}
+		}
 
-			// Remove the bot prefix and process the remaining message as a query
-			userMessage := msg.Message[5:]
-			botResponses, err := queryDialogflow(sessionID, userMessage, agentID)
-			if err != nil {
-				log.Printf("Dialogflow error: %v", err)
-				broadcast <- Message{Username: "Bot", Message: "Sorry, I couldn't process your request."}
-				continue
+		// Bans may start while connected, or apply to the name a guest picked
+		if sanction, banned := activeBan(client.username, ip); banned {
+			client.disconnect("banned", sanction.banText())
+			break
+		}
+
+		// Idle reports of the page switch the user between online and away
+		if msg.Type == "presence" {
+			setAway(client, msg.Status == presenceAway)
+			continue
+		}
+		if msg.Type == "read" {
+			markRead(client, msg.ID)
+			continue
+		}
+		if msg.Type == "subscribe" || msg.Type == "unsubscribe" {
+			followThread(client, msg)
+			continue
+		}
+
+		if sanction, muted := activeMute(client); muted {
+			client.writeJSON(Message{Type: "error", Code: "muted", Username: "System", Message: "You are muted for another " + sanction.remaining(), Room: client.room})
+			continue
+		}
+
+		// Edits and deletions refer to a message of the room by its ID
+		if msg.Type == "edit" || msg.Type == "delete" {
+			changeMessage(client, msg)
+			continue
+		}
+
+		if msg.Type == "react" {
+			react(client, msg)
+			continue
+		}
+
+		// Typing indicators are relayed to the room, never stored
+		if msg.Type == "typing_start" || msg.Type == "typing_stop" {
+			if msg.Type == "typing_start" && client.can(permSend) {
+				startTyping(client)
+			} else {
+				stopTyping(client)
 			}
+			continue
+		}
 
-			// Broadcast all bot responses to the chat
-			for _, botResponse := range botResponses {
-				broadcast <- Message{Username: "Bot", Message: botResponse}
+		// Slash commands are dispatched through the command registry
+		if strings.HasPrefix(msg.Message, "/") {
+			dispatchCommand(client, msg.Message)
+			continue
+		}
+
+		if !client.can(permSend) {
+			client.notify("You are not allowed to send messages")
+			continue
+		}
+
+		// Replies go into the thread of their parent
+		parentID := int64(0)
+		if msg.ParentID != 0 {
+			var found bool
+			if parentID, found = threadRoot(client.room, msg.ParentID); !found {
+				client.writeJSON(Message{Type: "error", Code: "thread_not_found", Username: "System", Message: "The message you reply to is not in this room", Room: client.room})
+				continue
 			}
 		}
+
+		// Floods of near-duplicates or mentions get the sender muted
+		if checkSpam(client, msg.Message) {
+			continue
+		}
+
+		// The content filters of the room may mask, refuse or hold the message
+		result := filterMessage(client, msg.Message)
+		switch result.Action {
+		case filterReject:
+			client.writeJSON(Message{Type: "error", Code: "message_rejected", Username: "System", Message: "Your message was not sent: " + result.Reason, Room: client.room})
+			continue
+		case filterFlag:
+			holdForReview(client, result.Text, result.Reason, parentID)
+			continue
+		}
+		msg.Message = result.Text
+
+		// Broadcast the user's message to everyone in the same room; sending ends typing
+		stopTyping(client)
+		broadcast <- Message{Username: client.username, Message: msg.Message, HTML: renderMarkdown(msg.Message), Room: client.room, ParentID: parentID, author: authorID(client)}
+
+		// Everything else goes to the bot attached to the room, if any. Bots answer in the room, so replies in threads are left alone.
+		if parentID == 0 {
+			forwardToRoomBot(client, client.room, msg.Message)
+		}
+	}
+}
+
+// broadcastBotResponses posts the replies of a bot query, or an apology if it failed before
+// replying at all. The reply template decides the room and visibility of every response.
+func broadcastBotResponses(reply Message, botResponses []string, err error) {
+	reply.Username = "Bot"
+	if err != nil {
+		log.Printf("Dialogflow error: %v", err)
+		if len(botResponses) == 0 {
+			reply.Message = "Sorry, I couldn't process your request."
+			broadcast <- reply
+			return
+		}
+	}
+
+	// Broadcast all bot responses to the chat
+	for _, botResponse := range botResponses {
+		reply.Message = botResponse
+		broadcast <- reply
 	}
 }
 
 func handleMessages() {
 	for msg := range broadcast {
-		for client := range clients {
-			err := client.WriteJSON(msg)
-			if err != nil {
-				log.Printf("WebSocket write error: %v", err)
-				client.Close()
-				delete(clients, client)
+		// Chat messages of rooms are numbered and kept; other frames are only relayed
+		if msg.Type == "" && !msg.Private {
+			msg = history.record(msg)
+		}
+		deliver(msg)
+
+		// A reply also updates the summary of its thread
+		if msg.Type == "" && msg.ParentID != 0 {
+			if parent, found := history.find(msg.Room, msg.ParentID); found {
+				deliver(threadFrame(parent))
 			}
 		}
 	}
 }
 
+// deliver writes a frame to the clients in its room and the followers of its thread,
+// or to the recipient of a private message. The writes happen outside clientsMu, so a
+// slow client holds up neither the other deliveries nor the permission checks.
+func deliver(msg Message) {
+	clientsMu.Lock()
+	var targets []*Client
+	for _, client := range clients {
+		if msg.Private {
+			// Private messages reach every connection of the recipient, whatever the room. They go by
+			// identity rather than name, so a guest who takes the name of the asker gets nothing.
+			if authorID(client) != msg.recipient {
+				continue
+			}
+		} else if roomName(client.room) != roomName(msg.Room) && !client.followsLocked(msg) {
+			continue
+		}
+		if msg.exceptSender && client.username == msg.Username {
+			continue
+		}
+		targets = append(targets, client)
+	}
+	clientsMu.Unlock()
+
+	for _, client := range targets {
+		if err := client.writeJSON(msg); err != nil {
+			log.Printf("WebSocket write error: %v", err)
+			client.conn.Close()
+			clientsMu.Lock()
+			delete(clients, client.conn)
+			clientsMu.Unlock()
+		}
+	}
+}
+
 func queryDialogflow(sessionID, message, agentID string) ([]string, error) {
-	ctx := context.Background()
+	// Create a text input
+	textInput := &cxpb.TextInput{
+		Text: message,
+	}
+	queryInput := &cxpb.QueryInput{
+		Input: &cxpb.QueryInput_Text{
+			Text: textInput,
+		},
+		LanguageCode: "en",
+	}
+	return detectIntent(sessionID, agentID, queryInput)
+}
 
-	var credentials []byte
-	var err error
+// queryDialogflowEvent triggers a named event (e.g. the welcome event) on the agent
+func queryDialogflowEvent(sessionID, event, agentID string) ([]string, error) {
+	queryInput := &cxpb.QueryInput{
+		Input: &cxpb.QueryInput_Event{
+			Event: &cxpb.EventInput{Event: event},
+		},
+		LanguageCode: "en",
+	}
+	return detectIntent(sessionID, agentID, queryInput)
+}
 
-	// Check if the DIALOGFLOW_CREDENTIALS environment variable is set
-	credentialsEnv := os.Getenv("DIALOGFLOW_CREDENTIALS")
-	if credentialsEnv != "" {
-		// If it's set, it should contain base64 encoded credentials (for Docker)
-		log.Println("Using DIALOGFLOW_CREDENTIALS from environment variable")
-		credentials, err = base64.StdEncoding.DecodeString(credentialsEnv)
-		if err != nil {
-			return nil, fmt.Errorf("failed to decode credentials from environment variable: %v", err)
-		}
-	} else {
-		// If not set, try to read from the local file (credentials.json)
-		log.Println("Using credentials.json from the local filesystem")
-		credentials, err = os.ReadFile("credentials.json")
-		if err != nil {
-			// Check if the code is running in a Docker container (based on Docker's file mounting)
-			log.Println("No credentials found in the local filesystem, attempting to load from Docker")
-			credentials, err = os.ReadFile("/app/credentials/credentials.json")
-			if err != nil {
-				return nil, fmt.Errorf("failed to read credentials file: %v", err)
-			}
-		}
+func detectIntent(sessionID, agentID string, queryInput *cxpb.QueryInput) ([]string, error) {
+	ctx := context.Background()
+
+	if botCredentials == nil {
+		return nil, errNoCredentialSource
+	}
+	credentials, err := botCredentials.credentials()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read credentials from %s: %v", botCredentials, err)
 	}
 
 	// Configure the Dialogflow client
@@ -250,31 +605,29 @@ func queryDialogflow(sessionID, message, agentID string) ([]string, error) {
 	location := "us-central1"
 	sessionPath := fmt.Sprintf("projects/%s/locations/%s/agents/%s/sessions/%s", projectID, location, agentID, sessionID)
 
-	// Create a text input
-	textInput := &cxpb.TextInput{
-		Text: message,
-	}
-	queryInput := &cxpb.QueryInput{
-		Input: &cxpb.QueryInput_Text{
-			Text: textInput,
-		},
-		LanguageCode: "en",
-	}
+	var responses []string
+	for i := 0; queryInput != nil && i <= maxBotEventChain; i++ {
+		// Send the query to Dialogflow CX
+		response, err := client.DetectIntent(ctx, &cxpb.DetectIntentRequest{
+			Session:    sessionPath,
+			QueryInput: queryInput,
+		})
+		if err != nil {
+			// Replies collected before a follow-up event failed are still worth showing
+			return responses, fmt.Errorf("failed to detect intent: %v", err)
+		}
 
-	// Send the query to Dialogflow CX
-	response, err := client.DetectIntent(ctx, &cxpb.DetectIntentRequest{
-		Session:    sessionPath,
-		QueryInput: queryInput,
-	})
-	if err != nil {
-		return nil, fmt.Errorf("failed to detect intent: %v", err)
-	}
+		// Extract all response messages
+		texts, event := parseResponseMessages(response.GetQueryResult().GetResponseMessages())
+		responses = append(responses, texts...)
 
-	// Extract all response messages
-	var responses []string
-	for _, message := range response.GetQueryResult().GetResponseMessages() {
-		if text := message.GetText().GetText(); len(text) > 0 {
-			responses = append(responses, text[0]) // Append each message to the list
+		// A webhook may ask for a follow-up event through a custom payload
+		queryInput = nil
+		if event != "" {
+			queryInput = &cxpb.QueryInput{
+				Input:        &cxpb.QueryInput_Event{Event: &cxpb.EventInput{Event: event}},
+				LanguageCode: "en",
+			}
 		}
 	}
 
@@ -284,3 +637,19 @@ func queryDialogflow(sessionID, message, agentID string) ([]string, error) {
 
 	return responses, nil
 }
+
+// parseResponseMessages collects the text replies and the first custom event
+// requested via a `{"event": "<name>"}` payload
+func parseResponseMessages(messages []*cxpb.ResponseMessage) ([]string, string) {
+	var texts []string
+	var event string
+	for _, message := range messages {
+		if text := message.GetText().GetText(); len(text) > 0 {
+			texts = append(texts, text[0]) // Append each message to the list
+		}
+		if name := message.GetPayload().GetFields()["event"].GetStringValue(); name != "" && event == "" {
+			event = name
+		}
+	}
+	return texts, event
+}
@@ -1,16 +1,18 @@
 package main
 
 import (
-	"encoding/base64"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
-	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"cloud.google.com/go/dialogflow/cx/apiv3/cxpb"
 	"github.com/gorilla/websocket"
 	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/types/known/structpb"
 )
 
 func TestBotAgentMap(t *testing.T) {
@@ -120,9 +122,9 @@ func TestQueryDialogflowMock(t *testing.T) {
 }
 
 func TestQueryDialogflow(t *testing.T) {
-	originalEnv := os.Getenv("DIALOGFLOW_CREDENTIALS")
-	defer os.Setenv("DIALOGFLOW_CREDENTIALS", originalEnv)
-	os.Setenv("DIALOGFLOW_CREDENTIALS", base64.StdEncoding.EncodeToString([]byte(`{}`))) // Mock credentials
+	original := botCredentials
+	defer func() { botCredentials = original }()
+	botCredentials = &staticCredentials{source: "test", key: []byte(`{}`)} // Mock credentials
 
 	sessionID := "test-session"
 	message := "Hello"
@@ -134,13 +136,13 @@ func TestQueryDialogflow(t *testing.T) {
 	assert.Nil(t, responses, "Expected no responses due to error")
 }
 
-func TestMissingEnvVariable(t *testing.T) {
-	originalValue := os.Getenv("DIALOGFLOW_CREDENTIALS")
-	defer os.Setenv("DIALOGFLOW_CREDENTIALS", originalValue)
+func TestMissingCredentials(t *testing.T) {
+	original := botCredentials
+	defer func() { botCredentials = original }()
 
-	os.Unsetenv("DIALOGFLOW_CREDENTIALS")
+	botCredentials = nil
 	_, err := queryDialogflow("test-session", "Hello", "valid-agent")
-	assert.Error(t, err, "Expected an error when DIALOGFLOW_CREDENTIALS is missing")
+	assert.ErrorIs(t, err, errNoCredentialSource, "Expected an error when no credentials are configured")
 }
 
 func TestEmptyMessageHandling(t *testing.T) {
@@ -207,16 +209,20 @@ func TestSimulatedChatFlow(t *testing.T) {
 }
 
 func TestRateLimiting(t *testing.T) {
-	conn := &websocket.Conn{} // Mock connection
-	canSend1 := canSendMessage(conn)
-	assert.True(t, canSend1, "Expected to allow sending the first message")
+	scope := newRateScope("test", rateLimit{PerMinute: 600, Burst: 3}) // 10 a second after a burst of 3
+	for i := 0; i < 3; i++ {
+		wait, _ := takeTokens([]rateKey{{scope, "conn"}})
+		assert.Zero(t, wait, "Expected a burst to be allowed")
+	}
 
-	canSend2 := canSendMessage(conn)
-	assert.False(t, canSend2, "Expected to block sending a message too quickly")
+	wait, name := takeTokens([]rateKey{{scope, "conn"}})
+	assert.Greater(t, wait, time.Duration(0), "Expected to block sending a message too quickly")
+	assert.LessOrEqual(t, wait, 100*time.Millisecond)
+	assert.Equal(t, "test", name)
 
 	time.Sleep(100 * time.Millisecond)
-	canSend3 := canSendMessage(conn)
-	assert.True(t, canSend3, "Expected to allow sending a message after rate limit duration")
+	wait, _ = takeTokens([]rateKey{{scope, "conn"}})
+	assert.Zero(t, wait, "Expected to allow sending a message once a token is refilled")
 }
 
 func TestConnectionTimeout(t *testing.T) {
@@ -263,19 +269,40 @@ func TestIPConnectionLimit(t *testing.T) {
 
 	// Simulate connections from the same IP
 	for i := 0; i < maxConnectionsPerIP; i++ {
-		ipConnectionCount[ip]++
+		assert.True(t, trackConnection(ip), "Expected connection %d to be within the limit", i+1)
 	}
 
 	// Exceed the limit
-	ipConnectionCount[ip]++
+	assert.False(t, trackConnection(ip), "Expected the connection over the limit to be refused")
+	ipConnectionMu.Lock()
 	assert.Equal(t, maxConnectionsPerIP+1, ipConnectionCount[ip], "Expected IP connection count to increment")
+	ipConnectionMu.Unlock()
 
-	if ipConnectionCount[ip] > maxConnectionsPerIP {
-		t.Log("IP exceeded connection limit, as expected")
+	// Clean up
+	for i := 0; i <= maxConnectionsPerIP; i++ {
+		untrackConnection(ip)
 	}
+	ipConnectionMu.Lock()
+	_, counted := ipConnectionCount[ip]
+	ipConnectionMu.Unlock()
+	assert.False(t, counted, "Expected the address to be forgotten once its connections are gone")
+}
 
-	// Clean up
-	ipConnectionCount[ip] = 0
+func TestIPConnectionCountUnderConcurrentConnects(t *testing.T) {
+	ip := "192.0.2.10"
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			trackConnection(ip)
+			untrackConnection(ip)
+		}()
+	}
+	wg.Wait()
+	ipConnectionMu.Lock()
+	defer ipConnectionMu.Unlock()
+	assert.Zero(t, ipConnectionCount[ip], "Expected every connection to be released")
 }
 
 func TestConnectionLimit(t *testing.T) {
@@ -314,7 +341,7 @@ func TestConnectionLimit(t *testing.T) {
 
 func TestSanitizeMessage(t *testing.T) {
 	input := " <script>alert('test')</script> "
-	expected := " <script>alert('test')</script> " // Replace with your sanitization logic
+	expected := " <script>alert('test')</script> " // Markup is plain text and kept as typed
 	output := sanitizeMessage(input)
 	assert.Equal(t, expected, output, "Expected sanitized message to match")
 }
@@ -436,8 +463,114 @@ func TestBroadcastEmptyChannel(t *testing.T) {
 
 func TestSanitizedMessageHandling(t *testing.T) {
 	rawMessage := " <script>alert('xss')</script> "
-	expectedSanitized := " <script>alert('xss')</script> " // Adjust based on sanitization logic
+	expectedSanitized := " <script>alert('xss')</script> " // Clients render it as text
 
 	sanitizedMessage := sanitizeMessage(rawMessage)
 	assert.Equal(t, expectedSanitized, sanitizedMessage, "Expected sanitization logic to clean input correctly")
 }
+
+func TestParseResponseMessages(t *testing.T) {
+	payload, err := structpb.NewStruct(map[string]interface{}{"event": "order.lookup"})
+	assert.NoError(t, err)
+
+	messages := []*cxpb.ResponseMessage{
+		{Message: &cxpb.ResponseMessage_Text_{Text: &cxpb.ResponseMessage_Text{Text: []string{"Welcome!"}}}},
+		{Message: &cxpb.ResponseMessage_Payload{Payload: payload}},
+		{Message: &cxpb.ResponseMessage_Text_{Text: &cxpb.ResponseMessage_Text{Text: []string{"How can I help?"}}}},
+	}
+
+	texts, event := parseResponseMessages(messages)
+	assert.Equal(t, []string{"Welcome!", "How can I help?"}, texts)
+	assert.Equal(t, "order.lookup", event, "Expected the payload event to be picked up")
+}
+
+func TestQueryDialogflowEvent(t *testing.T) {
+	original := botCredentials
+	defer func() { botCredentials = original }()
+	botCredentials = &staticCredentials{source: "test", key: []byte(`{}`)} // Mock credentials
+
+	responses, err := queryDialogflowEvent("test-session", botWelcomeEvent, "valid-agent-id")
+	assert.Error(t, err, "Expected error with mocked credentials")
+	assert.NotErrorIs(t, err, errNoCredentialSource, "Expected the mocked credentials to be used")
+	assert.Nil(t, responses, "Expected no responses due to error")
+}
+
+func TestIsPrivateBotConversation(t *testing.T) {
+	assert.True(t, isPrivateBotConversation("/bot7", false), "Expected Healthcare to be private")
+	assert.True(t, isPrivateBotConversation("/bot2", true), "Expected /botN! to force a private query")
+	assert.False(t, isPrivateBotConversation("/bot2", false), "Expected Small Talk to be public")
+}
+
+func TestPrivateBotRepliesOnlyReachAsker(t *testing.T) {
+	startTestHub(t)
+	stubBots(t, func(sessionID, input, agentID string) ([]string, error) {
+		return []string{"private answer"}, nil
+	})
+	wsURL := startTestServer(t)
+
+	asker := joinTestClient(t, wsURL, "Alice")
+	other := joinTestClient(t, wsURL, "Bob")
+
+	sendTestMessage(t, asker, Message{Username: "Alice", Message: "/bot2! are you there?"})
+	query := readTestMessage(t, asker)
+	assert.True(t, query.Private, "Expected the query echo to be private")
+	reply := readTestMessage(t, asker)
+	assert.Equal(t, "private answer", reply.Message)
+	assert.True(t, reply.Private)
+
+	sendTestMessage(t, other, Message{Username: "Bob", Message: "hi"})
+	assert.Equal(t, "hi", readTestMessage(t, other).Message, "Expected the private conversation to be skipped")
+}
+
+func TestPrivateBotRepliesDoNotFollowTheName(t *testing.T) {
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	// The asker left while the bot was answering, and another guest took the name
+	asker := &Client{id: "gone", username: "Alice", room: lobbyRoom}
+	impostor := joinTestClient(t, wsURL, "Alice")
+	reply := botReplyTemplate(asker, true)
+	reply.Message = "your test results"
+	broadcast <- reply
+
+	sendTestMessage(t, impostor, Message{Message: "hi"})
+	assert.Equal(t, "hi", readTestMessage(t, impostor).Message, "Expected the reply meant for the first Alice to be dropped")
+}
+
+func TestPartialBotRepliesAreKept(t *testing.T) {
+	startTestHub(t)
+	stubBots(t, func(sessionID, input, agentID string) ([]string, error) {
+		return []string{"Looking up your order"}, fmt.Errorf("follow-up event failed")
+	})
+	wsURL := startTestServer(t)
+
+	asker := joinTestClient(t, wsURL, "Alice")
+	sendTestMessage(t, asker, Message{Message: "/bot2 where is my order?"})
+	assert.Equal(t, "/bot2 where is my order?", readTestMessage(t, asker).Message)
+	assert.Equal(t, "Looking up your order", readTestMessage(t, asker).Message, "Expected the replies before the failure")
+	sendTestMessage(t, asker, Message{Message: "thanks"})
+	assert.Equal(t, "thanks", readTestMessage(t, asker).Message, "Expected no apology after partial replies")
+}
+
+func TestSlowClientDoesNotHoldUpOthers(t *testing.T) {
+	original := writeTimeout
+	writeTimeout = 200 * time.Millisecond
+	t.Cleanup(func() { writeTimeout = original })
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	joinTestClient(t, wsURL, "Stuck") // Never reads again
+	alice := joinTestClient(t, wsURL, "Alice")
+	stuck := onlineClients("Stuck")[0]
+
+	// Enough to fill the socket buffers towards the client that stopped reading, then a frame for everyone
+	filler := Message{Type: "notice", Username: "System", Message: strings.Repeat("x", 64*1024), Private: true, recipient: authorID(stuck)}
+	go func() {
+		for i := 0; i < 300; i++ {
+			broadcast <- filler
+		}
+		broadcast <- Message{Type: "notice", Username: "System", Message: "still there?", Room: lobbyRoom}
+	}()
+	assert.Equal(t, "still there?", readTestMessage(t, alice).Message)
+	assert.Len(t, onlineClients("Stuck"), 0, "Expected the stuck client to be dropped")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// renderMarkdown turns a chat message into HTML using a small Markdown subset: **bold**, *italic*,
+// `inline code`, fenced code blocks, [links](https://...) and lists. Everything else is escaped,
+// so the result only ever contains the tags produced here.
+func renderMarkdown(text string) string {
+	var b strings.Builder
+	lines := strings.Split(text, "\n")
+	for i := 0; i < len(lines); {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(strings.TrimSpace(line), "```"):
+			i = renderCodeBlock(&b, lines, i)
+		case unorderedItemPattern.MatchString(line):
+			i = renderList(&b, lines, i, unorderedItemPattern, "ul")
+		case orderedItemPattern.MatchString(line):
+			i = renderList(&b, lines, i, orderedItemPattern, "ol")
+		case strings.TrimSpace(line) == "":
+			i++
+		default:
+			i = renderParagraph(&b, lines, i)
+		}
+	}
+	return b.String()
+}
+
+var (
+	unorderedItemPattern = regexp.MustCompile(`^\s*[-*+]\s+(.*)$`)
+	orderedItemPattern   = regexp.MustCompile(`^\s*\d{1,9}[.)]\s+(.*)$`)
+	codeLanguagePattern  = regexp.MustCompile(`^[A-Za-z0-9_+-]{1,20}$`)
+)
+
+// renderCodeBlock renders a fenced code block starting at lines[start] and returns the next line to render.
+// An unterminated fence runs to the end of the message.
+func renderCodeBlock(b *strings.Builder, lines []string, start int) int {
+	language := strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(lines[start]), "```"))
+	end := start + 1
+	for end < len(lines) && strings.TrimSpace(lines[end]) != "```" {
+		end++
+	}
+	if codeLanguagePattern.MatchString(language) {
+		b.WriteString(`<pre><code class="language-` + strings.ToLower(language) + `">`)
+	} else {
+		b.WriteString("<pre><code>")
+	}
+	b.WriteString(html.EscapeString(strings.Join(lines[start+1:min(end, len(lines))], "\n")))
+	b.WriteString("</code></pre>")
+	return end + 1
+}
+
+// renderList renders consecutive list items and returns the next line to render
+func renderList(b *strings.Builder, lines []string, start int, item *regexp.Regexp, tag string) int {
+	b.WriteString("<" + tag + ">")
+	i := start
+	for ; i < len(lines); i++ {
+		match := item.FindStringSubmatch(lines[i])
+		if match == nil {
+			break
+		}
+		b.WriteString("<li>" + renderInline(match[1]) + "</li>")
+	}
+	b.WriteString("</" + tag + ">")
+	return i
+}
+
+// renderParagraph renders lines up to the next blank line or block and returns the next line to render
+func renderParagraph(b *strings.Builder, lines []string, start int) int {
+	var rendered []string
+	i := start
+	for ; i < len(lines); i++ {
+		line := lines[i]
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(strings.TrimSpace(line), "```") ||
+			unorderedItemPattern.MatchString(line) || orderedItemPattern.MatchString(line) {
+			break
+		}
+		rendered = append(rendered, renderInline(line))
+	}
+	b.WriteString("<p>" + strings.Join(rendered, "<br>") + "</p>")
+	return i
+}
+
+var (
+	codeSpanPattern = regexp.MustCompile("`([^`]+)`")
+	linkPattern     = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	placeholder     = regexp.MustCompile("\x00([0-9]+)\x00")
+	strongPattern   = regexp.MustCompile(`\*\*([^*]+)\*\*|__([^_]+)__`)
+	emPattern       = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// renderInline renders the formatting of a single line. Code spans and links are swapped for
+// placeholders first, so emphasis markers inside them (e.g. "_" in a URL) are left alone.
+// sanitizeMessage removes NUL characters, so user text cannot forge a placeholder.
+func renderInline(line string) string {
+	var fragments []string
+	keep := func(fragment string) string {
+		fragments = append(fragments, fragment)
+		return fmt.Sprintf("\x00%d\x00", len(fragments)-1)
+	}
+
+	line = codeSpanPattern.ReplaceAllStringFunc(line, func(span string) string {
+		return keep("<code>" + html.EscapeString(codeSpanPattern.FindStringSubmatch(span)[1]) + "</code>")
+	})
+	line = linkPattern.ReplaceAllStringFunc(line, func(link string) string {
+		match := linkPattern.FindStringSubmatch(link)
+		href, ok := safeLinkURL(match[2])
+		if !ok {
+			return link // Shown as typed
+		}
+		return keep(`<a href="` + html.EscapeString(href) + `" rel="nofollow noopener noreferrer" target="_blank">` +
+			renderEmphasis(html.EscapeString(match[1])) + "</a>")
+	})
+
+	// A link text may itself hold a code span, so fragments are restored recursively;
+	// they only refer to fragments kept before them
+	var restore func(text string, limit int) string
+	restore = func(text string, limit int) string {
+		return placeholder.ReplaceAllStringFunc(text, func(ref string) string {
+			index, err := strconv.Atoi(placeholder.FindStringSubmatch(ref)[1])
+			if err != nil || index >= limit {
+				return ""
+			}
+			return restore(fragments[index], index)
+		})
+	}
+	return restore(renderEmphasis(html.EscapeString(line)), len(fragments))
+}
+
+// renderEmphasis applies bold and italic markers to escaped text
+func renderEmphasis(escaped string) string {
+	escaped = strongPattern.ReplaceAllStringFunc(escaped, func(span string) string {
+		match := strongPattern.FindStringSubmatch(span)
+		return "<strong>" + match[1] + match[2] + "</strong>"
+	})
+	return emPattern.ReplaceAllStringFunc(escaped, func(span string) string {
+		match := emPattern.FindStringSubmatch(span)
+		return "<em>" + match[1] + match[2] + "</em>"
+	})
+}
+
+// safeLinkURL accepts absolute http, https and mailto links only, so a link can never run script
+func safeLinkURL(raw string) (string, bool) {
+	parsed, err := url.Parse(raw)
+	if err != nil {
+		return "", false
+	}
+	switch strings.ToLower(parsed.Scheme) {
+	case "http", "https":
+		if parsed.Host == "" {
+			return "", false
+		}
+	case "mailto":
+	default:
+		return "", false
+	}
+	return parsed.String(), true
+}
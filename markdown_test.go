@@ -0,0 +1,89 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRenderMarkdown(t *testing.T) {
+	cases := map[string]string{
+		"hello":                               "<p>hello</p>",
+		"**bold** and *italic*":               "<p><strong>bold</strong> and <em>italic</em></p>",
+		"__bold__ and _italic_":               "<p><strong>bold</strong> and <em>italic</em></p>",
+		"snake_case_name stays":               "<p>snake_case_name stays</p>",
+		"run `go test ./...` now":             "<p>run <code>go test ./...</code> now</p>",
+		"`**not bold**`":                      "<p><code>**not bold**</code></p>",
+		"line one\nline two":                  "<p>line one<br>line two</p>",
+		"first\n\nsecond":                     "<p>first</p><p>second</p>",
+		"- one\n- **two**\n* three":           "<ul><li>one</li><li><strong>two</strong></li><li>three</li></ul>",
+		"1. first\n2) second":                 "<ol><li>first</li><li>second</li></ol>",
+		"Steps:\n1. pull\n2. build":           "<p>Steps:</p><ol><li>pull</li><li>build</li></ol>",
+		"```go\nfmt.Println(\"<hi>\")\n```":   "<pre><code class=\"language-go\">fmt.Println(&#34;&lt;hi&gt;&#34;)</code></pre>",
+		"```\n**raw**\n\n- raw":               "<pre><code>**raw**\n\n- raw</code></pre>",
+		"[docs](https://go.dev/doc/a_b_c)":    `<p><a href="https://go.dev/doc/a_b_c" rel="nofollow noopener noreferrer" target="_blank">docs</a></p>`,
+		"[*see* `this`](http://x.io?a=1&b=2)": `<p><a href="http://x.io?a=1&amp;b=2" rel="nofollow noopener noreferrer" target="_blank"><em>see</em> <code>this</code></a></p>`,
+		"[mail](mailto:help@example.com)":     `<p><a href="mailto:help@example.com" rel="nofollow noopener noreferrer" target="_blank">mail</a></p>`,
+		"[x](javascript:alert(1))":            "<p>[x](javascript:alert(1))</p>",
+		"[x](//evil.example)":                 "<p>[x](//evil.example)</p>",
+		"a < b && c > d":                      "<p>a &lt; b &amp;&amp; c &gt; d</p>",
+	}
+	for input, expected := range cases {
+		assert.Equal(t, expected, renderMarkdown(input), input)
+	}
+}
+
+var (
+	renderedTagPattern = regexp.MustCompile(`<(/?)([a-z]+)((?: [a-z]+="[^"<>]*")*)>`)
+	renderedAttributes = regexp.MustCompile(` ([a-z]+)="([^"]*)"`)
+	allowedTags        = map[string]bool{"p": true, "br": true, "strong": true, "em": true, "code": true, "pre": true, "ul": true, "ol": true, "li": true, "a": true}
+)
+
+// assertSafeHTML checks that rendered HTML only holds the tags and attributes of the Markdown subset
+func assertSafeHTML(t *testing.T, rendered string) {
+	t.Helper()
+	for _, tag := range renderedTagPattern.FindAllStringSubmatch(rendered, -1) {
+		assert.True(t, allowedTags[tag[2]], "Unexpected tag %q in %q", tag[0], rendered)
+		for _, attribute := range renderedAttributes.FindAllStringSubmatch(tag[3], -1) {
+			switch attribute[1] {
+			case "href":
+				assert.Regexp(t, `^(https?://|mailto:)`, attribute[2])
+			case "class", "rel", "target":
+			default:
+				t.Errorf("Unexpected attribute %q in %q", attribute[0], rendered)
+			}
+		}
+	}
+	// Once the known tags are removed, no markup may be left
+	text := renderedTagPattern.ReplaceAllString(rendered, "")
+	assert.False(t, strings.ContainsAny(text, "<>\""), "Unescaped markup in %q", rendered)
+}
+
+func TestRenderMarkdownKeepsXSSPayloadsInert(t *testing.T) {
+	for _, payload := range xssPayloads {
+		assertSafeHTML(t, renderMarkdown(sanitizeMessage(payload)))
+		assertSafeHTML(t, renderMarkdown("[link]("+payload+")"))
+	}
+}
+
+func TestChatMessagesCarryRenderedHTML(t *testing.T) {
+	startTestHub(t)
+	ws := joinTestClient(t, startTestServer(t), "Ivy")
+
+	sendTestMessage(t, ws, Message{Message: "**hi** <b>there</b>"})
+	msg := readTestMessage(t, ws)
+	assert.Equal(t, "**hi** <b>there</b>", msg.Message, "Expected the raw text to be kept for plain-text clients")
+	assert.Equal(t, "<p><strong>hi</strong> &lt;b&gt;there&lt;/b&gt;</p>", msg.HTML)
+}
+
+func FuzzRenderMarkdown(f *testing.F) {
+	for _, payload := range xssPayloads {
+		f.Add(payload)
+	}
+	f.Add("**a** _b_ `c` [d](https://e.f)\n- g\n1. h\n```js\ni\n```")
+	f.Fuzz(func(t *testing.T, input string) {
+		assertSafeHTML(t, renderMarkdown(sanitizeMessage(input)))
+	})
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+)
+
+// counters count security events, such as refused upgrades, for /api/admin/metrics
+type counters struct {
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+var metrics = &counters{values: make(map[string]int64)}
+
+func (c *counters) inc(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[name]++
+}
+
+func (c *counters) get(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[name]
+}
+
+// snapshot returns a copy of the counters
+func (c *counters) snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	values := make(map[string]int64, len(c.values))
+	for name, value := range c.values {
+		values[name] = value
+	}
+	return values
+}
+
+// handleAdminMetrics reports the counters
+func handleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, metrics.snapshot())
+}
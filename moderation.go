@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	sanctionBan  = "ban"
+	sanctionMute = "mute"
+)
+
+// Sanction is a ban or mute that lasts until it expires
+type Sanction struct {
+	Kind   string    `json:"kind"`
+	Target string    `json:"target"`         // Lowercased username, or an IP address for IP bans
+	User   string    `json:"user,omitempty"` // Lowercased guest whose mute also covers the address in Target
+	Reason string    `json:"reason,omitempty"`
+	By     string    `json:"by"`
+	Until  time.Time `json:"until"`
+}
+
+// moderationStore keeps the active sanctions in memory and persists them to a JSON file
+type moderationStore struct {
+	mu        sync.Mutex
+	path      string
+	sanctions map[string]*Sanction // By "<kind>:<target>"
+}
+
+var moderation = newModerationStore(filepath.Join(dataDir, "moderation.json"))
+
+func newModerationStore(path string) *moderationStore {
+	return &moderationStore{path: path, sanctions: make(map[string]*Sanction)}
+}
+
+func sanctionKey(kind, target string) string {
+	return kind + ":" + strings.ToLower(target)
+}
+
+// load reads the sanctions persisted by a previous run
+func (s *moderationStore) load() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return loadJSONFile(s.path, &s.sanctions)
+}
+
+// add records a sanction, replacing an earlier one of the same kind on the same target
+func (s *moderationStore) add(sanction Sanction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sanction.Target = strings.ToLower(sanction.Target)
+	key := sanctionKey(sanction.Kind, sanction.Target)
+	previous := s.sanctions[key]
+	s.sanctions[key] = &sanction
+	if err := s.save(); err != nil {
+		s.sanctions[key] = previous
+		if previous == nil {
+			delete(s.sanctions, key)
+		}
+		return err
+	}
+	return nil
+}
+
+// remove lifts a sanction, with the ones it was extended to, reporting whether there was one
+func (s *moderationStore) remove(kind, target string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := sanctionKey(kind, target)
+	sanction, exists := s.sanctions[key]
+	if !exists || time.Now().After(sanction.Until) {
+		return false, nil
+	}
+	removed := map[string]*Sanction{key: sanction}
+	for other, extended := range s.sanctions {
+		if extended.Kind == kind && extended.User != "" && extended.User == sanction.Target {
+			removed[other] = extended
+		}
+	}
+	for key := range removed {
+		delete(s.sanctions, key)
+	}
+	if err := s.save(); err != nil {
+		for key, sanction := range removed {
+			s.sanctions[key] = sanction
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// active returns the sanction of a kind on any of the targets that has not expired yet
+func (s *moderationStore) active(kind string, targets ...string) (Sanction, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, target := range targets {
+		if target == "" {
+			continue
+		}
+		sanction, exists := s.sanctions[sanctionKey(kind, target)]
+		if !exists {
+			continue
+		}
+		if time.Now().After(sanction.Until) {
+			delete(s.sanctions, sanctionKey(kind, target)) // Dropped from the file on the next save
+			continue
+		}
+		return *sanction, true
+	}
+	return Sanction{}, false
+}
+
+// save persists the store; the caller holds the lock
+func (s *moderationStore) save() error {
+	return saveJSONFile(s.path, s.sanctions)
+}
+
+// AuditEntry records one moderation action
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Actor    string    `json:"actor"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target"`
+	Reason   string    `json:"reason,omitempty"`
+	Duration string    `json:"duration,omitempty"`
+}
+
+var (
+	auditPath       = filepath.Join(dataDir, "audit.log") // One JSON entry per line, never rewritten
+	auditMu         sync.Mutex
+	maxAuditEntries = 200 // Entries returned by the audit endpoint
+)
+
+// writeAudit appends an entry to the audit trail
+func writeAudit(entry AuditEntry) {
+	entry.Time = time.Now().UTC()
+	log.Printf("Moderation: %s %s %s %s", entry.Actor, entry.Action, entry.Target, entry.Duration)
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding audit entry: %v", err)
+		return
+	}
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(auditPath), 0o700); err != nil {
+		log.Printf("Error writing audit trail: %v", err)
+		return
+	}
+	file, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		log.Printf("Error writing audit trail: %v", err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		log.Printf("Error writing audit trail: %v", err)
+	}
+}
+
+// readAudit returns the latest entries of the audit trail, oldest first
+func readAudit(limit int) ([]AuditEntry, error) {
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	entries := []AuditEntry{}
+	file, err := os.Open(auditPath)
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			continue // Skip a line cut short by a crash
+		}
+		entries = append(entries, entry)
+		if len(entries) > limit {
+			entries = entries[1:]
+		}
+	}
+	return entries, scanner.Err()
+}
+
+// handleAdminAudit lists the latest moderation actions
+func handleAdminAudit(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	entries, err := readAudit(maxAuditEntries)
+	if err != nil {
+		log.Printf("Error reading audit trail: %v", err)
+		writeJSONError(w, http.StatusInternalServerError, "could not read audit trail")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, entries)
+}
+
+var durationPattern = regexp.MustCompile(`^(\d+)([smhdw])$`)
+
+// parseSanctionDuration reads durations like 30s, 10m, 2h, 7d or 4w
+func parseSanctionDuration(value string) (time.Duration, error) {
+	match := durationPattern.FindStringSubmatch(strings.ToLower(value))
+	if match == nil {
+		return 0, fmt.Errorf("invalid duration %q. Use a number followed by s, m, h, d or w, e.g. 10m", value)
+	}
+	amount, err := strconv.Atoi(match[1])
+	if err != nil || amount == 0 {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	unit := map[string]time.Duration{"s": time.Second, "m": time.Minute, "h": time.Hour, "d": 24 * time.Hour, "w": 7 * 24 * time.Hour}[match[2]]
+	return time.Duration(amount) * unit, nil
+}
+
+// remaining describes how long a sanction still lasts
+func (s Sanction) remaining() string {
+	return time.Until(s.Until).Round(time.Second).String()
+}
+
+// banText is the explanation sent to a banned user
+func (s Sanction) banText() string {
+	text := "You are banned for " + s.remaining()
+	if s.Reason != "" {
+		text += ": " + s.Reason
+	}
+	return text
+}
+
+// activeBan returns the ban on a username or an IP address
+func activeBan(username, ip string) (Sanction, bool) {
+	return moderation.active(sanctionBan, username, ip)
+}
+
+// addMute mutes a user, and the addresses of its guest connections as well, so a muted guest
+// cannot carry on under another name. Accounts are only muted by name.
+func addMute(sanction Sanction) error {
+	if err := moderation.add(sanction); err != nil {
+		return err
+	}
+	for _, target := range onlineClients(sanction.Target) {
+		if target.account != "" {
+			continue
+		}
+		byAddress := sanction
+		byAddress.Target, byAddress.User = target.ip, strings.ToLower(sanction.Target)
+		if err := moderation.add(byAddress); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// activeMute returns the mute on the username of a client, or for guests on its address
+func activeMute(client *Client) (Sanction, bool) {
+	address := ""
+	if client.account == "" {
+		address = client.ip
+	}
+	return moderation.active(sanctionMute, client.username, address)
+}
+
+// disconnect tells the client why it is removed and closes its connection.
+// The read loop of the connection then ends and cleans up.
+func (c *Client) disconnect(code, text string) {
+	c.writeJSON(Message{Type: "error", Code: code, Username: "System", Message: text, Room: c.room})
+	text = truncateUTF8(text, 120) // Close reasons must fit in a control frame
+	c.writeMu.Lock()
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.ClosePolicyViolation, text), time.Now().Add(time.Second))
+	c.writeMu.Unlock()
+	c.conn.Close()
+}
+
+// truncateUTF8 shortens a text to at most limit bytes without splitting a character
+func truncateUTF8(text string, limit int) string {
+	if len(text) <= limit {
+		return text
+	}
+	for limit > 0 && !utf8.RuneStart(text[limit]) {
+		limit--
+	}
+	return text[:limit]
+}
+
+// onlineClients returns the connections of a user, or of an IP address
+func onlineClients(target string) []*Client {
+	isIP := net.ParseIP(target) != nil
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	var matches []*Client
+	for _, client := range clients {
+		if (isIP && client.ip == target) || (!isIP && client.username != "" && strings.EqualFold(client.username, target)) {
+			matches = append(matches, client)
+		}
+	}
+	return matches
+}
+
+// announceRemoval tells the rooms of the removed connections what happened, once per room
+func announceRemoval(targets []*Client, text string) {
+	announced := make(map[string]bool)
+	for _, target := range targets {
+		if room := roomName(target.room); !announced[room] {
+			announced[room] = true
+			broadcast <- Message{Username: "System", Message: text, Room: room}
+		}
+	}
+}
+
+// isModerator reports whether a user may moderate others, so moderators cannot sanction each other
+func isModerator(username string) bool {
+	for _, client := range onlineClients(username) {
+		if client.can(permKick) {
+			return true
+		}
+	}
+	if _, exists := accounts.get(username); exists {
+		return rolesAllow(rolesFor(&Session{Username: username}), permKick)
+	}
+	return false
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:       "kick",
+		Args:       []ArgSpec{{Name: "user", Required: true}, {Name: "reason", Rest: true}},
+		Help:       "Disconnect a user, who may come back",
+		Permission: permKick,
+		Run:        runKick,
+	})
+	registerCommand(&Command{
+		Name:       "mute",
+		Args:       []ArgSpec{{Name: "user", Required: true}, {Name: "duration", Required: true}, {Name: "reason", Rest: true}},
+		Help:       "Stop a user from sending messages for a while, e.g. /mute Bob 10m",
+		Permission: permMute,
+		Run:        runMute,
+	})
+	registerCommand(&Command{
+		Name:       "unmute",
+		Args:       []ArgSpec{{Name: "user", Required: true}},
+		Help:       "Lift the mute of a user",
+		Permission: permMute,
+		Run:        runUnmute,
+	})
+	registerCommand(&Command{
+		Name:       "ban",
+		Args:       []ArgSpec{{Name: "target", Required: true}, {Name: "duration", Required: true}, {Name: "reason", Rest: true}},
+		Help:       "Keep a user or an IP address out of the chat for a while, e.g. /ban Bob 7d",
+		Permission: permBan,
+		Run:        runBan,
+	})
+	registerCommand(&Command{
+		Name:       "unban",
+		Args:       []ArgSpec{{Name: "target", Required: true}},
+		Help:       "Lift the ban of a user or an IP address",
+		Permission: permBan,
+		Run:        runUnban,
+	})
+}
+
+func runKick(ctx *CommandContext) {
+	user, reason := ctx.Args["user"], ctx.Args["reason"]
+	targets := onlineClients(user)
+	if len(targets) == 0 || net.ParseIP(user) != nil {
+		ctx.reply("%s is not online", user)
+		return
+	}
+	if isModerator(user) {
+		ctx.reply("Moderators cannot be kicked")
+		return
+	}
+	user = targets[0].username
+
+	text := "You were kicked by " + ctx.Client.username
+	if reason != "" {
+		text += ": " + reason
+	}
+	writeAudit(AuditEntry{Actor: ctx.Client.username, Action: "kick", Target: user, Reason: reason})
+	for _, target := range targets {
+		target.disconnect("kicked", text)
+	}
+	announceRemoval(targets, user+" was kicked by "+ctx.Client.username)
+}
+
+func runMute(ctx *CommandContext) {
+	user := ctx.Args["user"]
+	duration, err := parseSanctionDuration(ctx.Args["duration"])
+	if err != nil {
+		ctx.reply("%s", capitalize(err.Error()))
+		return
+	}
+	if isModerator(user) {
+		ctx.reply("Moderators cannot be muted")
+		return
+	}
+	sanction := Sanction{Kind: sanctionMute, Target: user, Reason: ctx.Args["reason"], By: ctx.Client.username, Until: time.Now().Add(duration)}
+	if err := addMute(sanction); err != nil {
+		log.Printf("Error saving mute: %v", err)
+		ctx.reply("The mute could not be saved")
+		return
+	}
+	writeAudit(AuditEntry{Actor: ctx.Client.username, Action: "mute", Target: user, Reason: sanction.Reason, Duration: duration.String()})
+	for _, target := range onlineClients(user) {
+		target.writeJSON(Message{Type: "error", Code: "muted", Username: "System", Message: "You were muted for " + duration.String(), Room: target.room})
+	}
+	ctx.reply("%s is muted for %s", user, duration)
+}
+
+func runUnmute(ctx *CommandContext) {
+	user := ctx.Args["user"]
+	lifted, err := moderation.remove(sanctionMute, user)
+	if err != nil {
+		log.Printf("Error saving mute: %v", err)
+		ctx.reply("The mute could not be lifted")
+		return
+	}
+	if !lifted {
+		ctx.reply("%s is not muted", user)
+		return
+	}
+	writeAudit(AuditEntry{Actor: ctx.Client.username, Action: "unmute", Target: user})
+	for _, target := range onlineClients(user) {
+		target.notify("You can send messages again")
+	}
+	ctx.reply("%s is no longer muted", user)
+}
+
+func runBan(ctx *CommandContext) {
+	target := ctx.Args["target"]
+	duration, err := parseSanctionDuration(ctx.Args["duration"])
+	if err != nil {
+		ctx.reply("%s", capitalize(err.Error()))
+		return
+	}
+	isIP := net.ParseIP(target) != nil
+	if !isIP && isModerator(target) {
+		ctx.reply("Moderators cannot be banned")
+		return
+	}
+	if isIP && target == ctx.Client.ip {
+		ctx.reply("You cannot ban your own IP address")
+		return
+	}
+	sanction := Sanction{Kind: sanctionBan, Target: target, Reason: ctx.Args["reason"], By: ctx.Client.username, Until: time.Now().Add(duration)}
+	if err := moderation.add(sanction); err != nil {
+		log.Printf("Error saving ban: %v", err)
+		ctx.reply("The ban could not be saved")
+		return
+	}
+	writeAudit(AuditEntry{Actor: ctx.Client.username, Action: "ban", Target: target, Reason: sanction.Reason, Duration: duration.String()})
+	targets := onlineClients(target)
+	for _, client := range targets {
+		client.disconnect("banned", sanction.banText())
+	}
+	if !isIP && len(targets) > 0 {
+		announceRemoval(targets, targets[0].username+" was banned by "+ctx.Client.username)
+	}
+	ctx.reply("%s is banned for %s", target, duration)
+}
+
+func runUnban(ctx *CommandContext) {
+	target := ctx.Args["target"]
+	lifted, err := moderation.remove(sanctionBan, target)
+	if err != nil {
+		log.Printf("Error saving ban: %v", err)
+		ctx.reply("The ban could not be lifted")
+		return
+	}
+	if !lifted {
+		ctx.reply("%s is not banned", target)
+		return
+	}
+	writeAudit(AuditEntry{Actor: ctx.Client.username, Action: "unban", Target: target})
+	ctx.reply("%s is no longer banned", target)
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// useTempModeration swaps the sanctions and the audit trail for empty ones in a temporary directory
+func useTempModeration(t *testing.T) string {
+	dir := t.TempDir()
+	originalStore, originalAudit := moderation, auditPath
+	moderation = newModerationStore(filepath.Join(dir, "moderation.json"))
+	auditPath = filepath.Join(dir, "audit.log")
+	t.Cleanup(func() { moderation, auditPath = originalStore, originalAudit })
+	return dir
+}
+
+// expectClosed reads until the connection is closed and returns the close error
+func expectClosed(t *testing.T, ws *websocket.Conn) *websocket.CloseError {
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		var msg Message
+		err := ws.ReadJSON(&msg)
+		if closeErr, ok := err.(*websocket.CloseError); ok {
+			return closeErr
+		}
+		if err != nil {
+			t.Fatalf("Expected a close frame, got %v", err)
+		}
+	}
+}
+
+func TestParseSanctionDuration(t *testing.T) {
+	duration, err := parseSanctionDuration("10m")
+	assert.NoError(t, err)
+	assert.Equal(t, 10*time.Minute, duration)
+	duration, err = parseSanctionDuration("7D")
+	assert.NoError(t, err)
+	assert.Equal(t, 7*24*time.Hour, duration)
+
+	for _, invalid := range []string{"", "0m", "10", "1y", "-5m", "1h30m"} {
+		_, err := parseSanctionDuration(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestTruncateUTF8(t *testing.T) {
+	assert.Equal(t, "short", truncateUTF8("short", 120))
+	reason := strings.Repeat("é", 100) // Two bytes each
+	assert.Equal(t, strings.Repeat("é", 60), truncateUTF8(reason, 120))
+	assert.Equal(t, strings.Repeat("é", 60), truncateUTF8(reason, 121), "Expected a character not to be split")
+	assert.True(t, utf8.ValidString(truncateUTF8("ab"+strings.Repeat("😀", 40), 120)))
+}
+
+func TestKickCommand(t *testing.T) {
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	mod := joinTestAccount(t, wsURL, "Moe", roleModerator)
+	troll := joinTestClient(t, wsURL, "Troll")
+
+	sendTestMessage(t, troll, Message{Message: "/kick Moe"})
+	assert.Equal(t, "You are not allowed to use /kick", readTestMessage(t, troll).Message)
+
+	sendTestMessage(t, mod, Message{Message: "/kick troll stop spamming"})
+	msg := readTestMessage(t, troll)
+	assert.Equal(t, "kicked", msg.Code)
+	assert.Equal(t, "You were kicked by Moe: stop spamming", msg.Message)
+	assert.Equal(t, websocket.ClosePolicyViolation, expectClosed(t, troll).Code)
+	assert.Equal(t, "Troll was kicked by Moe", readTestMessage(t, mod).Message)
+
+	entries, err := readAudit(10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, AuditEntry{Time: entries[0].Time, Actor: "Moe", Action: "kick", Target: "Troll", Reason: "stop spamming"}, entries[0])
+	}
+
+	// Kicked guests may come back under their name
+	joinTestClient(t, wsURL, "Troll")
+}
+
+func TestMuteCommand(t *testing.T) {
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	mod := joinTestAccount(t, wsURL, "Mona", roleModerator)
+	loud := joinTestClient(t, wsURL, "Loud")
+
+	sendTestMessage(t, mod, Message{Message: "/mute Mona 5m"})
+	assert.Equal(t, "Moderators cannot be muted", readTestMessage(t, mod).Message)
+	sendTestMessage(t, mod, Message{Message: "/mute Loud forever"})
+	assert.Contains(t, readTestMessage(t, mod).Message, "Invalid duration")
+
+	sendTestMessage(t, mod, Message{Message: "/mute Loud 5m"})
+	assert.Equal(t, "You were muted for 5m0s", readTestMessage(t, loud).Message)
+	assert.Equal(t, "Loud is muted for 5m0s", readTestMessage(t, mod).Message)
+
+	sendTestMessage(t, loud, Message{Message: "HELLO EVERYONE"})
+	msg := readTestMessage(t, loud)
+	assert.Equal(t, "muted", msg.Code)
+	assert.Contains(t, msg.Message, "You are muted for another")
+
+	// The mute outlives the connection
+	persisted := newModerationStore(moderation.path)
+	assert.NoError(t, persisted.load())
+	_, muted := persisted.active(sanctionMute, "loud")
+	assert.True(t, muted, "Expected the mute to be persisted")
+
+	sendTestMessage(t, mod, Message{Message: "/unmute loud"})
+	assert.Equal(t, "You can send messages again", readTestMessage(t, loud).Message)
+	assert.Equal(t, "loud is no longer muted", readTestMessage(t, mod).Message)
+	sendTestMessage(t, loud, Message{Message: "sorry"})
+	assert.Equal(t, "sorry", readTestMessage(t, loud).Message)
+}
+
+func TestMutedGuestsCannotTakeAnotherName(t *testing.T) {
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	mod := joinTestAccount(t, wsURL, "Mona", roleModerator)
+	loud := joinTestClient(t, wsURL, "Loud")
+
+	sendTestMessage(t, mod, Message{Message: "/mute Loud 5m"})
+	assert.Equal(t, "You were muted for 5m0s", readTestMessage(t, loud).Message)
+	assert.Equal(t, "Loud is muted for 5m0s", readTestMessage(t, mod).Message)
+
+	// A new tab under another name comes from the same address
+	again := joinTestClient(t, wsURL, "Quiet")
+	sendTestMessage(t, again, Message{Message: "still here"})
+	assert.Equal(t, "muted", readTestMessage(t, again).Code, "Expected the mute to follow the guest's address")
+
+	// Logged-in users behind the same address are muted by name only
+	sendTestMessage(t, mod, Message{Message: "carry on"})
+	assert.Equal(t, "carry on", readTestMessage(t, mod).Message)
+	assert.Equal(t, "carry on", readTestMessage(t, again).Message)
+
+	sendTestMessage(t, mod, Message{Message: "/unmute loud"})
+	assert.Equal(t, "loud is no longer muted", readTestMessage(t, mod).Message)
+	sendTestMessage(t, again, Message{Message: "sorry"})
+	assert.Equal(t, "sorry", readTestMessage(t, again).Message, "Expected /unmute to lift the mute of the address too")
+}
+
+func TestBanCommand(t *testing.T) {
+	useTempModeration(t)
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	mod := joinTestAccount(t, wsURL, "Max", roleModerator)
+	spammer := joinTestAccount(t, wsURL, "Spammer")
+
+	sendTestMessage(t, mod, Message{Message: "/ban spammer 1h links"})
+	msg := readTestMessage(t, spammer)
+	assert.Equal(t, "banned", msg.Code)
+	assert.Contains(t, msg.Message, ": links")
+	assert.Equal(t, websocket.ClosePolicyViolation, expectClosed(t, spammer).Code)
+	notices := []string{readTestMessage(t, mod).Message, readTestMessage(t, mod).Message}
+	assert.ElementsMatch(t, []string{"Spammer was banned by Max", "spammer is banned for 1h0m0s"}, notices)
+
+	// The account is refused at the upgrade
+	value, err := encodeSession(Session{Username: "Spammer", Expires: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	_, resp, err := websocket.DefaultDialer.Dial(withCSRF(wsURL, value), http.Header{"Cookie": {sessionCookieName + "=" + value}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	// A guest picking the banned name is disconnected once the name is bound
+	guest := dialTestClient(t, wsURL)
+	sendTestMessage(t, guest, Message{Type: "join", Username: "spammer"})
+	assert.Equal(t, "joined", readTestMessage(t, guest).Type)
+	assert.Equal(t, "banned", readTestMessage(t, guest).Code)
+	expectClosed(t, guest)
+
+	sendTestMessage(t, mod, Message{Message: "/unban Spammer"})
+	assert.Equal(t, "Spammer is no longer banned", readTestMessage(t, mod).Message)
+	joinTestAccount(t, wsURL, "Spammer")
+}
+
+func TestIPBanIsEnforcedAtUpgrade(t *testing.T) {
+	useTempModeration(t)
+	assert.NoError(t, moderation.add(Sanction{Kind: sanctionBan, Target: "127.0.0.1", By: "Max", Until: time.Now().Add(time.Hour)}))
+
+	req := httptest.NewRequest(http.MethodGet, "/ws", nil)
+	req.RemoteAddr = "127.0.0.1:4321"
+	w := httptest.NewRecorder()
+	handleConnections(w, req)
+	assert.Equal(t, http.StatusForbidden, w.Code)
+	assert.Contains(t, w.Body.String(), "You are banned for")
+
+	// Expired bans are ignored
+	assert.NoError(t, moderation.add(Sanction{Kind: sanctionBan, Target: "127.0.0.1", By: "Max", Until: time.Now().Add(-time.Second)}))
+	_, banned := activeBan("", "127.0.0.1")
+	assert.False(t, banned)
+}
+
+func TestAdminAuditAPI(t *testing.T) {
+	useTempModeration(t)
+	writeAudit(AuditEntry{Actor: "Max", Action: "ban", Target: "10.0.0.1", Duration: "1h0m0s"})
+
+	req := httptest.NewRequest(http.MethodGet, "/api/admin/audit", nil)
+	w := httptest.NewRecorder()
+	handleAdminAudit(w, req)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Contains(t, w.Body.String(), `"target":"10.0.0.1"`)
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	oidcProviderName = "oidc"
+	oidcCookieName   = "gochat_oidc"
+)
+
+// Single sign-on settings; SSO is enabled when OIDC_ISSUER is set
+var (
+	oidcIssuer       = envString("OIDC_ISSUER", "")
+	oidcClientID     = envString("OIDC_CLIENT_ID", "")
+	oidcClientSecret = envString("OIDC_CLIENT_SECRET", "")
+	oidcRedirectURL  = envString("OIDC_REDIRECT_URL", "")
+	oidcScopes       = envString("OIDC_SCOPES", "openid profile email")
+	oidcNameClaim    = envString("OIDC_NAME_CLAIM", "preferred_username") // Claim used as the display name
+	oidcRolesClaim   = envString("OIDC_ROLES_CLAIM", "roles")             // Claim listing the user's roles
+	ssoRequired      = envBool("SSO_REQUIRED", false)                     // Only single sign-on users may chat
+	oidcHTTPClient   = &http.Client{Timeout: 10 * time.Second}
+	oidcLoginTimeout = 10 * time.Minute // How long a user has to complete the login at the provider
+)
+
+func oidcEnabled() bool {
+	return oidcIssuer != ""
+}
+
+// oidcProvider is the discovered configuration of the identity provider
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+
+	mu   sync.Mutex
+	keys map[string]*rsa.PublicKey // Signing keys by key ID
+}
+
+var (
+	oidcDiscovered *oidcProvider
+	oidcMu         sync.Mutex
+)
+
+// getOIDCProvider fetches the discovery document once and caches it
+func getOIDCProvider() (*oidcProvider, error) {
+	oidcMu.Lock()
+	defer oidcMu.Unlock()
+	if oidcDiscovered != nil {
+		return oidcDiscovered, nil
+	}
+
+	discoveryURL := strings.TrimSuffix(oidcIssuer, "/") + "/.well-known/openid-configuration"
+	var provider oidcProvider
+	if err := fetchJSON(discoveryURL, &provider); err != nil {
+		return nil, fmt.Errorf("failed to discover OIDC provider: %v", err)
+	}
+	if provider.Issuer != oidcIssuer {
+		return nil, fmt.Errorf("discovery document issuer %q does not match %q", provider.Issuer, oidcIssuer)
+	}
+	if provider.AuthorizationEndpoint == "" || provider.TokenEndpoint == "" || provider.JWKSURI == "" {
+		return nil, errors.New("discovery document is missing endpoints")
+	}
+	oidcDiscovered = &provider
+	return oidcDiscovered, nil
+}
+
+func fetchJSON(url string, v interface{}) error {
+	resp, err := oidcHTTPClient.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// signingKey returns the RSA key with the given ID, refreshing the JWKS when the key is unknown
+func (p *oidcProvider) signingKey(kid string) (*rsa.PublicKey, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if key, exists := p.keys[kid]; exists {
+		return key, nil
+	}
+
+	var jwks struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+		} `json:"keys"`
+	}
+	if err := fetchJSON(p.JWKSURI, &jwks); err != nil {
+		return nil, fmt.Errorf("failed to fetch JWKS: %v", err)
+	}
+	p.keys = make(map[string]*rsa.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Kty != "RSA" || (jwk.Use != "" && jwk.Use != "sig") {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(jwk.N)
+		e, errE := base64.RawURLEncoding.DecodeString(jwk.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		p.keys[jwk.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if key, exists := p.keys[kid]; exists {
+		return key, nil
+	}
+	return nil, fmt.Errorf("unknown signing key %q", kid)
+}
+
+// verifyIDToken checks the RS256 signature and standard claims of an ID token and returns its claims
+func (p *oidcProvider) verifyIDToken(rawToken, nonce string) (map[string]interface{}, error) {
+	parts := strings.Split(rawToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("malformed ID token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, fmt.Errorf("invalid ID token header: %v", err)
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported ID token algorithm %q", header.Alg)
+	}
+	key, err := p.signingKey(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid ID token signature encoding")
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("invalid ID token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, fmt.Errorf("invalid ID token claims: %v", err)
+	}
+	if claims["iss"] != p.Issuer {
+		return nil, fmt.Errorf("unexpected issuer %v", claims["iss"])
+	}
+	if !audienceContains(claims["aud"], oidcClientID) {
+		return nil, errors.New("ID token was issued for another client")
+	}
+	if exp, ok := claims["exp"].(float64); !ok || time.Now().Unix() > int64(exp) {
+		return nil, errors.New("ID token expired")
+	}
+	if claims["nonce"] != nonce {
+		return nil, errors.New("ID token nonce mismatch")
+	}
+	if sub, _ := claims["sub"].(string); sub == "" {
+		return nil, errors.New("ID token has no subject")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// audienceContains handles both forms of the aud claim: a string or a list of strings
+func audienceContains(aud interface{}, clientID string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientID
+	case []interface{}:
+		for _, item := range aud {
+			if item == clientID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// displayNameFromClaims maps the configured claim to a chat username, falling back to the
+// name and email claims. The local part of an email address is used as the name.
+func displayNameFromClaims(claims map[string]interface{}) (string, error) {
+	for _, claim := range []string{oidcNameClaim, "name", "email"} {
+		value, _ := claims[claim].(string)
+		if at := strings.Index(value, "@"); at > 0 {
+			value = value[:at]
+		}
+		if name, err := validateUsername(value); err == nil {
+			return name, nil
+		}
+	}
+	return "", errors.New("no usable display name in the ID token")
+}
+
+// rolesFromClaims reads the roles claim, accepting a list or a space-separated string
+func rolesFromClaims(claims map[string]interface{}) []string {
+	var roles []string
+	switch value := claims[oidcRolesClaim].(type) {
+	case []interface{}:
+		for _, item := range value {
+			if role, ok := item.(string); ok {
+				roles = append(roles, role)
+			}
+		}
+	case string:
+		roles = strings.Fields(value)
+	}
+	return roles
+}
+
+// oidcLoginState is kept in a signed cookie between the redirect to the provider and the callback
+type oidcLoginState struct {
+	State    string `json:"s"`
+	Nonce    string `json:"n"`
+	Verifier string `json:"v"` // PKCE code verifier
+	Expires  int64  `json:"exp"`
+}
+
+func randomToken() string {
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Fatalf("Error generating random token: %v", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// handleOIDCLogin redirects the browser to the identity provider
+func handleOIDCLogin(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	provider, err := getOIDCProvider()
+	if err != nil {
+		log.Printf("OIDC error: %v", err)
+		http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+		return
+	}
+
+	login := oidcLoginState{State: randomToken(), Nonce: randomToken(), Verifier: randomToken(), Expires: time.Now().Add(oidcLoginTimeout).Unix()}
+	value, err := signJSON(login)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     oidcCookieName,
+		Value:    value,
+		Path:     "/auth/",
+		MaxAge:   int(oidcLoginTimeout.Seconds()),
+		HttpOnly: true,
+		Secure:   r.TLS != nil,
+		SameSite: http.SameSiteLaxMode, // Sent on the top-level redirect back from the provider
+	})
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidcClientID},
+		"redirect_uri":          {oidcRedirectURL},
+		"scope":                 {oidcScopes},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(provider.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, provider.AuthorizationEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// handleOIDCCallback completes the login: it exchanges the code, verifies the ID token and starts a session
+func handleOIDCCallback(w http.ResponseWriter, r *http.Request) {
+	if !oidcEnabled() {
+		http.NotFound(w, r)
+		return
+	}
+	cookie, err := r.Cookie(oidcCookieName)
+	var login oidcLoginState
+	if err != nil || verifyJSON(cookie.Value, &login) != nil || time.Now().Unix() > login.Expires {
+		http.Error(w, "Login expired, please try again", http.StatusBadRequest)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: oidcCookieName, Value: "", Path: "/auth/", MaxAge: -1, HttpOnly: true})
+
+	if r.URL.Query().Get("state") != login.State {
+		http.Error(w, "Invalid login state", http.StatusBadRequest)
+		return
+	}
+	if providerErr := r.URL.Query().Get("error"); providerErr != "" {
+		http.Error(w, "Login failed: "+providerErr, http.StatusUnauthorized)
+		return
+	}
+
+	provider, err := getOIDCProvider()
+	if err != nil {
+		log.Printf("OIDC error: %v", err)
+		http.Error(w, "Single sign-on is unavailable", http.StatusBadGateway)
+		return
+	}
+	rawIDToken, err := exchangeOIDCCode(provider, r.URL.Query().Get("code"), login.Verifier)
+	if err != nil {
+		log.Printf("OIDC code exchange failed: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+	claims, err := provider.verifyIDToken(rawIDToken, login.Nonce)
+	if err != nil {
+		log.Printf("OIDC ID token rejected: %v", err)
+		http.Error(w, "Login failed", http.StatusUnauthorized)
+		return
+	}
+
+	username, err := displayNameFromClaims(claims)
+	if err != nil {
+		http.Error(w, "Login failed: "+err.Error(), http.StatusForbidden)
+		return
+	}
+	if err := accounts.linkExternal(username, oidcProviderName, claims["sub"].(string)); err != nil {
+		log.Printf("OIDC login of %s refused: %v", username, err)
+		http.Error(w, "The name "+username+" is already used by another account", http.StatusConflict)
+		return
+	}
+
+	session := Session{Username: username, Provider: oidcProviderName, Roles: rolesFromClaims(claims)}
+	if err := startSession(w, r, session); err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// exchangeOIDCCode redeems an authorization code at the token endpoint and returns the ID token
+func exchangeOIDCCode(provider *oidcProvider, code, verifier string) (string, error) {
+	if code == "" {
+		return "", errors.New("missing authorization code")
+	}
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {oidcRedirectURL},
+		"client_id":     {oidcClientID},
+		"code_verifier": {verifier},
+	}
+	if oidcClientSecret != "" {
+		form.Set("client_secret", oidcClientSecret)
+	}
+	resp, err := oidcHTTPClient.PostForm(provider.TokenEndpoint, form)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token endpoint returned %s", resp.Status)
+	}
+
+	var token struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", err
+	}
+	if token.IDToken == "" {
+		return "", errors.New("token response has no id_token")
+	}
+	return token.IDToken, nil
+}
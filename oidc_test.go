@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeIdP is a minimal OpenID Connect provider for tests
+type fakeIdP struct {
+	server    *httptest.Server
+	key       *rsa.PrivateKey
+	challenge string                 // PKCE challenge of the pending login
+	claims    map[string]interface{} // Claims of the next ID token
+}
+
+func newFakeIdP(t *testing.T) *fakeIdP {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	idp := &fakeIdP{key: key}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 idp.server.URL,
+			"authorization_endpoint": idp.server.URL + "/authorize",
+			"token_endpoint":         idp.server.URL + "/token",
+			"jwks_uri":               idp.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"kid": "test-key",
+			"use": "sig",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if r.FormValue("code") != "test-code" || base64.RawURLEncoding.EncodeToString(verifier[:]) != idp.challenge {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": idp.sign(t, idp.key, idp.claims)})
+	})
+	idp.server = httptest.NewServer(mux)
+	t.Cleanup(idp.server.Close)
+
+	originalIssuer, originalClient, originalRedirect := oidcIssuer, oidcClientID, oidcRedirectURL
+	oidcIssuer, oidcClientID, oidcRedirectURL = idp.server.URL, "go-chat", "http://chat.test/auth/callback"
+	oidcDiscovered = nil
+	t.Cleanup(func() {
+		oidcIssuer, oidcClientID, oidcRedirectURL = originalIssuer, originalClient, originalRedirect
+		oidcDiscovered = nil
+	})
+	return idp
+}
+
+// sign creates an RS256 JWT
+func (idp *fakeIdP) sign(t *testing.T, key *rsa.PrivateKey, claims map[string]interface{}) string {
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "kid": "test-key", "typ": "JWT"})
+	payload, _ := json.Marshal(claims)
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// startLogin runs /auth/login and records the PKCE challenge at the fake provider
+func (idp *fakeIdP) startLogin(t *testing.T) (url.Values, *http.Cookie) {
+	w := httptest.NewRecorder()
+	handleOIDCLogin(w, httptest.NewRequest(http.MethodGet, "/auth/login", nil))
+	if w.Code != http.StatusFound {
+		t.Fatalf("Expected a redirect to the provider, got %d: %s", w.Code, w.Body.String())
+	}
+	location, err := url.Parse(w.Header().Get("Location"))
+	if err != nil {
+		t.Fatalf("Invalid redirect: %v", err)
+	}
+	query := location.Query()
+	idp.challenge = query.Get("code_challenge")
+	return query, w.Result().Cookies()[0]
+}
+
+// callback simulates the browser coming back from the provider
+func callback(state string, cookie *http.Cookie) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?code=test-code&state="+url.QueryEscape(state), nil)
+	req.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handleOIDCCallback(w, req)
+	return w
+}
+
+func (idp *fakeIdP) standardClaims(nonce string) map[string]interface{} {
+	return map[string]interface{}{
+		"iss":                idp.server.URL,
+		"aud":                "go-chat",
+		"sub":                "user-42",
+		"exp":                time.Now().Add(time.Hour).Unix(),
+		"nonce":              nonce,
+		"preferred_username": "ivan@example.com",
+		"roles":              []string{"moderator"},
+	}
+}
+
+func TestOIDCLoginFlow(t *testing.T) {
+	useTempAccounts(t)
+	idp := newFakeIdP(t)
+
+	query, cookie := idp.startLogin(t)
+	assert.Equal(t, "S256", query.Get("code_challenge_method"))
+	assert.Equal(t, "go-chat", query.Get("client_id"))
+	assert.NotEmpty(t, query.Get("nonce"))
+
+	idp.claims = idp.standardClaims(query.Get("nonce"))
+	w := callback(query.Get("state"), cookie)
+	assert.Equal(t, http.StatusFound, w.Code, w.Body.String())
+	assert.Equal(t, "/", w.Header().Get("Location"))
+
+	session, err := decodeSession(sessionCookie(t, w).Value)
+	assert.NoError(t, err)
+	assert.Equal(t, "ivan", session.Username, "Expected the email local part as display name")
+	assert.Equal(t, oidcProviderName, session.Provider)
+	assert.Equal(t, []string{"moderator"}, session.Roles)
+
+	account, exists := accounts.get("ivan")
+	assert.True(t, exists)
+	assert.Equal(t, "user-42", account.Subject)
+}
+
+func TestOIDCCallbackRejectsBadLogins(t *testing.T) {
+	useTempAccounts(t)
+	idp := newFakeIdP(t)
+
+	query, cookie := idp.startLogin(t)
+	idp.claims = idp.standardClaims(query.Get("nonce"))
+	assert.Equal(t, http.StatusBadRequest, callback("forged-state", cookie).Code, "Expected the state to be checked")
+
+	query, cookie = idp.startLogin(t)
+	idp.claims = idp.standardClaims("another-nonce")
+	assert.Equal(t, http.StatusUnauthorized, callback(query.Get("state"), cookie).Code, "Expected the nonce to be checked")
+
+	query, cookie = idp.startLogin(t)
+	idp.claims = idp.standardClaims(query.Get("nonce"))
+	idp.claims["aud"] = []string{"another-client"}
+	assert.Equal(t, http.StatusUnauthorized, callback(query.Get("state"), cookie).Code, "Expected the audience to be checked")
+
+	query, cookie = idp.startLogin(t)
+	idp.claims = idp.standardClaims(query.Get("nonce"))
+	idp.claims["exp"] = time.Now().Add(-time.Minute).Unix()
+	assert.Equal(t, http.StatusUnauthorized, callback(query.Get("state"), cookie).Code, "Expected expired tokens to be rejected")
+}
+
+func TestOIDCRejectsTokensSignedByAnotherKey(t *testing.T) {
+	idp := newFakeIdP(t)
+	provider, err := getOIDCProvider()
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	assert.NoError(t, err)
+	token := idp.sign(t, otherKey, idp.standardClaims("nonce"))
+	_, err = provider.verifyIDToken(token, "nonce")
+	assert.EqualError(t, err, "invalid ID token signature")
+
+	claims, err := provider.verifyIDToken(idp.sign(t, idp.key, idp.standardClaims("nonce")), "nonce")
+	assert.NoError(t, err)
+	assert.Equal(t, "user-42", claims["sub"])
+}
+
+func TestSSORequiredRefusesOtherUsers(t *testing.T) {
+	useTempAccounts(t)
+	ssoRequired = true
+	defer func() { ssoRequired = false }()
+	wsURL := startTestServer(t)
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, nil)
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	password, err := encodeSession(Session{Username: "Judy", Expires: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	_, resp, err = websocket.DefaultDialer.Dial(wsURL, http.Header{"Cookie": {sessionCookieName + "=" + password}})
+	assert.Error(t, err, "Expected password sessions to be refused when SSO is required")
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	sso, err := encodeSession(Session{Username: "Judy", Provider: oidcProviderName, Expires: time.Now().Add(time.Hour).Unix()})
+	assert.NoError(t, err)
+	ws, _, err := websocket.DefaultDialer.Dial(withCSRF(wsURL, sso), http.Header{"Cookie": {sessionCookieName + "=" + sso}})
+	if assert.NoError(t, err) {
+		ws.Close()
+	}
+}
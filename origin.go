@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/hmac"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// originPattern is an allowed origin such as "https://chat.example.com", "https://*.example.com"
+// or "example.com:8443". Without a scheme both http and https are allowed; a host starting with
+// "*." matches every subdomain, but not the domain itself.
+type originPattern struct {
+	scheme string
+	host   string
+	port   string
+}
+
+var (
+	allowedOrigins = parseOriginPatterns(envList("ALLOWED_ORIGINS"))
+	originDevMode  = envBool("ORIGIN_DEV_MODE", false) // Also allow pages served from localhost, on any port
+)
+
+// parseOriginPatterns reads the allowlist, skipping invalid entries
+func parseOriginPatterns(entries []string) []originPattern {
+	var patterns []originPattern
+	for _, entry := range entries {
+		pattern := originPattern{}
+		rest := strings.ToLower(strings.TrimSuffix(entry, "/"))
+		if scheme, host, found := strings.Cut(rest, "://"); found {
+			pattern.scheme, rest = scheme, host
+		}
+		if host, port, err := net.SplitHostPort(rest); err == nil {
+			pattern.host, pattern.port = host, port
+		} else {
+			pattern.host = rest
+		}
+		if pattern.host == "" || strings.ContainsAny(pattern.host, "/?#@") || strings.Contains(strings.TrimPrefix(pattern.host, "*."), "*") ||
+			(pattern.scheme != "" && pattern.scheme != "http" && pattern.scheme != "https") {
+			log.Printf("Ignoring invalid allowed origin %q", entry)
+			continue
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns
+}
+
+// matches reports whether an origin, already split into its parts, is allowed by the pattern
+func (p originPattern) matches(scheme, host, port string) bool {
+	if p.scheme != "" && p.scheme != scheme {
+		return false
+	}
+	if p.port != port {
+		return false
+	}
+	if domain, wildcard := strings.CutPrefix(p.host, "*."); wildcard {
+		return strings.HasSuffix(host, "."+domain)
+	}
+	return p.host == host
+}
+
+// splitOrigin returns the scheme, host and port of an Origin header; the port is empty when it is the default one
+func splitOrigin(origin string) (string, string, string, bool) {
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", "", "", false
+	}
+	port := u.Port()
+	if (u.Scheme == "http" && port == "80") || (u.Scheme == "https" && port == "443") {
+		port = ""
+	}
+	return u.Scheme, strings.ToLower(u.Hostname()), port, true
+}
+
+func isLocalhost(host string) bool {
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// originAllowed decides whether the page that opens a WebSocket may talk to us. Requests
+// without an Origin header do not come from a browser and are allowed. Without an allowlist
+// only pages served by this host may connect, like the default of gorilla/websocket.
+func originAllowed(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	scheme, host, port, ok := splitOrigin(origin)
+	if !ok {
+		return false
+	}
+	if originDevMode && isLocalhost(host) {
+		return true
+	}
+	if len(allowedOrigins) == 0 {
+		u, _ := url.Parse(origin)
+		return strings.EqualFold(u.Host, r.Host)
+	}
+	for _, pattern := range allowedOrigins {
+		if pattern.matches(scheme, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// csrfToken is the token a page must present to open a WebSocket with a session. It is derived
+// from the session cookie, so it changes with every login and cannot be guessed by other sites.
+func csrfToken(sessionCookie string) string {
+	return signPayload("csrf:" + sessionCookie)
+}
+
+// csrfTokenFor returns the token of the session of a request, or "" for anonymous requests
+func csrfTokenFor(r *http.Request) string {
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil || sessionFromRequest(r) == nil {
+		return ""
+	}
+	return csrfToken(cookie.Value)
+}
+
+// csrfValid checks the token passed in the csrf query parameter of an upgrade with a session
+func csrfValid(r *http.Request) bool {
+	expected := csrfTokenFor(r)
+	if expected == "" {
+		return true // Guests have no session to steal
+	}
+	return hmac.Equal([]byte(r.URL.Query().Get("csrf")), []byte(expected))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// useAllowedOrigins sets the origin allowlist and dev mode for the duration of a test
+func useAllowedOrigins(t *testing.T, devMode bool, entries ...string) {
+	originalOrigins, originalDevMode := allowedOrigins, originDevMode
+	allowedOrigins, originDevMode = parseOriginPatterns(entries), devMode
+	t.Cleanup(func() { allowedOrigins, originDevMode = originalOrigins, originalDevMode })
+}
+
+func originRequest(host, origin string) *http.Request {
+	req := httptest.NewRequest(http.MethodGet, "http://"+host+"/ws", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	return req
+}
+
+func TestOriginAllowlist(t *testing.T) {
+	useAllowedOrigins(t, false, "https://chat.example.com", "https://*.example.org", "partner.test:8443", "ftp://bad.test", "https://*.*.test")
+	assert.Len(t, allowedOrigins, 3, "Expected invalid entries to be skipped")
+
+	cases := []struct {
+		origin  string
+		allowed bool
+	}{
+		{"", true}, // Not a browser
+		{"https://chat.example.com", true},
+		{"https://CHAT.example.com:443", true},
+		{"http://chat.example.com", false},
+		{"https://chat.example.com:8443", false},
+		{"https://chat.example.com.evil.test", false},
+		{"https://eu.example.org", true},
+		{"https://a.b.example.org", true},
+		{"https://example.org", false},
+		{"https://evilexample.org", false},
+		{"http://partner.test:8443", true},
+		{"https://partner.test:8443", true},
+		{"https://partner.test", false},
+		{"null", false},
+		{"http://localhost:3000", false},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.allowed, originAllowed(originRequest("chat.example.com", c.origin)), c.origin)
+	}
+}
+
+func TestOriginDefaultsToSameHost(t *testing.T) {
+	useAllowedOrigins(t, false)
+	assert.True(t, originAllowed(originRequest("chat.example.com", "https://chat.example.com")))
+	assert.False(t, originAllowed(originRequest("chat.example.com", "https://evil.test")))
+	assert.False(t, originAllowed(originRequest("chat.example.com", "http://localhost:8080")))
+
+	useAllowedOrigins(t, true)
+	assert.True(t, originAllowed(originRequest("chat.example.com", "http://localhost:8080")), "Expected dev mode to allow localhost")
+	assert.True(t, originAllowed(originRequest("chat.example.com", "http://127.0.0.1:5500")))
+	assert.True(t, originAllowed(originRequest("chat.example.com", "http://[::1]:3000")))
+	assert.False(t, originAllowed(originRequest("chat.example.com", "http://localhost.evil.test")))
+}
+
+func TestUpgradeRejectsForeignOrigins(t *testing.T) {
+	startTestHub(t)
+	useAllowedOrigins(t, false, "https://chat.example.com")
+	wsURL := startTestServer(t)
+	before := metrics.get("upgrade_rejected_origin")
+
+	_, resp, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://evil.test"}})
+	assert.Error(t, err)
+	if assert.NotNil(t, resp) {
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	assert.Equal(t, before+1, metrics.get("upgrade_rejected_origin"))
+
+	ws, _, err := websocket.DefaultDialer.Dial(wsURL, http.Header{"Origin": {"https://chat.example.com"}})
+	if assert.NoError(t, err) {
+		ws.Close()
+	}
+}
+
+func TestUpgradeRequiresCSRFToken(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	value, err := encodeSession(Session{Username: "Grace", Expires: 4102444800})
+	assert.NoError(t, err)
+	other, err := encodeSession(Session{Username: "Grace", Expires: 4102444801})
+	assert.NoError(t, err)
+	cookie := http.Header{"Cookie": {sessionCookieName + "=" + value}}
+	before := metrics.get("upgrade_rejected_csrf")
+
+	for _, url := range []string{wsURL, wsURL + "?csrf=forged", withCSRF(wsURL, other)} {
+		_, resp, err := websocket.DefaultDialer.Dial(url, cookie)
+		assert.Error(t, err, url)
+		if assert.NotNil(t, resp) {
+			assert.Equal(t, http.StatusForbidden, resp.StatusCode, url)
+		}
+	}
+	assert.Equal(t, before+3, metrics.get("upgrade_rejected_csrf"))
+
+	ws, _, err := websocket.DefaultDialer.Dial(withCSRF(wsURL, value), cookie)
+	if assert.NoError(t, err) {
+		defer ws.Close()
+		assert.Equal(t, "joined", readTestMessage(t, ws).Type)
+	}
+}
+
+func TestSessionReportsCSRFToken(t *testing.T) {
+	w := httptest.NewRecorder()
+	handleSession(w, httptest.NewRequest(http.MethodGet, "/api/session", nil))
+	assert.NotContains(t, w.Body.String(), "csrf_token", "Expected no token without a session")
+
+	value, err := encodeSession(Session{Username: "Grace", Expires: 4102444800})
+	assert.NoError(t, err)
+	req := httptest.NewRequest(http.MethodGet, "/api/session", nil)
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+	w = httptest.NewRecorder()
+	handleSession(w, req)
+	assert.Contains(t, w.Body.String(), `"csrf_token":"`+csrfToken(value)+`"`)
+}
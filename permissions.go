@@ -0,0 +1,227 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Role is a set of permissions granted to an identity
+type Role string
+
+const (
+	roleAdmin     Role = "admin"
+	roleModerator Role = "moderator"
+	roleAgent     Role = "agent" // Support agents answering customers
+	roleMember    Role = "member"
+	roleGuest     Role = "guest"
+)
+
+// Permission names an action. A trailing ".*" in a grant covers every action below it.
+type Permission string
+
+const (
+	permSend         Permission = "messages.send"
+	permCreateRooms  Permission = "rooms.create"
+	permManageRooms  Permission = "rooms.manage" // Attach bots to rooms
+	permKick         Permission = "moderation.kick"
+	permMute         Permission = "moderation.mute"
+	permBan          Permission = "moderation.ban"
+	permReview       Permission = "moderation.review"   // Approve or reject messages held by the content filters
+	permFilters      Permission = "moderation.filters"  // Configure the content filters
+	permMessages     Permission = "moderation.messages" // Edit or delete any message, at any time
+	permHandoffQueue Permission = "handoff.view"
+	permAdminRead    Permission = "admin.read"
+	permManageRoles  Permission = "admin.roles"
+)
+
+// botPermission is the permission to query one bot, e.g. "bots.bot7"
+func botPermission(botCommand string) Permission {
+	return Permission("bots." + strings.TrimPrefix(botCommand, "/"))
+}
+
+var rolePermissions = map[Role][]Permission{
+	roleAdmin:     {"*"},
+	roleModerator: {permSend, "bots.*", permCreateRooms, permManageRooms, "moderation.*", permHandoffQueue, permAdminRead},
+	roleAgent:     {permSend, "bots.*", permCreateRooms, permManageRooms, permHandoffQueue},
+	roleMember:    {permSend, "bots.*", permCreateRooms},
+	roleGuest:     guestPermissions(),
+}
+
+// adminUsers are granted the admin role at login, so a fresh install can hand out roles
+var adminUsers = envList("ADMIN_USERS")
+
+// adminAccounts are the accounts of adminUsers that existed at startup. A listed name
+// that nobody had registered yet grants nothing, or anyone could register it to become admin.
+var adminAccounts = make(map[string]Account)
+
+// loadAdminUsers pins ADMIN_USERS to the accounts loaded at startup
+func loadAdminUsers() {
+	adminAccounts = make(map[string]Account)
+	for _, admin := range adminUsers {
+		account, exists := accounts.get(admin)
+		if !exists {
+			log.Printf("ADMIN_USERS lists %s, who has no account; register it and restart to grant the admin role", admin)
+			continue
+		}
+		adminAccounts[strings.ToLower(admin)] = account
+	}
+}
+
+// isAdminAccount reports whether an account is one of the pinned adminAccounts
+func isAdminAccount(account Account) bool {
+	admin, listed := adminAccounts[strings.ToLower(account.Username)]
+	return listed && admin.Created.Equal(account.Created) && admin.Provider == account.Provider && admin.Subject == account.Subject
+}
+
+// guestPermissions lets guests chat and use the public bots only
+func guestPermissions() []Permission {
+	permissions := []Permission{permSend}
+	for botCommand := range botAgentMap {
+		if botVisibility[botCommand] != botPrivate {
+			permissions = append(permissions, botPermission(botCommand))
+		}
+	}
+	return permissions
+}
+
+func isKnownRole(role Role) bool {
+	_, exists := rolePermissions[role]
+	return exists
+}
+
+// grants reports whether a granted permission covers the requested one
+func grants(granted, requested Permission) bool {
+	if granted == "*" || granted == requested {
+		return true
+	}
+	prefix, wildcard := strings.CutSuffix(string(granted), ".*")
+	return wildcard && strings.HasPrefix(string(requested), prefix+".")
+}
+
+// rolesAllow reports whether any of the roles has the permission. The empty permission is always allowed.
+func rolesAllow(roles []Role, permission Permission) bool {
+	if permission == "" {
+		return true
+	}
+	for _, role := range roles {
+		for _, granted := range rolePermissions[role] {
+			if grants(granted, permission) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rolesFor returns the roles of an identity: guests are guests, every logged-in user is a member,
+// plus the roles granted to the account, by the identity provider or through ADMIN_USERS
+func rolesFor(session *Session) []Role {
+	if session == nil {
+		return []Role{roleGuest}
+	}
+	roles := []Role{roleMember}
+	add := func(role Role) {
+		for _, existing := range roles {
+			if existing == role {
+				return
+			}
+		}
+		if isKnownRole(role) && role != roleGuest {
+			roles = append(roles, role)
+		}
+	}
+	account, exists := accounts.get(session.Username)
+	if exists {
+		for _, role := range account.Roles {
+			add(role)
+		}
+	}
+	for _, role := range session.Roles {
+		add(Role(role))
+	}
+	if exists && isAdminAccount(account) {
+		add(roleAdmin)
+	}
+	return roles
+}
+
+// can reports whether the client has a permission
+func (c *Client) can(permission Permission) bool {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return rolesAllow(c.roles, permission)
+}
+
+// refreshRoles recomputes the roles of every connection of an account after a grant or revoke
+func refreshRoles(username string) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	for _, client := range clients {
+		if client.session != nil && strings.EqualFold(client.account, username) {
+			client.roles = rolesFor(client.session)
+		}
+	}
+}
+
+// requirePermission protects an HTTP handler with a permission of the logged-in user
+func requirePermission(permission Permission, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		session := sessionFromRequest(r)
+		if session == nil {
+			writeJSONError(w, http.StatusUnauthorized, "login required")
+			return
+		}
+		if !rolesAllow(rolesFor(session), permission) {
+			writeJSONError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+		next(w, r)
+	}
+}
+
+type roleGrant struct {
+	Username string `json:"username"`
+	Role     Role   `json:"role,omitempty"`  // Role to grant or revoke
+	Roles    []Role `json:"roles,omitempty"` // Roles of the account in responses
+}
+
+// handleAdminRoles lists role grants (GET), grants a role (POST) or revokes it (DELETE)
+func handleAdminRoles(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSONResponse(w, http.StatusOK, accounts.roleGrants())
+		return
+	case http.MethodPost, http.MethodDelete:
+	default:
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	// Changing roles needs more than reading the admin endpoints
+	if !rolesAllow(rolesFor(sessionFromRequest(r)), permManageRoles) {
+		writeJSONError(w, http.StatusForbidden, "permission denied")
+		return
+	}
+	var grant roleGrant
+	if !readJSONBody(w, r, &grant) {
+		return
+	}
+	if !isKnownRole(grant.Role) || grant.Role == roleGuest || grant.Role == roleMember {
+		writeJSONError(w, http.StatusBadRequest, "unknown role")
+		return
+	}
+
+	err := accounts.setRole(grant.Username, grant.Role, r.Method == http.MethodPost)
+	if err == errAccountNotFound {
+		writeJSONError(w, http.StatusNotFound, "no such account")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "could not save roles")
+		return
+	}
+	refreshRoles(grant.Username)
+	account, _ := accounts.get(grant.Username)
+	writeJSONResponse(w, http.StatusOK, roleGrant{Username: account.Username, Roles: account.Roles})
+}
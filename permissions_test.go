@@ -0,0 +1,114 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGrants(t *testing.T) {
+	assert.True(t, grants("*", permBan))
+	assert.True(t, grants("moderation.*", permKick))
+	assert.True(t, grants("bots.*", botPermission("/bot7")))
+	assert.False(t, grants("bots.*", "botsy.thing"))
+	assert.False(t, grants("moderation.*", "moderation"))
+	assert.False(t, grants(permSend, permBan))
+}
+
+func TestRolesFor(t *testing.T) {
+	useTempAccounts(t)
+	originalAdmins, originalAccounts := adminUsers, adminAccounts
+	adminUsers = []string{"root"}
+	defer func() { adminUsers, adminAccounts = originalAdmins, originalAccounts }()
+	assert.NoError(t, accounts.create(&Account{Username: "Root", Created: time.Now()}))
+	loadAdminUsers()
+
+	assert.Equal(t, []Role{roleGuest}, rolesFor(nil))
+	assert.Equal(t, []Role{roleMember}, rolesFor(&Session{Username: "Kim"}))
+	assert.Equal(t, []Role{roleMember, roleModerator}, rolesFor(&Session{Username: "Kim", Roles: []string{"moderator", "wizard", "guest"}}),
+		"Expected unknown roles from the identity provider to be ignored")
+	assert.Equal(t, []Role{roleMember, roleAdmin}, rolesFor(&Session{Username: "Root"}))
+
+	assert.False(t, rolesAllow(rolesFor(nil), botPermission("/bot7")), "Expected guests to be kept away from private bots")
+	assert.True(t, rolesAllow(rolesFor(nil), botPermission("/bot2")))
+	assert.False(t, rolesAllow([]Role{roleAgent}, permBan))
+	assert.True(t, rolesAllow([]Role{roleAgent}, permHandoffQueue))
+}
+
+func TestAdminUsersNeedAnAccountAtStartup(t *testing.T) {
+	useTempAccounts(t)
+	originalAdmins, originalAccounts := adminUsers, adminAccounts
+	adminUsers = []string{"root", "ops"}
+	defer func() { adminUsers, adminAccounts = originalAdmins, originalAccounts }()
+	assert.NoError(t, accounts.create(&Account{Username: "Root", Created: time.Now()}))
+	loadAdminUsers()
+
+	// Names without an account are taken by whoever registers or signs in first
+	postJSON(handleRegister, `{"username": "Ops", "password": "long enough"}`)
+	assert.NotContains(t, rolesFor(&Session{Username: "Ops"}), roleAdmin, "Expected a name registered after startup not to become admin")
+	assert.NoError(t, accounts.linkExternal("ops2", oidcProviderName, "subject-1"))
+	adminUsers = []string{"root", "ops2"}
+	assert.NotContains(t, rolesFor(&Session{Username: "ops2", Provider: oidcProviderName}), roleAdmin)
+
+	assert.Contains(t, rolesFor(&Session{Username: "ROOT"}), roleAdmin)
+	loadAdminUsers()
+	assert.Contains(t, rolesFor(&Session{Username: "ops2", Provider: oidcProviderName}), roleAdmin, "Expected the account to be granted after a restart")
+}
+
+func TestGuestPermissionsInChat(t *testing.T) {
+	startTestHub(t)
+	ws := joinTestClient(t, startTestServer(t), "Leo")
+
+	sendTestMessage(t, ws, Message{Message: "/bot7 my results"})
+	assert.Equal(t, "You are not allowed to use /bot7", readTestMessage(t, ws).Message)
+
+	sendTestMessage(t, ws, Message{Message: "/join brand-new-room"})
+	assert.Equal(t, "The room brand-new-room does not exist and you are not allowed to create rooms", readTestMessage(t, ws).Message)
+
+	sendTestMessage(t, ws, Message{Message: "/join lobby"})
+	assert.Equal(t, "You joined lobby", readTestMessage(t, ws).Message, "Expected guests to join existing rooms")
+}
+
+// adminRequest sends a request to the roles endpoint as the given user
+func adminRequest(t *testing.T, method, username, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, "/api/admin/roles", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if username != "" {
+		value, err := encodeSession(Session{Username: username, Expires: time.Now().Add(time.Hour).Unix()})
+		assert.NoError(t, err)
+		req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: value})
+	}
+	w := httptest.NewRecorder()
+	requirePermission(permAdminRead, handleAdminRoles)(w, req)
+	return w
+}
+
+func TestAdminRolesAPI(t *testing.T) {
+	useTempAccounts(t)
+	postJSON(handleRegister, `{"username": "Boss", "password": "long enough"}`)
+	postJSON(handleRegister, `{"username": "Mia", "password": "long enough"}`)
+	assert.NoError(t, accounts.setRole("Boss", roleAdmin, true))
+
+	assert.Equal(t, http.StatusUnauthorized, adminRequest(t, http.MethodGet, "", "").Code)
+	assert.Equal(t, http.StatusForbidden, adminRequest(t, http.MethodGet, "Mia", "").Code)
+
+	w := adminRequest(t, http.MethodPost, "Boss", `{"username": "mia", "role": "moderator"}`)
+	assert.Equal(t, http.StatusOK, w.Code, w.Body.String())
+	assert.JSONEq(t, `{"username": "Mia", "roles": ["moderator"]}`, w.Body.String())
+	assert.Contains(t, rolesFor(&Session{Username: "Mia"}), roleModerator)
+
+	// Moderators may read the admin endpoints but not change roles
+	assert.Equal(t, http.StatusOK, adminRequest(t, http.MethodGet, "Mia", "").Code)
+	assert.Equal(t, http.StatusForbidden, adminRequest(t, http.MethodPost, "Mia", `{"username": "Mia", "role": "admin"}`).Code)
+
+	assert.Equal(t, http.StatusBadRequest, adminRequest(t, http.MethodPost, "Boss", `{"username": "Mia", "role": "wizard"}`).Code)
+	assert.Equal(t, http.StatusNotFound, adminRequest(t, http.MethodPost, "Boss", `{"username": "Nobody", "role": "agent"}`).Code)
+
+	w = adminRequest(t, http.MethodDelete, "Boss", `{"username": "Mia", "role": "moderator"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, []Role{roleMember}, rolesFor(&Session{Username: "Mia"}))
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Presence of a user, over all of their connections
+const (
+	presenceOnline  = "online"  // At least one connection is in use
+	presenceAway    = "away"    // Every connection reported being idle
+	presenceOffline = "offline" // Not connected, or no longer in the room of a presence frame
+)
+
+// Member is a user connected to a room
+type Member struct {
+	Username string `json:"username"`
+	Status   string `json:"status"`
+}
+
+// userStatusLocked returns the presence of a user; the caller holds clientsMu
+func userStatusLocked(username string) string {
+	status := presenceOffline
+	for _, client := range clients {
+		if client.username == "" || !strings.EqualFold(client.username, username) {
+			continue
+		}
+		if !client.away {
+			return presenceOnline
+		}
+		status = presenceAway
+	}
+	return status
+}
+
+// inRoomLocked reports whether a user has a connection other than except in a room; the caller holds clientsMu
+func inRoomLocked(username, room string, except *Client) bool {
+	for _, client := range clients {
+		if client != except && strings.EqualFold(client.username, username) && roomName(client.room) == roomName(room) {
+			return true
+		}
+	}
+	return false
+}
+
+// roomMembers lists the users connected to a room, sorted by name
+func roomMembers(room string) []Member {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	members := []Member{}
+	seen := make(map[string]bool)
+	for _, client := range clients {
+		key := strings.ToLower(client.username)
+		if client.username == "" || roomName(client.room) != roomName(room) || seen[key] {
+			continue
+		}
+		seen[key] = true
+		members = append(members, Member{Username: client.username, Status: userStatusLocked(client.username)})
+	}
+	sort.Slice(members, func(i, j int) bool {
+		return strings.ToLower(members[i].Username) < strings.ToLower(members[j].Username)
+	})
+	return members
+}
+
+// sendToRoom writes a frame to every named connection in a room. Presence frames are written
+// directly instead of through the broadcast channel since they are also sent by closing connections.
+func sendToRoom(room string, frame Message) {
+	clientsMu.Lock()
+	var targets []*Client
+	for _, client := range clients {
+		if client.username != "" && roomName(client.room) == roomName(room) {
+			targets = append(targets, client)
+		}
+	}
+	clientsMu.Unlock()
+	for _, client := range targets {
+		client.writeJSON(frame)
+	}
+}
+
+func presenceFrame(username, room, status, text string) Message {
+	return Message{Type: "presence", Username: username, Room: roomName(room), Status: status, Message: text}
+}
+
+// enterRoom announces a client that arrived in its room, unless the user was there already on another connection
+func enterRoom(client *Client) {
+	clientsMu.Lock()
+	name, room := client.username, client.room
+	known := name == "" || inRoomLocked(name, room, client)
+	status := userStatusLocked(name)
+	clientsMu.Unlock()
+	if !known {
+		sendToRoom(room, presenceFrame(name, room, status, name+" joined"))
+	}
+}
+
+// leaveRoom announces that a user left a room, unless another of their connections is still in it.
+// The client has already moved to another room, changed its name or been removed from the clients.
+func leaveRoom(client *Client, name, room string) {
+	if name == "" {
+		return
+	}
+	clientsMu.Lock()
+	stays := inRoomLocked(name, room, client)
+	clientsMu.Unlock()
+	if !stays {
+		sendToRoom(room, presenceFrame(name, room, presenceOffline, name+" left"))
+	}
+}
+
+// setAway records an idle report of a connection and announces the user in their rooms when their presence changes
+func setAway(client *Client, away bool) {
+	clientsMu.Lock()
+	name := client.username
+	before := userStatusLocked(name)
+	client.away = away
+	after := userStatusLocked(name)
+	userRooms := make(map[string]bool)
+	for _, other := range clients {
+		if strings.EqualFold(other.username, name) {
+			userRooms[roomName(other.room)] = true
+		}
+	}
+	clientsMu.Unlock()
+	if name == "" || before == after {
+		return
+	}
+	text := name + " is back"
+	if after == presenceAway {
+		text = name + " is away"
+	}
+	for room := range userRooms {
+		sendToRoom(room, presenceFrame(name, room, after, text))
+	}
+}
+
+func init() {
+	registerCommand(&Command{
+		Name: "who",
+		Args: []ArgSpec{{Name: "room", Pattern: roomNamePattern}},
+		Help: "List the users in the current room, or in another room",
+		Run:  runWho,
+	})
+}
+
+func runWho(ctx *CommandContext) {
+	room := roomName(ctx.Client.room)
+	if ctx.Args["room"] != "" {
+		room = ctx.Args["room"]
+	}
+	if !roomExists(room) {
+		ctx.reply("The room %s does not exist", room)
+		return
+	}
+	var names []string
+	for _, member := range roomMembers(room) {
+		if member.Status == presenceAway {
+			names = append(names, member.Username+" (away)")
+		} else {
+			names = append(names, member.Username)
+		}
+	}
+	if len(names) == 0 {
+		ctx.reply("Nobody is in %s", room)
+		return
+	}
+	ctx.reply("In %s: %s", room, strings.Join(names, ", "))
+}
+
+// handleRooms serves /api/rooms/{room}/members, /receipts, /messages and /threads/{id}. The path is split by
+// hand, as the patterns of http.ServeMux only match methods and wildcards from Go 1.22 on.
+func handleRooms(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/rooms/"), "/")
+	if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3) != (parts[1] == "threads") || !roomNamePattern.MatchString(parts[0]) {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	var handler func(w http.ResponseWriter, r *http.Request, room string)
+	switch parts[1] {
+	case "members":
+		handler = handleRoomMembers
+	case "receipts":
+		handler = handleRoomReceipts
+	case "messages":
+		handler = handleRoomMessages
+	case "threads":
+		handler = func(w http.ResponseWriter, r *http.Request, room string) { handleRoomThread(w, r, room, parts[2]) }
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	if session := sessionFromRequest(r); session == nil && (!guestMode || ssoRequired) {
+		writeJSONError(w, http.StatusUnauthorized, "login required")
+		return
+	}
+	room := parts[0]
+	if !roomExists(room) && !history.knows(room) {
+		writeJSONError(w, http.StatusNotFound, "room not found")
+		return
+	}
+	handler(w, r, room)
+}
+
+func handleRoomMembers(w http.ResponseWriter, r *http.Request, room string) {
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"room": room, "members": roomMembers(room)})
+}
+
+func handleRoomReceipts(w http.ResponseWriter, r *http.Request, room string) {
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"room": room, "receipts": history.receipts(room)})
+}
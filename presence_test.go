@@ -0,0 +1,125 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+// readPresence reads frames until the next presence frame
+func readPresence(t *testing.T, ws *websocket.Conn) Message {
+	for {
+		if msg := readTestFrame(t, ws); msg.Type == "presence" {
+			return msg
+		}
+	}
+}
+
+func TestPresenceFramesOnJoinAndLeave(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	alice := joinTestClient(t, wsURL, "Alice")
+	assert.Equal(t, presenceFrame("Alice", lobbyRoom, presenceOnline, "Alice joined"), readPresence(t, alice))
+
+	bob := joinTestAccount(t, wsURL, "Bob")
+	assert.Equal(t, presenceFrame("Bob", lobbyRoom, presenceOnline, "Bob joined"), readPresence(t, alice))
+	assert.Equal(t, "Bob joined", readPresence(t, bob).Message)
+
+	// The legacy "joined" message of older pages binds the name without being shown
+	carol := dialTestClient(t, wsURL)
+	sendTestMessage(t, carol, Message{Username: "Carol", Message: "joined"})
+	assert.Equal(t, "Carol joined", readPresence(t, alice).Message)
+	sendTestMessage(t, carol, Message{Message: "hi"})
+	assert.Equal(t, "hi", readTestMessage(t, alice).Message, "Expected no chat message for the legacy join")
+
+	sendTestMessage(t, bob, Message{Message: "/join games"})
+	assert.Equal(t, presenceFrame("Bob", lobbyRoom, presenceOffline, "Bob left"), readPresence(t, alice))
+
+	carol.Close()
+	assert.Equal(t, presenceFrame("Carol", lobbyRoom, presenceOffline, "Carol left"), readPresence(t, alice))
+}
+
+func TestPresenceAcrossConnections(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	watcher := joinTestClient(t, wsURL, "Watcher")
+	readPresence(t, watcher)
+	laptop := joinTestAccount(t, wsURL, "Dana")
+	assert.Equal(t, "Dana joined", readPresence(t, watcher).Message)
+	phone := joinTestAccount(t, wsURL, "Dana")
+
+	// Dana is only away once every connection is idle
+	sendTestMessage(t, laptop, Message{Type: "presence", Status: presenceAway})
+	assert.Equal(t, []Member{{"Dana", presenceOnline}, {"Watcher", presenceOnline}}, roomMembers(lobbyRoom))
+	sendTestMessage(t, phone, Message{Type: "presence", Status: presenceAway})
+	assert.Equal(t, presenceFrame("Dana", lobbyRoom, presenceAway, "Dana is away"), readPresence(t, watcher))
+	assert.Equal(t, []Member{{"Dana", presenceAway}, {"Watcher", presenceOnline}}, roomMembers(lobbyRoom))
+
+	sendTestMessage(t, laptop, Message{Type: "presence", Status: presenceOnline})
+	assert.Equal(t, presenceFrame("Dana", lobbyRoom, presenceOnline, "Dana is back"), readPresence(t, watcher))
+
+	// Closing one connection does not make Dana leave
+	phone.Close()
+	sendTestMessage(t, watcher, Message{Message: "/who"})
+	assert.Equal(t, "In lobby: Dana, Watcher", readTestMessage(t, watcher).Message)
+	laptop.Close()
+	assert.Equal(t, "Dana left", readPresence(t, watcher).Message)
+}
+
+func TestWhoCommand(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	erin := joinTestClient(t, wsURL, "Erin")
+	frank := joinTestAccount(t, wsURL, "Frank")
+	sendTestMessage(t, frank, Message{Type: "presence", Status: presenceAway})
+	sendTestMessage(t, erin, Message{Message: "/who"})
+	assert.Equal(t, "In lobby: Erin, Frank (away)", readTestMessage(t, erin).Message)
+
+	sendTestMessage(t, frank, Message{Message: "/join games"})
+	readTestMessage(t, frank)
+	sendTestMessage(t, erin, Message{Message: "/who games"})
+	assert.Equal(t, "In games: Frank (away)", readTestMessage(t, erin).Message)
+	sendTestMessage(t, erin, Message{Message: "/who nowhere"})
+	assert.Equal(t, "The room nowhere does not exist", readTestMessage(t, erin).Message)
+}
+
+func TestRoomMembersEndpoint(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	joinTestClient(t, wsURL, "Grace")
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handleRooms(w, httptest.NewRequest(http.MethodGet, path, nil))
+		return w
+	}
+	w := get("/api/rooms/lobby/members")
+	assert.Equal(t, http.StatusOK, w.Code)
+	var body struct {
+		Room    string   `json:"room"`
+		Members []Member `json:"members"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, lobbyRoom, body.Room)
+	assert.Equal(t, []Member{{"Grace", presenceOnline}}, body.Members)
+
+	assert.Equal(t, http.StatusNotFound, get("/api/rooms/nowhere/members").Code)
+	assert.Equal(t, http.StatusNotFound, get("/api/rooms/lobby/owners").Code)
+	assert.Equal(t, http.StatusNotFound, get("/api/rooms/Lobby!/members").Code)
+	assert.Equal(t, http.StatusNotFound, get("/api/rooms/lobby/members/extra").Code)
+
+	guestMode = false
+	defer func() { guestMode = true }()
+	assert.Equal(t, http.StatusUnauthorized, get("/api/rooms/lobby/members").Code, "Expected a login without guest mode")
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rateLimit is a token bucket: Burst tokens at most, refilled at PerMinute tokens a minute
+type rateLimit struct {
+	PerMinute float64
+	Burst     float64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateScope limits one kind of key, e.g. every user or every room, with the same budget
+type rateScope struct {
+	name    string
+	limit   rateLimit
+	buckets map[string]*tokenBucket
+}
+
+func newRateScope(name string, limit rateLimit) *rateScope {
+	return &rateScope{name: name, limit: limit, buckets: make(map[string]*tokenBucket)}
+}
+
+// Budgets of every scope. Bot queries have their own budget on top of the message limits,
+// since every one of them is a paid Dialogflow call.
+var (
+	connectionLimits = newRateScope("connection", envRate("RATE_LIMIT_CONNECTION", rateLimit{PerMinute: 600, Burst: 20}))
+	userLimits       = newRateScope("user", envRate("RATE_LIMIT_USER", rateLimit{PerMinute: 600, Burst: 20}))
+	ipLimits         = newRateScope("ip", envRate("RATE_LIMIT_IP", rateLimit{PerMinute: 1200, Burst: 40}))
+	roomLimits       = newRateScope("room", envRate("RATE_LIMIT_ROOM", rateLimit{PerMinute: 3000, Burst: 100}))
+	botLimits        = newRateScope("bot", envRate("RATE_LIMIT_BOT", rateLimit{PerMinute: 20, Burst: 5}))
+	rateMu           sync.Mutex // Guards every scope and the penalties
+)
+
+// Repeated violations put the offender in a penalty box that doubles on every offence
+var (
+	penaltyStrikes = 5                // Violations that trigger a penalty
+	strikeWindow   = time.Minute      // Violations further apart than this are forgiven
+	basePenalty    = 10 * time.Second // First penalty, doubled for every further one
+	maxPenalty     = 10 * time.Minute
+	penaltyMemory  = time.Hour // Penalties are forgotten after this long without violations
+	penalties      = make(map[string]*penaltyBox)
+)
+
+type penaltyBox struct {
+	strikes    int
+	lastStrike time.Time
+	served     int // Penalties given so far
+	until      time.Time
+}
+
+// envRate reads a limit written "<per minute>,<burst>", e.g. "600,20"
+func envRate(name string, fallback rateLimit) rateLimit {
+	value := envString(name, "")
+	if value == "" {
+		return fallback
+	}
+	perMinute, burst, found := strings.Cut(value, ",")
+	rate, err1 := strconv.ParseFloat(strings.TrimSpace(perMinute), 64)
+	size, err2 := strconv.ParseFloat(strings.TrimSpace(burst), 64)
+	if !found || err1 != nil || err2 != nil || rate <= 0 || size < 1 {
+		log.Printf("Ignoring invalid %s=%q: expected <per minute>,<burst>", name, value)
+		return fallback
+	}
+	return rateLimit{PerMinute: rate, Burst: size}
+}
+
+// refill brings a bucket up to date and returns it; the caller holds rateMu
+func (s *rateScope) refill(key string, now time.Time) *tokenBucket {
+	bucket, exists := s.buckets[key]
+	if !exists {
+		if len(s.buckets) > 10000 {
+			s.prune(now)
+		}
+		bucket = &tokenBucket{tokens: s.limit.Burst, last: now}
+		s.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(s.limit.Burst, bucket.tokens+now.Sub(bucket.last).Minutes()*s.limit.PerMinute)
+	bucket.last = now
+	return bucket
+}
+
+// wait returns how long until a bucket holds enough tokens
+func (s *rateScope) wait(bucket *tokenBucket, cost float64) time.Duration {
+	missing := cost - bucket.tokens
+	if missing <= 0 {
+		return 0
+	}
+	return time.Duration(missing / s.limit.PerMinute * float64(time.Minute))
+}
+
+// prune forgets the buckets that are full again, as new ones start full anyway
+func (s *rateScope) prune(now time.Time) {
+	for key, bucket := range s.buckets {
+		if bucket.tokens+now.Sub(bucket.last).Minutes()*s.limit.PerMinute >= s.limit.Burst {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// rateKey names the bucket of a scope to take tokens from
+type rateKey struct {
+	scope *rateScope
+	key   string
+}
+
+// takeTokens takes a token from every bucket, or from none if any of them is empty.
+// It returns how long to wait and the scope that refused.
+func takeTokens(keys []rateKey) (time.Duration, string) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	now := time.Now()
+	buckets := make([]*tokenBucket, len(keys))
+	for i, k := range keys {
+		buckets[i] = k.scope.refill(k.key, now)
+		if wait := k.scope.wait(buckets[i], 1); wait > 0 {
+			return wait, k.scope.name
+		}
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return 0, ""
+}
+
+// penalize records a violation and returns the penalty it earned, if any
+func penalize(offender string, now time.Time) time.Duration {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	box, exists := penalties[offender]
+	if !exists && len(penalties) > 10000 {
+		for key, old := range penalties {
+			if now.Sub(old.lastStrike) > penaltyMemory {
+				delete(penalties, key)
+			}
+		}
+	}
+	if !exists || now.Sub(box.lastStrike) > penaltyMemory {
+		box = &penaltyBox{}
+		penalties[offender] = box
+	}
+	if now.Sub(box.lastStrike) > strikeWindow {
+		box.strikes = 0
+	}
+	box.strikes++
+	box.lastStrike = now
+	if box.strikes < penaltyStrikes {
+		return 0
+	}
+	penalty := basePenalty << box.served
+	if penalty > maxPenalty || penalty <= 0 {
+		penalty = maxPenalty
+	}
+	box.served++
+	box.strikes = 0
+	box.until = now.Add(penalty)
+	return penalty
+}
+
+// penaltyLeft returns how long an offender still has to wait
+func penaltyLeft(offender string, now time.Time) time.Duration {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	if box, exists := penalties[offender]; exists && now.Before(box.until) {
+		return box.until.Sub(now)
+	}
+	return 0
+}
+
+// offender names whoever is penalized for a client's violations: the user, or the address of unnamed connections
+func (c *Client) offender() string {
+	if c.username != "" {
+		return "user:" + strings.ToLower(c.username)
+	}
+	return "ip:" + c.ip
+}
+
+// rateLimited tells a client to wait before sending again
+func (c *Client) rateLimited(wait time.Duration, text string) {
+	seconds := int(math.Ceil(wait.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+	c.writeJSON(Message{Type: "error", Code: "rate_limited", Username: "System", Room: c.room, RetryAfter: seconds,
+		Message: fmt.Sprintf("%s Please wait %d seconds.", text, seconds)})
+}
+
+// allowFrame applies the message limits of every scope to a frame from a client, telling the client when it is refused
+func allowFrame(client *Client) bool {
+	now := time.Now()
+	if wait := penaltyLeft(client.offender(), now); wait > 0 {
+		client.rateLimited(wait, "You are temporarily blocked for sending too many messages.")
+		return false
+	}
+	keys := []rateKey{{connectionLimits, fmt.Sprintf("%p", client)}, {ipLimits, client.ip}, {roomLimits, roomName(client.room)}}
+	if client.username != "" {
+		keys = append(keys, rateKey{userLimits, strings.ToLower(client.username)})
+	}
+	wait, scope := takeTokens(keys)
+	if wait == 0 {
+		return true
+	}
+	if scope == roomLimits.name {
+		client.rateLimited(wait, "This room is very busy.") // Not the sender's fault alone
+		return false
+	}
+	if penalty := penalize(client.offender(), now); penalty > 0 {
+		log.Printf("Rate limit: %s blocked for %s", client.offender(), penalty)
+		client.rateLimited(penalty, "You are temporarily blocked for sending too many messages.")
+		return false
+	}
+	client.rateLimited(wait, "You are sending messages too quickly.")
+	return false
+}
+
+// allowBotQuery applies the bot budget of a user before a Dialogflow call
+func allowBotQuery(client *Client) bool {
+	wait, _ := takeTokens([]rateKey{{botLimits, client.offender()}})
+	if wait == 0 {
+		return true
+	}
+	client.rateLimited(wait, "You are asking the bots too many questions.")
+	return false
+}
+
+// forgetConnection drops the bucket of a closed connection
+func forgetConnection(client *Client) {
+	rateMu.Lock()
+	defer rateMu.Unlock()
+	delete(connectionLimits.buckets, fmt.Sprintf("%p", client))
+}
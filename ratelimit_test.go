@@ -0,0 +1,94 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useRateLimits replaces the user and bot budgets and clears the penalties for the duration of a test
+func useRateLimits(t *testing.T, user, bot rateLimit) {
+	originalUser, originalBot, originalPenalties := userLimits, botLimits, penalties
+	userLimits, botLimits = newRateScope("user", user), newRateScope("bot", bot)
+	penalties = make(map[string]*penaltyBox)
+	t.Cleanup(func() { userLimits, botLimits, penalties = originalUser, originalBot, originalPenalties })
+}
+
+func TestTakeTokensIsAllOrNothing(t *testing.T) {
+	roomy := newRateScope("roomy", rateLimit{PerMinute: 60, Burst: 5})
+	tight := newRateScope("tight", rateLimit{PerMinute: 60, Burst: 1})
+
+	wait, _ := takeTokens([]rateKey{{roomy, "a"}, {tight, "a"}})
+	assert.Zero(t, wait)
+	wait, name := takeTokens([]rateKey{{roomy, "a"}, {tight, "a"}})
+	assert.Equal(t, "tight", name)
+	assert.InDelta(t, float64(time.Second), float64(wait), float64(50*time.Millisecond), "Expected the wait for one token")
+	assert.InDelta(t, 4, roomy.buckets["a"].tokens, 0.01, "Expected no token to be taken when another scope refuses")
+}
+
+func TestPenaltiesEscalate(t *testing.T) {
+	useRateLimits(t, userLimits.limit, botLimits.limit)
+	now := time.Now()
+	var given []time.Duration
+	for i := 0; i < 3*penaltyStrikes; i++ {
+		if penalty := penalize("user:mallory", now); penalty > 0 {
+			given = append(given, penalty)
+		}
+	}
+	assert.Equal(t, []time.Duration{basePenalty, 2 * basePenalty, 4 * basePenalty}, given)
+	assert.Equal(t, 4*basePenalty, penaltyLeft("user:mallory", now))
+
+	// Occasional violations are forgiven
+	for i := 0; i < 2*penaltyStrikes; i++ {
+		assert.Zero(t, penalize("user:oscar", now.Add(time.Duration(i)*2*strikeWindow)))
+	}
+}
+
+func TestUserBudgetIsSharedByConnections(t *testing.T) {
+	useRateLimits(t, rateLimit{PerMinute: 1, Burst: 3}, botLimits.limit)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	first := joinTestAccount(t, wsURL, "Tabby")
+	second := joinTestAccount(t, wsURL, "Tabby")
+
+	sendTestMessage(t, first, Message{Message: "one"})
+	sendTestMessage(t, second, Message{Message: "two"})
+	for i := 0; i < 2; i++ {
+		readTestMessage(t, first) // Both messages reach both tabs
+		readTestMessage(t, second)
+	}
+	sendTestMessage(t, second, Message{Message: "three"})
+	readTestMessage(t, first)
+	readTestMessage(t, second)
+
+	sendTestMessage(t, first, Message{Message: "four"})
+	msg := readTestMessage(t, first)
+	assert.Equal(t, "rate_limited", msg.Code, "Expected another tab not to get a fresh budget")
+	assert.Equal(t, 60, msg.RetryAfter)
+	assert.Equal(t, "You are sending messages too quickly. Please wait 60 seconds.", msg.Message)
+}
+
+func TestBotQueriesHaveTheirOwnBudget(t *testing.T) {
+	useRateLimits(t, userLimits.limit, rateLimit{PerMinute: 2, Burst: 1})
+	startTestHub(t)
+	queries := 0
+	stubBots(t, func(sessionID, input, agentID string) ([]string, error) {
+		queries++
+		return []string{"answer"}, nil
+	})
+	ws := joinTestClient(t, startTestServer(t), "Penny")
+
+	sendTestMessage(t, ws, Message{Message: "/bot2 hi"})
+	assert.Equal(t, "/bot2 hi", readTestMessage(t, ws).Message)
+	assert.Equal(t, "answer", readTestMessage(t, ws).Message)
+
+	sendTestMessage(t, ws, Message{Message: "/bot2 again"})
+	msg := readTestMessage(t, ws)
+	assert.Equal(t, "rate_limited", msg.Code)
+	assert.Equal(t, 30, msg.RetryAfter)
+	assert.Equal(t, 1, queries, "Expected Dialogflow not to be called over the budget")
+
+	sendTestMessage(t, ws, Message{Message: "plain chat still works"})
+	assert.Equal(t, "plain chat still works", readTestMessage(t, ws).Message)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Limits per message, so reactions cannot be used to flood a room
+var (
+	maxReactionEmoji = envInt("REACTION_LIMIT", 20)     // Different emoji on one message
+	maxUserReactions = envInt("REACTION_USER_LIMIT", 5) // Emoji one user may put on one message
+)
+
+const maxEmojiBytes = 32 // Long enough for flags and skin tone or family sequences
+
+var errReactionLimit = errors.New("too many reactions")
+
+// Reaction aggregates the users who reacted to a message with the same emoji
+type Reaction struct {
+	Emoji string   `json:"emoji"`
+	Count int      `json:"count"`
+	Users []string `json:"users"`
+
+	authors []string // Identities of Users in the same order, see authorID; never sent to clients
+}
+
+const (
+	zeroWidthJoiner = '\u200d'
+	emojiSelector   = '\ufe0f' // Variation selector 16, asks for the emoji presentation
+	keycapMark      = '\u20e3'
+)
+
+// Characters drawn as emoji (Extended_Pictographic in Unicode 15)
+var extendedPictographic = &unicode.RangeTable{
+	R16: []unicode.Range16{
+		{0x00a9, 0x00a9, 1}, {0x00ae, 0x00ae, 1}, {0x203c, 0x203c, 1}, {0x2049, 0x2049, 1},
+		{0x2122, 0x2122, 1}, {0x2139, 0x2139, 1}, {0x2194, 0x2199, 1}, {0x21a9, 0x21aa, 1},
+		{0x231a, 0x231b, 1}, {0x2328, 0x2328, 1}, {0x2388, 0x2388, 1}, {0x23cf, 0x23cf, 1},
+		{0x23e9, 0x23f3, 1}, {0x23f8, 0x23fa, 1}, {0x24c2, 0x24c2, 1}, {0x25aa, 0x25ab, 1},
+		{0x25b6, 0x25b6, 1}, {0x25c0, 0x25c0, 1}, {0x25fb, 0x25fe, 1}, {0x2600, 0x2605, 1},
+		{0x2607, 0x2612, 1}, {0x2614, 0x2685, 1}, {0x2690, 0x2705, 1}, {0x2708, 0x2712, 1},
+		{0x2714, 0x2714, 1}, {0x2716, 0x2716, 1}, {0x271d, 0x271d, 1}, {0x2721, 0x2721, 1},
+		{0x2728, 0x2728, 1}, {0x2733, 0x2734, 1}, {0x2744, 0x2744, 1}, {0x2747, 0x2747, 1},
+		{0x274c, 0x274c, 1}, {0x274e, 0x274e, 1}, {0x2753, 0x2755, 1}, {0x2757, 0x2757, 1},
+		{0x2763, 0x2767, 1}, {0x2795, 0x2797, 1}, {0x27a1, 0x27a1, 1}, {0x27b0, 0x27b0, 1},
+		{0x27bf, 0x27bf, 1}, {0x2934, 0x2935, 1}, {0x2b05, 0x2b07, 1}, {0x2b1b, 0x2b1c, 1},
+		{0x2b50, 0x2b50, 1}, {0x2b55, 0x2b55, 1}, {0x3030, 0x3030, 1}, {0x303d, 0x303d, 1},
+		{0x3297, 0x3297, 1}, {0x3299, 0x3299, 1},
+	},
+	R32: []unicode.Range32{
+		{0x1f000, 0x1f0ff, 1}, {0x1f10d, 0x1f10f, 1}, {0x1f12f, 0x1f12f, 1}, {0x1f16c, 0x1f171, 1},
+		{0x1f17e, 0x1f17f, 1}, {0x1f18e, 0x1f18e, 1}, {0x1f191, 0x1f19a, 1}, {0x1f1ad, 0x1f1e5, 1},
+		{0x1f201, 0x1f20f, 1}, {0x1f21a, 0x1f21a, 1}, {0x1f22f, 0x1f22f, 1}, {0x1f232, 0x1f23a, 1},
+		{0x1f23c, 0x1f23f, 1}, {0x1f249, 0x1f3fa, 1}, {0x1f400, 0x1f53d, 1}, {0x1f546, 0x1f64f, 1},
+		{0x1f680, 0x1f6ff, 1}, {0x1f774, 0x1f77f, 1}, {0x1f7d5, 0x1f7ff, 1}, {0x1f80c, 0x1f80f, 1},
+		{0x1f848, 0x1f84f, 1}, {0x1f85a, 0x1f85f, 1}, {0x1f888, 0x1f88f, 1}, {0x1f8ae, 0x1f8ff, 1},
+		{0x1f90c, 0x1f93a, 1}, {0x1f93c, 0x1f945, 1}, {0x1f947, 0x1faff, 1}, {0x1fc00, 0x1fffd, 1},
+	},
+	LatinOffset: 2,
+}
+
+// isSkinTone reports whether a rune is one of the skin tone modifiers
+func isSkinTone(r rune) bool {
+	return r >= 0x1f3fb && r <= 0x1f3ff
+}
+
+func isRegionalIndicator(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// isEmoji accepts a single emoji: a flag, a keycap such as "1️⃣", or pictographs with an optional
+// presentation selector and skin tone, joined by zero width joiners as in "👨‍👩‍👧". Text, symbols
+// that are not emoji and invisible characters such as bidi overrides are refused.
+func isEmoji(value string) bool {
+	if value == "" || len(value) > maxEmojiBytes || !utf8.ValidString(value) {
+		return false
+	}
+	runes := []rune(value)
+	switch {
+	case isRegionalIndicator(runes[0]):
+		return len(runes) == 2 && isRegionalIndicator(runes[1])
+	case strings.ContainsRune("0123456789#*", runes[0]):
+		return (len(runes) == 2 && runes[1] == keycapMark) || (len(runes) == 3 && runes[1] == emojiSelector && runes[2] == keycapMark)
+	}
+	for i := 0; ; i++ {
+		if i == len(runes) || !unicode.Is(extendedPictographic, runes[i]) {
+			return false
+		}
+		if i+1 < len(runes) && runes[i+1] == emojiSelector {
+			i++
+		}
+		if i+1 < len(runes) && isSkinTone(runes[i+1]) {
+			i++
+		}
+		if i+1 == len(runes) {
+			return true
+		}
+		if runes[i+1] != zeroWidthJoiner {
+			return false
+		}
+		i++
+	}
+}
+
+// toggleReaction adds the reaction of a user to a message, or takes it back if it was there.
+// Users are told apart by author, their identity, and shown by username. It returns the
+// aggregate of that emoji after the change; a count of 0 means it is gone.
+func toggleReaction(msg *Message, username, author, emoji string) (Reaction, error) {
+	found, mine := -1, 0
+	for i, reaction := range msg.Reactions {
+		if reaction.Emoji == emoji {
+			found = i
+		}
+		for _, id := range reaction.authors {
+			if id == author {
+				mine++
+			}
+		}
+	}
+	reactions := append([]Reaction(nil), msg.Reactions...) // The stored message only changes if the update succeeds
+	if found < 0 {
+		if len(reactions) >= maxReactionEmoji {
+			return Reaction{}, errReactionLimit
+		}
+		reactions = append(reactions, Reaction{Emoji: emoji})
+		found = len(reactions) - 1
+	}
+
+	users, authors := []string{}, []string{}
+	removed := false
+	for i, user := range reactions[found].Users {
+		id := ""
+		if i < len(reactions[found].authors) {
+			id = reactions[found].authors[i]
+		}
+		if id == author {
+			removed = true
+			continue
+		}
+		users, authors = append(users, user), append(authors, id)
+	}
+	if !removed {
+		if mine >= maxUserReactions {
+			return Reaction{}, errReactionLimit
+		}
+		users, authors = append(users, username), append(authors, author)
+	}
+
+	reaction := Reaction{Emoji: emoji, Count: len(users), Users: users, authors: authors}
+	if len(users) == 0 {
+		reactions = append(reactions[:found], reactions[found+1:]...)
+	} else {
+		reactions[found] = reaction
+	}
+	if len(reactions) == 0 {
+		reactions = nil
+	}
+	msg.Reactions = reactions
+	return reaction, nil
+}
+
+// react handles a react frame: the reaction of the client to a message of its room is toggled,
+// and the room is sent the new count of that emoji
+func react(client *Client, msg Message) {
+	if !client.can(permSend) {
+		client.notify("You are not allowed to send messages")
+		return
+	}
+	emoji := strings.TrimSpace(msg.Emoji)
+	if !isEmoji(emoji) {
+		client.writeJSON(Message{Type: "error", Code: "reaction_invalid", Username: "System", Message: "Reactions must be a single emoji", Room: client.room})
+		return
+	}
+
+	var reaction Reaction
+	changed, err := history.update(client.room, msg.ID, func(stored *Message) error {
+		if stored.Deleted {
+			return errMessageDeleted
+		}
+		var err error
+		reaction, err = toggleReaction(stored, client.username, authorID(client), emoji)
+		return err
+	})
+	switch {
+	case errors.Is(err, errMessageNotFound), errors.Is(err, errMessageDeleted):
+		client.writeJSON(Message{Type: "error", Code: "message_not_found", Username: "System", Message: "There is no such message in this room", Room: client.room})
+		return
+	case errors.Is(err, errReactionLimit):
+		client.writeJSON(Message{Type: "error", Code: "reaction_limit", Username: "System", Message: "This message has too many reactions", Room: client.room})
+		return
+	}
+	broadcast <- Message{Type: "reaction", ID: changed.ID, Username: client.username, Room: changed.Room, Emoji: emoji, Reactions: []Reaction{reaction}, ParentID: changed.ParentID}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsEmoji(t *testing.T) {
+	for _, emoji := range []string{"👍", "❤️", "👍🏽", "🇫🇷", "👨‍👩‍👧", "👩🏽‍💻", "🏳️‍🌈", "1️⃣", "#⃣", "🎉", "☺", "⭐"} {
+		assert.True(t, isEmoji(emoji), emoji)
+	}
+	for _, text := range []string{"", "ok", ":+1:", "👍 👍", "<b>", "1", "é", "👍ok", "🎉🎉🎉🎉🎉🎉🎉🎉🎉", "👍👍", "🇫", "🇫🇷🇫",
+		"\u200b", "\u202e", "\u2060\u2060", "👍\u202e", "\u200d👍", "👍\u200d", "→→→", "€", "1\ufe0f", "🏽"} {
+		assert.False(t, isEmoji(text), "%q", text)
+	}
+}
+
+func TestToggleReactionAggregatesAndLimits(t *testing.T) {
+	originalEmoji, originalUser := maxReactionEmoji, maxUserReactions
+	maxReactionEmoji, maxUserReactions = 3, 2
+	defer func() { maxReactionEmoji, maxUserReactions = originalEmoji, originalUser }()
+
+	msg := &Message{ID: 1}
+	reaction, err := toggleReaction(msg, "Ann", "guest:ann", "👍")
+	assert.NoError(t, err)
+	assert.Equal(t, Reaction{Emoji: "👍", Count: 1, Users: []string{"Ann"}, authors: []string{"guest:ann"}}, reaction)
+	reaction, _ = toggleReaction(msg, "Bob", "guest:bob", "👍")
+	assert.Equal(t, 2, reaction.Count)
+	toggleReaction(msg, "Ann", "guest:ann", "🎉")
+
+	_, err = toggleReaction(msg, "Ann", "guest:ann", "😮")
+	assert.ErrorIs(t, err, errReactionLimit, "Expected a limit on the reactions of one user")
+	toggleReaction(msg, "Bob", "guest:bob", "😮")
+	_, err = toggleReaction(msg, "Carl", "guest:carl", "😢")
+	assert.ErrorIs(t, err, errReactionLimit, "Expected a limit on different emoji")
+	assert.Len(t, msg.Reactions, 3)
+
+	// Someone else under the same name adds a reaction rather than taking Ann's back
+	reaction, _ = toggleReaction(msg, "Ann", "guest:other", "🎉")
+	assert.Equal(t, 2, reaction.Count)
+	toggleReaction(msg, "Ann", "guest:other", "🎉")
+
+	// Toggling again takes the reaction back, and emoji nobody uses anymore disappear
+	reaction, _ = toggleReaction(msg, "ann", "guest:ann", "🎉")
+	assert.Equal(t, Reaction{Emoji: "🎉", Count: 0, Users: []string{}, authors: []string{}}, reaction)
+	assert.Equal(t, []Reaction{
+		{Emoji: "👍", Count: 2, Users: []string{"Ann", "Bob"}, authors: []string{"guest:ann", "guest:bob"}},
+		{Emoji: "😮", Count: 1, Users: []string{"Bob"}, authors: []string{"guest:bob"}},
+	}, msg.Reactions)
+}
+
+func TestReactionsInChat(t *testing.T) {
+	useTempAccounts(t)
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	gina := joinTestClient(t, wsURL, "Gina")
+	hank := joinTestClient(t, wsURL, "Hank")
+	sendTestMessage(t, gina, Message{Message: "Release is out"})
+	sent := readTestMessage(t, hank)
+	readTestMessage(t, gina)
+
+	sendTestMessage(t, hank, Message{Type: "react", ID: sent.ID, Emoji: "🎉"})
+	update := Message{Type: "reaction", ID: sent.ID, Username: "Hank", Room: lobbyRoom, Emoji: "🎉", Reactions: []Reaction{{Emoji: "🎉", Count: 1, Users: []string{"Hank"}}}}
+	assert.Equal(t, update, readTestMessage(t, gina))
+	assert.Equal(t, update, readTestMessage(t, hank))
+	sendTestMessage(t, gina, Message{Type: "react", ID: sent.ID, Emoji: "🎉"})
+	assert.Equal(t, 2, readTestMessage(t, hank).Reactions[0].Count)
+	readTestMessage(t, gina)
+
+	sendTestMessage(t, hank, Message{Type: "react", ID: sent.ID, Emoji: "hooray"})
+	assert.Equal(t, "reaction_invalid", readTestMessage(t, hank).Code)
+	sendTestMessage(t, hank, Message{Type: "react", ID: 999, Emoji: "🎉"})
+	assert.Equal(t, "message_not_found", readTestMessage(t, hank).Code)
+
+	// History carries the reactions, and they survive a restart
+	stored := history.messages(lobbyRoom, 0, 1)[0]
+	assert.Equal(t, []Reaction{{Emoji: "🎉", Count: 2, Users: []string{"Hank", "Gina"}}}, stored.Reactions)
+	history.flush()
+	restarted := newHistoryStore(history.path)
+	assert.NoError(t, restarted.load())
+	assert.Equal(t, stored.Reactions, restarted.messages(lobbyRoom, 0, 1)[0].Reactions)
+	assert.Len(t, restarted.Reactors[sent.ID]["🎉"], 2, "Expected who reacted to survive a restart")
+
+	// A guest who takes the name of one who left cannot take back their reactions
+	hank.Close()
+	time.Sleep(50 * time.Millisecond) // Let the server release the name
+	impostor := joinTestClient(t, wsURL, "Hank")
+	sendTestMessage(t, impostor, Message{Type: "react", ID: sent.ID, Emoji: "🎉"})
+	assert.Equal(t, 3, readTestMessage(t, impostor).Reactions[0].Count, "Expected a new reaction rather than Hank's taken back")
+	readTestMessage(t, gina)
+
+	// Deleting a message drops its reactions
+	sendTestMessage(t, gina, Message{Type: "delete", ID: sent.ID})
+	readTestMessage(t, impostor)
+	assert.Nil(t, history.messages(lobbyRoom, 0, 1)[0].Reactions)
+}
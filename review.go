@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ReviewItem is a message held by a filter until a moderator approves or rejects it
+type ReviewItem struct {
+	ID       int       `json:"id"`
+	Username string    `json:"username"`
+	Room     string    `json:"room"`
+	Message  string    `json:"message"`
+	Reason   string    `json:"reason"`
+	ParentID int64     `json:"parent_id,omitempty"` // Message the held one replies to
+	Author   string    `json:"author,omitempty"`    // Identity of the sender, see authorID
+	Created  time.Time `json:"created"`
+}
+
+// reviewQueue keeps the held messages and persists them to a JSON file
+type reviewQueue struct {
+	mu     sync.Mutex
+	path   string
+	NextID int           `json:"next_id"`
+	Items  []*ReviewItem `json:"items"`
+}
+
+var reviews = newReviewQueue(filepath.Join(dataDir, "review.json"))
+
+func newReviewQueue(path string) *reviewQueue {
+	return &reviewQueue{path: path, NextID: 1, Items: []*ReviewItem{}}
+}
+
+// load reads the messages held before a restart
+func (q *reviewQueue) load() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return loadJSONFile(q.path, q)
+}
+
+// add holds a message and persists the queue
+func (q *reviewQueue) add(item ReviewItem) (ReviewItem, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	item.ID = q.NextID
+	item.Created = time.Now().UTC()
+	q.NextID++
+	q.Items = append(q.Items, &item)
+	if err := saveJSONFile(q.path, q); err != nil {
+		q.Items = q.Items[:len(q.Items)-1]
+		return item, err
+	}
+	return item, nil
+}
+
+// take removes a held message from the queue
+func (q *reviewQueue) take(id int) (ReviewItem, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for i, item := range q.Items {
+		if item.ID != id {
+			continue
+		}
+		previous := q.Items
+		q.Items = append(q.Items[:i:i], q.Items[i+1:]...)
+		if err := saveJSONFile(q.path, q); err != nil {
+			q.Items = previous
+			return ReviewItem{}, false, err
+		}
+		return *item, true, nil
+	}
+	return ReviewItem{}, false, nil
+}
+
+// pending returns a copy of the held messages, oldest first
+func (q *reviewQueue) pending() []ReviewItem {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := []ReviewItem{}
+	for _, item := range q.Items {
+		items = append(items, *item)
+	}
+	return items
+}
+
+// holdForReview queues a flagged message and tells the sender and the moderators
+func holdForReview(client *Client, text, reason string, parentID int64) {
+	item, err := reviews.add(ReviewItem{Username: client.username, Room: roomName(client.room), Message: text, Reason: reason, ParentID: parentID, Author: authorID(client)})
+	if err != nil {
+		log.Printf("Error saving review queue: %v", err)
+		client.notify("Your message could not be sent")
+		return
+	}
+	client.notify("Your message is held for review by a moderator")
+	notifyModerators(permReview, fmt.Sprintf("Message #%d from %s in %s is held for review (%s). Use /approve %d or /reject %d", item.ID, item.Username, item.Room, reason, item.ID, item.ID))
+}
+
+// notifyModerators sends a system message to every online client with the permission
+func notifyModerators(permission Permission, text string) {
+	clientsMu.Lock()
+	var online []*Client
+	for _, client := range clients {
+		if client.username != "" {
+			online = append(online, client)
+		}
+	}
+	clientsMu.Unlock()
+	for _, client := range online {
+		if client.can(permission) {
+			client.notify(text)
+		}
+	}
+}
+
+var reviewIDPattern = regexp.MustCompile(`^#?[0-9]+$`)
+
+func init() {
+	registerCommand(&Command{
+		Name:       "review",
+		Help:       "List the messages held for review",
+		Permission: permReview,
+		Run:        runReview,
+	})
+	registerCommand(&Command{
+		Name:       "approve",
+		Args:       []ArgSpec{{Name: "id", Required: true, Pattern: reviewIDPattern}},
+		Help:       "Deliver a message held for review",
+		Permission: permReview,
+		Run:        runApprove,
+	})
+	registerCommand(&Command{
+		Name:       "reject",
+		Args:       []ArgSpec{{Name: "id", Required: true, Pattern: reviewIDPattern}},
+		Help:       "Discard a message held for review",
+		Permission: permReview,
+		Run:        runReject,
+	})
+}
+
+func runReview(ctx *CommandContext) {
+	items := reviews.pending()
+	if len(items) == 0 {
+		ctx.reply("No messages are held for review")
+		return
+	}
+	lines := []string{"Messages held for review:"}
+	for _, item := range items {
+		lines = append(lines, fmt.Sprintf("#%d %s in %s (%s): %s", item.ID, item.Username, item.Room, item.Reason, item.Message))
+	}
+	ctx.reply("%s", strings.Join(lines, "\n"))
+}
+
+// takeReview removes the held message named by the id argument
+func takeReview(ctx *CommandContext) (ReviewItem, bool) {
+	id, _ := strconv.Atoi(strings.TrimPrefix(ctx.Args["id"], "#"))
+	item, found, err := reviews.take(id)
+	if err != nil {
+		log.Printf("Error saving review queue: %v", err)
+		ctx.reply("The review queue could not be saved")
+		return item, false
+	}
+	if !found {
+		ctx.reply("No message #%d is held for review", id)
+		return item, false
+	}
+	return item, true
+}
+
+func runApprove(ctx *CommandContext) {
+	item, ok := takeReview(ctx)
+	if !ok {
+		return
+	}
+	writeAudit(AuditEntry{Actor: ctx.Client.username, Action: "approve", Target: item.Username, Reason: item.Reason})
+	broadcast <- Message{Username: item.Username, Message: item.Message, HTML: renderMarkdown(item.Message), Room: item.Room, ParentID: item.ParentID, author: item.Author}
+	ctx.reply("Message #%d was delivered", item.ID)
+}
+
+func runReject(ctx *CommandContext) {
+	item, ok := takeReview(ctx)
+	if !ok {
+		return
+	}
+	writeAudit(AuditEntry{Actor: ctx.Client.username, Action: "reject", Target: item.Username, Reason: item.Reason})
+	for _, client := range onlineClients(item.Username) {
+		client.notify("Your held message was rejected by a moderator")
+	}
+	ctx.reply("Message #%d was discarded", item.ID)
+}
+
+// handleAdminReview lists the messages held for review
+func handleAdminReview(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, reviews.pending())
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const lobbyRoom = "lobby"
+
+// Room is a chat room, optionally with a bot attached to it
+type Room struct {
+	Name        string
+	BotCommand  string // Bot attached to the room (e.g. "/bot7"), empty for none
+	MentionOnly bool   // Only forward messages that mention the bot
+	sessionID   string // Dialogflow session shared by everyone in the room
+}
+
+var (
+	rooms   = map[string]*Room{lobbyRoom: {Name: lobbyRoom}}
+	roomsMu sync.Mutex
+)
+
+var (
+	roomNamePattern   = regexp.MustCompile(`^[a-z0-9_-]{1,32}$`)
+	botMentionPattern = regexp.MustCompile(`(?i)@bot\d*\b`)
+)
+
+// roomName maps the empty room of legacy messages to the lobby
+func roomName(name string) string {
+	if name == "" {
+		return lobbyRoom
+	}
+	return name
+}
+
+// getRoom returns the named room, creating it on first use
+func getRoom(name string) *Room {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+
+	name = roomName(name)
+	room, exists := rooms[name]
+	if !exists {
+		room = &Room{Name: name}
+		rooms[name] = room
+	}
+	return room
+}
+
+// roomExists reports whether a room was created already
+func roomExists(name string) bool {
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	_, exists := rooms[roomName(name)]
+	return exists
+}
+
+// roomBot returns a copy of the bot settings of a room
+func roomBot(name string) (botCommand string, mentionOnly bool, sessionID string) {
+	room := getRoom(name)
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	return room.BotCommand, room.MentionOnly, room.sessionID
+}
+
+// attachRoomBot attaches a bot to a room, or detaches it when botCommand is empty
+func attachRoomBot(name, botCommand string, mentionOnly bool) {
+	room := getRoom(name)
+	roomsMu.Lock()
+	defer roomsMu.Unlock()
+	room.BotCommand = botCommand
+	room.MentionOnly = mentionOnly
+	room.sessionID = fmt.Sprintf("room-%s-%d", room.Name, time.Now().UnixNano()) // Fresh bot conversation
+}
+
+func init() {
+	registerCommand(&Command{
+		Name:    "join",
+		Aliases: []string{"j"},
+		Args:    []ArgSpec{{Name: "room", Required: true, Pattern: roomNamePattern}},
+		Help:    "Switch to another room (lowercase letters, digits, - and _), creating it if needed",
+		Run:     runJoin,
+	})
+	registerCommand(&Command{
+		Name: "roombot",
+		Args: []ArgSpec{
+			{Name: "bot", Required: true},
+			{Name: "mention", Pattern: regexp.MustCompile(`^mention$`)},
+		},
+		Help:       "Attach a bot to the current room so it answers every message, or only @bot mentions. /roombot off detaches it",
+		Permission: permManageRooms,
+		Run:        runRoomBot,
+	})
+}
+
+func runJoin(ctx *CommandContext) {
+	room := ctx.Args["room"]
+	if !roomExists(room) && !ctx.Client.can(permCreateRooms) {
+		ctx.reply("The room %s does not exist and you are not allowed to create rooms", room)
+		return
+	}
+	getRoom(room)
+	clientsMu.Lock()
+	previous := ctx.Client.room
+	ctx.Client.room = room
+	clientsMu.Unlock()
+	ctx.reply("You joined %s", room)
+	if roomName(previous) != room {
+		stopTyping(ctx.Client)
+		leaveRoom(ctx.Client, ctx.Client.username, previous)
+		enterRoom(ctx.Client)
+	}
+}
+
+func runRoomBot(ctx *CommandContext) {
+	client := ctx.Client
+	if roomName(client.room) == lobbyRoom {
+		ctx.reply("Bots cannot be attached to the lobby. Use /botN there instead.")
+		return
+	}
+	if ctx.Args["bot"] == "off" {
+		attachRoomBot(client.room, "", false)
+		broadcast <- Message{Username: "System", Message: "The bot was detached from this room", Room: client.room}
+		return
+	}
+	botCommand := "/" + strings.TrimPrefix(ctx.Args["bot"], "/")
+	if _, exists := botAgentMap[botCommand]; !exists {
+		ctx.reply("Invalid bot %q. Type /help to see the bots.", ctx.Args["bot"])
+		return
+	}
+	mentionOnly := ctx.Args["mention"] != ""
+	attachRoomBot(client.room, botCommand, mentionOnly)
+	notice := botCommand + " is now attached to this room"
+	if mentionOnly {
+		notice += " and answers when mentioned with @bot"
+	}
+	broadcast <- Message{Username: "System", Message: notice, Room: client.room}
+}
+
+// forwardToRoomBot sends a regular chat message to the bot attached to the room
+// if the sender is allowed to use that bot
+func forwardToRoomBot(client *Client, room, text string) {
+	botCommand, mentionOnly, sessionID := roomBot(room)
+	if botCommand == "" || !client.can(botPermission(botCommand)) {
+		return
+	}
+	if mentionOnly {
+		if !botMentionPattern.MatchString(text) {
+			return
+		}
+		text = botMentionPattern.ReplaceAllString(text, "")
+	}
+	text = strings.TrimSpace(text)
+	if text == "" || !allowBotQuery(client) {
+		return
+	}
+
+	// An attached bot answers the whole room, whatever its visibility for /botN queries
+	botResponses, err := sendBotText(sessionID, text, botAgentMap[botCommand])
+	broadcastBotResponses(Message{Room: room}, botResponses, err)
+}
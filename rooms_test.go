@@ -0,0 +1,71 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRoomMessagesStayInRoom(t *testing.T) {
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	lobby := joinTestClient(t, wsURL, "Alice")
+	support := joinTestAccount(t, wsURL, "Agent", roleAgent)
+
+	sendTestMessage(t, support, Message{Username: "Agent", Message: "/join support"})
+	assert.Equal(t, "You joined support", readTestMessage(t, support).Message)
+
+	sendTestMessage(t, lobby, Message{Username: "Alice", Message: "Hello lobby"})
+	assert.Equal(t, "Hello lobby", readTestMessage(t, lobby).Message)
+
+	sendTestMessage(t, support, Message{Username: "Agent", Message: "Hello support"})
+	msg := readTestMessage(t, support)
+	assert.Equal(t, "Hello support", msg.Message, "Expected the lobby message to be skipped")
+	assert.Equal(t, "support", msg.Room)
+}
+
+func TestRoomBotAnswersEveryMessage(t *testing.T) {
+	startTestHub(t)
+	stubBots(t, func(sessionID, input, agentID string) ([]string, error) {
+		return []string{"echo: " + input}, nil
+	})
+	ws := joinTestAccount(t, startTestServer(t), "Alice", roleAgent)
+
+	sendTestMessage(t, ws, Message{Username: "Alice", Message: "/join help-desk"})
+	readTestMessage(t, ws)
+	sendTestMessage(t, ws, Message{Username: "Alice", Message: "/roombot bot7"})
+	assert.Equal(t, "/bot7 is now attached to this room", readTestMessage(t, ws).Message)
+
+	sendTestMessage(t, ws, Message{Username: "Alice", Message: "I need an appointment"})
+	assert.Equal(t, "I need an appointment", readTestMessage(t, ws).Message)
+	reply := readTestMessage(t, ws)
+	assert.Equal(t, "Bot", reply.Username)
+	assert.Equal(t, "echo: I need an appointment", reply.Message)
+}
+
+func TestRoomBotMentionOnly(t *testing.T) {
+	var queries []string
+	stubBots(t, func(sessionID, input, agentID string) ([]string, error) {
+		queries = append(queries, input)
+		return nil, nil
+	})
+	startTestHub(t)
+	attachRoomBot("mentions", "/bot2", true)
+
+	client := &Client{roles: []Role{roleMember}}
+	forwardToRoomBot(client, "mentions", "just chatting")
+	forwardToRoomBot(client, "mentions", "@bot tell me a joke")
+
+	assert.Equal(t, []string{"tell me a joke"}, queries, "Expected only the mention to reach the bot")
+}
+
+func TestRoomBotNotAllowedInLobby(t *testing.T) {
+	ws := joinTestAccount(t, startTestServer(t), "Alice", roleAgent)
+
+	sendTestMessage(t, ws, Message{Username: "Alice", Message: "/roombot bot1"})
+	msg := readTestMessage(t, ws)
+	assert.Contains(t, msg.Message, "cannot be attached to the lobby")
+	botCommand, _, _ := roomBot(lobbyRoom)
+	assert.Empty(t, botCommand)
+}
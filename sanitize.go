@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Chat messages are plain text. They are never interpreted as HTML: clients insert them as text,
+// and anything that renders HTML escapes them first. sanitizeMessage only removes characters
+// that can disguise a message, so the same text reaches everyone in the same form.
+
+// isBidiControl reports whether a rune overrides the direction of the surrounding text,
+// which can make a message or a link read differently from what it contains
+func isBidiControl(r rune) bool {
+	switch {
+	case r == '\u061c', r == '\u200e', r == '\u200f': // Arabic letter mark, LRM and RLM
+		return true
+	case r >= '\u202a' && r <= '\u202e': // Embeddings and overrides
+		return true
+	case r >= '\u2066' && r <= '\u2069': // Isolates
+		return true
+	}
+	return false
+}
+
+// keepRune reports whether a rune may appear in a chat message
+func keepRune(r rune) bool {
+	if r == '\n' || r == '\t' {
+		return true
+	}
+	if r == utf8.RuneError || r == '\ufeff' || isBidiControl(r) {
+		return false
+	}
+	return !unicode.IsControl(r)
+}
+
+// sanitizeMessage turns user input into clean plain text: invalid UTF-8, control characters and
+// bidi overrides are removed, line endings become "\n" and the text is normalized to NFC
+func sanitizeMessage(input string) string {
+	input = strings.ToValidUTF8(input, "")
+	input = strings.ReplaceAll(input, "\r\n", "\n")
+	input = strings.Map(func(r rune) rune {
+		if r == '\r' {
+			return '\n'
+		}
+		if !keepRune(r) {
+			return -1
+		}
+		return r
+	}, input)
+	return norm.NFC.String(input)
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/unicode/norm"
+)
+
+// xssPayloads is a corpus of markup that must stay inert text
+var xssPayloads = []string{
+	`<script>alert('xss')</script>`,
+	`<img src=x onerror=alert(1)>`,
+	`<svg/onload=alert(1)>`,
+	`<a href="javascript:alert(1)">click</a>`,
+	`<iframe src="data:text/html;base64,PHNjcmlwdD5hbGVydCgxKTwvc2NyaXB0Pg=="></iframe>`,
+	`"><script>alert(document.cookie)</script>`,
+	`'';!--"<XSS>=&{()}`,
+	`<body onload=alert('xss')>`,
+	`<scr<script>ipt>alert(1)</scr</script>ipt>`,
+	`<IMG SRC=JaVaScRiPt:alert('XSS')>`,
+	`<div style="background:url(javascript:alert(1))">`,
+	`&lt;script&gt;alert(1)&lt;/script&gt;`,
+	"<scr\x00ipt>alert(1)</script>",
+	"java\tscript:alert(1)",
+	"<a href=\"java&#x09;script:alert(1)\">x</a>",
+	"\u202egnp.exe",
+	"<img src=x onerror=\u2066alert(1)\u2069>",
+	"\xff\xfe<script>",
+	`<math><mtext><table><mglyph><style><img src=x onerror=alert(1)>`,
+	"<details open ontoggle=alert(1)>",
+}
+
+func TestSanitizeMessageStripsControlAndBidiCharacters(t *testing.T) {
+	assert.Equal(t, "hello world", sanitizeMessage("hello\x00 \x1bworld\x7f"))
+	assert.Equal(t, "line one\nline two\nthree", sanitizeMessage("line one\r\nline two\rthree"))
+	assert.Equal(t, "tab\tstays", sanitizeMessage("tab\tstays"))
+	assert.Equal(t, "invoice_exe.pdf", sanitizeMessage("invoice_\u202eexe.pdf"), "Expected bidi overrides to be removed")
+	assert.Equal(t, "admin", sanitizeMessage("\u2066admin\u2069\u200f"))
+	assert.Equal(t, "\u00e9t\u00e9", sanitizeMessage("e\u0301te\u0301"), "Expected messages to be normalized to NFC")
+	assert.Equal(t, "ok", sanitizeMessage("\xffok\ufeff"))
+	assert.Equal(t, "👩\u200d💻 café", sanitizeMessage("👩\u200d💻 café"), "Expected emoji sequences to survive")
+}
+
+func TestXSSPayloadsStayPlainText(t *testing.T) {
+	for _, payload := range xssPayloads {
+		output := sanitizeMessage(payload)
+		assertCleanText(t, output)
+		// Markup is text, so it is kept as typed rather than half-removed
+		if utf8.ValidString(payload) && !strings.ContainsAny(payload, "\x00\t\u202e\u2066\u2069") {
+			assert.Equal(t, payload, output)
+		}
+	}
+}
+
+func TestUsernamesAreNormalized(t *testing.T) {
+	name, err := validateUsername("Ame\u0301lie")
+	assert.NoError(t, err)
+	assert.Equal(t, "Am\u00e9lie", name, "Expected one spelling of accented names")
+	_, err = validateUsername("admin\u202e")
+	assert.Equal(t, errUsernameInvalid, err)
+}
+
+func TestFrontendRendersMessagesAsText(t *testing.T) {
+	script, err := os.ReadFile("static/js/scripts.js")
+	assert.NoError(t, err)
+	// The only HTML the page inserts is the Markdown rendered and escaped by the server
+	assignments := regexp.MustCompile(`innerHTML\s*=\s*([^;]+);`).FindAllStringSubmatch(string(script), -1)
+	for _, assignment := range assignments {
+		assert.Equal(t, "message.html", strings.TrimSpace(assignment[1]), "Expected message text to be inserted with textContent")
+	}
+}
+
+func FuzzSanitizeMessage(f *testing.F) {
+	for _, payload := range xssPayloads {
+		f.Add(payload)
+	}
+	f.Fuzz(func(t *testing.T, input string) {
+		output := sanitizeMessage(input)
+		assertCleanText(t, output)
+		assert.Equal(t, output, sanitizeMessage(output), "Expected sanitizing to be idempotent")
+	})
+}
+
+// assertCleanText checks the guarantees of sanitizeMessage
+func assertCleanText(t *testing.T, text string) {
+	t.Helper()
+	assert.True(t, utf8.ValidString(text), "Expected valid UTF-8: %q", text)
+	assert.True(t, norm.NFC.IsNormalString(text), "Expected NFC: %q", text)
+	for _, r := range text {
+		assert.True(t, keepRune(r), "Unexpected rune %U in %q", r, text)
+		assert.NotEqual(t, '\r', r)
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/bits"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+// Thresholds of the spam detector
+var (
+	spamWindow        = envDuration("SPAM_WINDOW", 2*time.Minute)  // How long messages are remembered
+	spamRepeatLimit   = envInt("SPAM_REPEAT_LIMIT", 3)             // Near-duplicates allowed within the window
+	spamSimilarity    = envInt("SPAM_SIMILARITY", 10)              // Differing bits of two fingerprints still counted as a duplicate
+	spamMentionLimit  = envInt("SPAM_MENTION_LIMIT", 5)            // Distinct mentions allowed in one message
+	spamMentionWindow = envInt("SPAM_MENTION_WINDOW_LIMIT", 12)    // Mentions allowed within the window
+	spamMuteBase      = envDuration("SPAM_MUTE", time.Minute)      // First automatic mute, doubled for every further offence
+	spamMuteMax       = envDuration("SPAM_MUTE_MAX", 24*time.Hour) // Longest automatic mute
+	spamMemory        = envDuration("SPAM_MEMORY", 24*time.Hour)   // Offences are forgotten after this long
+)
+
+// spamEntry is a message remembered by the detector
+type spamEntry struct {
+	fingerprint uint64
+	mentions    int
+	at          time.Time
+}
+
+// spamRecord is what the detector knows about one sender
+type spamRecord struct {
+	recent      []spamEntry
+	offences    int
+	lastOffence time.Time
+}
+
+var (
+	spamRecords = make(map[string]*spamRecord)
+	spamMu      sync.Mutex
+)
+
+var mentionPattern = regexp.MustCompile(`@([\p{L}\p{N}_.-]+)`)
+
+// fingerprint computes a similarity hash of a message: messages that differ by a few characters
+// get fingerprints that differ by a few bits. It is built from the letter trigrams of the text,
+// ignoring case, punctuation and spacing. Texts without letters or digits, such as a single
+// emoji, are fingerprinted from all their visible characters, or they would all look alike.
+func fingerprint(text string) uint64 {
+	var normalized, visible []rune
+	for _, r := range strings.ToLower(text) {
+		if unicode.IsLetter(r) || unicode.IsNumber(r) {
+			normalized = append(normalized, r)
+		}
+		if !unicode.IsSpace(r) {
+			visible = append(visible, r)
+		}
+	}
+	if len(normalized) == 0 {
+		normalized = visible
+	}
+	if len(normalized) < 3 {
+		normalized = append(normalized, make([]rune, 3-len(normalized))...)
+	}
+
+	var weights [64]int
+	for i := 0; i+3 <= len(normalized); i++ {
+		h := fnv.New64a()
+		h.Write([]byte(string(normalized[i : i+3])))
+		sum := h.Sum64()
+		for bit := 0; bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+	}
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << bit
+		}
+	}
+	return hash
+}
+
+// countMentions counts the distinct users mentioned in a message; @bot mentions address the room bot
+func countMentions(text string) int {
+	seen := make(map[string]bool)
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		if name := strings.ToLower(match[1]); !botMentionPattern.MatchString("@" + name) {
+			seen[name] = true
+		}
+	}
+	return len(seen)
+}
+
+// detectSpam remembers a message of a sender and returns why it is spam, or "" if it is not
+func detectSpam(sender, text string, now time.Time) string {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+
+	record, exists := spamRecords[sender]
+	if !exists {
+		if len(spamRecords) > 10000 {
+			pruneSpamRecords(now)
+		}
+		record = &spamRecord{}
+		spamRecords[sender] = record
+	}
+	if now.Sub(record.lastOffence) > spamMemory {
+		record.offences = 0
+	}
+	recent := record.recent[:0]
+	for _, entry := range record.recent {
+		if now.Sub(entry.at) <= spamWindow {
+			recent = append(recent, entry)
+		}
+	}
+
+	entry := spamEntry{fingerprint: fingerprint(text), mentions: countMentions(text), at: now}
+	duplicates, mentions := 0, entry.mentions
+	for _, previous := range recent {
+		if bits.OnesCount64(previous.fingerprint^entry.fingerprint) <= spamSimilarity {
+			duplicates++
+		}
+		mentions += previous.mentions
+	}
+	record.recent = append(recent, entry)
+
+	switch {
+	case duplicates >= spamRepeatLimit:
+		return "repeated messages"
+	case entry.mentions > spamMentionLimit || mentions > spamMentionWindow:
+		return "mass mentions"
+	}
+	return ""
+}
+
+// spamOffence records an offence and returns how long the offender is muted for
+func spamOffence(sender string, now time.Time) time.Duration {
+	spamMu.Lock()
+	defer spamMu.Unlock()
+	record := spamRecords[sender]
+	record.recent = nil // Start afresh once the mute is over
+	duration := spamMuteBase << record.offences
+	if duration > spamMuteMax || duration <= 0 {
+		duration = spamMuteMax
+	}
+	record.offences++
+	record.lastOffence = now
+	return duration
+}
+
+// checkSpam mutes a client whose message looks like spam, reporting whether the message must be dropped
+func checkSpam(client *Client, text string) bool {
+	if client.can(permKick) {
+		return false // Moderators cannot be muted, as with /mute
+	}
+	now := time.Now()
+	sender := strings.ToLower(client.username)
+	reason := detectSpam(sender, text, now)
+	if reason == "" {
+		return false
+	}
+
+	duration := spamOffence(sender, now)
+	sanction := Sanction{Kind: sanctionMute, Target: client.username, Reason: reason, By: "System", Until: now.Add(duration)}
+	if err := addMute(sanction); err != nil {
+		log.Printf("Error saving automatic mute: %v", err)
+		client.notify("Your message looks like spam and was not sent")
+		return true
+	}
+	writeAudit(AuditEntry{Actor: "System", Action: "mute", Target: client.username, Reason: reason, Duration: duration.String()})
+	for _, target := range onlineClients(client.username) {
+		target.writeJSON(Message{Type: "error", Code: "muted", Username: "System", Room: target.room,
+			Message: fmt.Sprintf("You were muted for %s for %s", duration, reason)})
+	}
+	notifyModerators(permMute, fmt.Sprintf("%s was muted automatically for %s for %s in %s. Use /unmute %s to lift it",
+		client.username, duration, reason, roomName(client.room), client.username))
+	return true
+}
+
+// pruneSpamRecords drops the records of senders without recent messages or offences; the caller holds spamMu
+func pruneSpamRecords(now time.Time) {
+	for sender, record := range spamRecords {
+		last := record.lastOffence.Add(spamMemory)
+		if n := len(record.recent); n > 0 && record.recent[n-1].at.Add(spamWindow).After(last) {
+			last = record.recent[n-1].at.Add(spamWindow)
+		}
+		if now.After(last) {
+			delete(spamRecords, sender)
+		}
+	}
+}
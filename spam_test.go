@@ -0,0 +1,119 @@
+package main
+
+import (
+	"math/bits"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useSpamRecords clears what the spam detector remembers for the duration of a test
+func useSpamRecords(t *testing.T) {
+	original := spamRecords
+	spamRecords = make(map[string]*spamRecord)
+	t.Cleanup(func() { spamRecords = original })
+}
+
+func fingerprintDistance(a, b string) int {
+	return bits.OnesCount64(fingerprint(a) ^ fingerprint(b))
+}
+
+func TestFingerprint(t *testing.T) {
+	assert.Zero(t, fingerprintDistance("Buy cheap watches at my shop", "buy cheap watches at my shop!!!"))
+	assert.LessOrEqual(t, fingerprintDistance("Buy cheap watches at my shop today", "Buy cheap watchez at my shop today"), spamSimilarity)
+	assert.Greater(t, fingerprintDistance("Buy cheap watches at my shop today", "Has anyone seen the new release notes?"), spamSimilarity)
+	assert.Greater(t, fingerprintDistance("see you tomorrow at the standup", "the build is broken on main again"), spamSimilarity)
+}
+
+func TestFingerprintWithoutLetters(t *testing.T) {
+	useSpamRecords(t)
+	now := time.Now()
+	for _, text := range []string{"👍", "😂", "🎉", "?", "🙏", "!!"} {
+		assert.Empty(t, detectSpam("uma", text, now), "Expected different emoji to not count as repeats")
+	}
+	assert.Zero(t, fingerprintDistance("👍 👍", "👍👍"))
+}
+
+func TestCountMentions(t *testing.T) {
+	assert.Equal(t, 2, countMentions("@ann @Bob @ann hello @bot"))
+	assert.Zero(t, countMentions("mail me at home"))
+}
+
+func TestDetectSpam(t *testing.T) {
+	useSpamRecords(t)
+	now := time.Now()
+
+	for i := 0; i < spamRepeatLimit; i++ {
+		assert.Empty(t, detectSpam("zed", "JOIN my server now", now))
+	}
+	assert.Equal(t, "repeated messages", detectSpam("zed", "join my server now!!", now))
+	assert.Empty(t, detectSpam("amy", "join my server now", now), "Expected other senders to be tracked separately")
+
+	// Repeats are forgotten after the window
+	later := now.Add(spamWindow + time.Second)
+	assert.Empty(t, detectSpam("zed", "JOIN my server now", later))
+
+	assert.Equal(t, "mass mentions", detectSpam("yan", "@a @b @c @d @e @f look", now))
+	for i, text := range []string{"@a @b @c @d hi", "@e @f @g @h hey", "@i @j @k @l yo"} {
+		assert.Empty(t, detectSpam("xia", text, now.Add(time.Duration(i)*time.Second)))
+	}
+	assert.Equal(t, "mass mentions", detectSpam("xia", "@m please", now.Add(5*time.Second)), "Expected mentions to add up within the window")
+}
+
+func TestSpamMutesEscalate(t *testing.T) {
+	useSpamRecords(t)
+	now := time.Now()
+	detectSpam("wes", "x", now)
+	assert.Equal(t, spamMuteBase, spamOffence("wes", now))
+	assert.Equal(t, 2*spamMuteBase, spamOffence("wes", now))
+	assert.Equal(t, 4*spamMuteBase, spamOffence("wes", now))
+
+	// Offences are forgotten after a quiet period
+	detectSpam("wes", "x", now.Add(spamMemory+time.Minute))
+	assert.Equal(t, spamMuteBase, spamOffence("wes", now.Add(spamMemory+time.Minute)))
+}
+
+func TestFloodingMutesAndNotifiesModerators(t *testing.T) {
+	useSpamRecords(t)
+	useTempModeration(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	mod := joinTestAccount(t, wsURL, "Vera", roleModerator)
+	flooder := joinTestClient(t, wsURL, "Flo")
+
+	for i := 0; i < spamRepeatLimit; i++ {
+		sendTestMessage(t, flooder, Message{Message: "FREE NITRO at example"})
+		readTestMessage(t, flooder)
+		readTestMessage(t, mod)
+	}
+	sendTestMessage(t, flooder, Message{Message: "free nitro at example!"})
+	msg := readTestMessage(t, flooder)
+	assert.Equal(t, "muted", msg.Code)
+	assert.Equal(t, "You were muted for 1m0s for repeated messages", msg.Message)
+	assert.Equal(t, "Flo was muted automatically for 1m0s for repeated messages in lobby. Use /unmute Flo to lift it", readTestMessage(t, mod).Message)
+
+	sendTestMessage(t, flooder, Message{Message: "something else"})
+	assert.Equal(t, "muted", readTestMessage(t, flooder).Code, "Expected the mute to be enforced")
+
+	entries, err := readAudit(10)
+	assert.NoError(t, err)
+	if assert.Len(t, entries, 1) {
+		assert.Equal(t, "System", entries[0].Actor)
+		assert.Equal(t, "mute", entries[0].Action)
+	}
+}
+
+func TestModeratorsAreNotMutedAutomatically(t *testing.T) {
+	useSpamRecords(t)
+	useTempModeration(t)
+	startTestHub(t)
+	mod := joinTestAccount(t, startTestServer(t), "Walt", roleModerator)
+
+	for i := 0; i <= spamRepeatLimit; i++ {
+		sendTestMessage(t, mod, Message{Message: "Please read the room rules"})
+		assert.Equal(t, "Please read the room rules", readTestMessage(t, mod).Message)
+	}
+	_, muted := moderation.active(sanctionMute, "Walt")
+	assert.False(t, muted)
+}
@@ -1,28 +1,101 @@
 let username;
 const protocol = window.location.protocol === 'https:' ? 'wss' : 'ws';
-const host = window.location.hostname;
-const wsUrl = host === 'localhost'
-    ? `${protocol}://${host}:8080/ws` // Use port 8080 for local development
-    : `${protocol}://${host}/ws`;     // No port for Cloud Run
+const wsUrl = `${protocol}://${window.location.host}/ws`; // Same host and port as the page, wherever it is served
 
-const ws = new WebSocket(wsUrl);
+let ws;
 
-document.addEventListener('DOMContentLoaded', function() {
-    const chat = document.getElementById('chat');
-    const messageInput = document.getElementById('messageInput');
+// Open the WebSocket; the session cookie, if any, identifies the user
+function connect(onOpen) {
+    fetch('/api/session')
+        .then(response => response.json())
+        .then(session => openSocket(session.csrf_token, onOpen))
+        .catch(error => console.error("Session check failed:", error));
+}
+
+// Logged-in users prove the socket is opened by our page with the CSRF token of their session
+function openSocket(csrfToken, onOpen) {
     const usernameModal = document.getElementById('usernameModal');
-    const usernameInput = document.getElementById('usernameInput');
-    const joinChatButton = document.getElementById('joinChatButton');
-    const fontSelect = document.getElementById('fontSelect');
-    let selectedFont = fontSelect.value;
+    ws = new WebSocket(csrfToken ? `${wsUrl}?csrf=${encodeURIComponent(csrfToken)}` : wsUrl);
 
     ws.onopen = function() {
         console.log("WebSocket connection established");
+        away = false; // New connections start online
+        if (onOpen) {
+            onOpen();
+        }
     };
 
     ws.onmessage = function(event) {
         const message = JSON.parse(event.data);
+
+        // The server tells us which username it bound to this connection
+        if (message.type === 'joined') {
+            username = message.username;
+            return;
+        }
+        if (message.type === 'error' && message.code && message.code.startsWith('username_')) {
+            username = undefined;
+            alert(message.message);
+            usernameModal.style.display = 'flex';
+            return;
+        }
+        // Typing indicators are shown below the chat, not in it
+        if (message.type === 'typing_start' || message.type === 'typing_stop') {
+            setTyping(message.username, message.type === 'typing_start');
+            return;
+        }
+        if (!message.type) {
+            setTyping(message.username, false); // A message ends the typing of its sender
+        }
+
+        // Edits and deletions replace a message already shown
+        if (message.type === 'edit' || message.type === 'delete') {
+            updateMessage(message);
+            return;
+        }
+        // Thread summaries are kept under the first message of a thread
+        if (message.type === 'thread' || message.type === 'subscribed') {
+            if (message.type === 'subscribed') {
+                followed.add(message.id);
+            }
+            renderThread(message.id, message.thread);
+            return;
+        }
+        if (message.type === 'unsubscribed') {
+            followed.delete(message.id);
+            renderThread(message.id);
+            return;
+        }
+        if (message.type === 'reaction') {
+            const reactions = document.querySelector(`#chat [data-id="${message.id}"] .reactions`);
+            if (reactions) {
+                message.reactions.forEach(reaction => renderReaction(reactions, message.id, reaction));
+            }
+            return;
+        }
+
         const messageElement = document.createElement('div');
+
+        // Users joining, leaving or going away are shown as a line of their own
+        if (message.type === 'presence') {
+            messageElement.classList.add('presence-message');
+            messageElement.textContent = message.message;
+            appendToChat(messageElement);
+            return;
+        }
+        if (message.type === 'read') {
+            showReceipt(message.username, message.id);
+            return;
+        }
+        if (message.type === 'unread') {
+            const counts = Object.entries(message.unread).filter(([, count]) => count > 0);
+            if (counts.length > 0) {
+                messageElement.classList.add('presence-message');
+                messageElement.textContent = 'Unread messages: ' + counts.map(([room, count]) => `${room} (${count})`).join(', ');
+                appendToChat(messageElement);
+            }
+            return;
+        }
     
         // Add class based on message sender
         if (message.username === 'Bot') {
@@ -30,14 +103,43 @@ document.addEventListener('DOMContentLoaded', function() {
         } else {
             messageElement.classList.add('user-message');
         }
+        if (message.private) {
+            messageElement.classList.add('private-message');
+        }
+        if (message.id) {
+            messageElement.dataset.id = message.id;
+        }
     
-        // Set message content
-        messageElement.innerHTML = `<strong>${message.username}:</strong> ${message.message.replace(/\n/g, '<br>')}`;
-        document.getElementById('chat').appendChild(messageElement);
-    
-        // Scroll to the latest message
-        const chat = document.getElementById('chat');
-        chat.scrollTop = chat.scrollHeight;
+        if (message.parent_id) {
+            messageElement.classList.add('reply-message');
+            messageElement.dataset.parentId = message.parent_id;
+            const context = document.createElement('div');
+            context.classList.add('reply-context');
+            const parent = document.querySelector(`#chat [data-id="${message.parent_id}"] > strong`);
+            context.textContent = parent ? `↪ Reply to ${parent.textContent.slice(0, -1)}` : `↪ Reply in ${message.room}`;
+            messageElement.appendChild(context);
+        }
+        const sender = document.createElement('strong');
+        sender.textContent = `${message.username}:`;
+        messageElement.appendChild(sender);
+        const body = document.createElement('span');
+        body.classList.add('message-body');
+        messageElement.appendChild(body);
+        renderBody(body, message);
+        if (message.id && !message.deleted) {
+            messageElement.appendChild(messageActions(message.id, message.username === username));
+            const reactions = document.createElement('div');
+            reactions.classList.add('reactions');
+            messageElement.appendChild(reactions);
+            (message.reactions || []).forEach(reaction => renderReaction(reactions, message.id, reaction));
+        }
+        appendToChat(messageElement);
+        if (message.thread) {
+            renderThread(message.id, message.thread);
+        }
+        if (message.id) {
+            markRead(message.id);
+        }
     };
 
     ws.onerror = function(error) {
@@ -47,16 +149,330 @@ document.addEventListener('DOMContentLoaded', function() {
     ws.onclose = function() {
         console.log("WebSocket connection closed");
     };
+}
+
+// The text of a message is never parsed as HTML; only the html field, which the
+// server renders from Markdown and escapes, is
+function renderBody(body, message) {
+    body.replaceChildren();
+    body.classList.toggle('deleted-message', !!message.deleted);
+    if (message.deleted) {
+        body.textContent = ' Message deleted';
+        return;
+    }
+    if (message.html) {
+        const formatted = document.createElement('div');
+        formatted.classList.add('formatted-message');
+        formatted.innerHTML = message.html;
+        body.appendChild(formatted);
+    } else {
+        body.appendChild(document.createTextNode(` ${message.message}`));
+    }
+    if (message.edited) {
+        const edited = document.createElement('span');
+        edited.classList.add('edited-marker');
+        edited.textContent = ' (edited)';
+        body.appendChild(edited);
+    }
+}
+
+function updateMessage(message) {
+    const element = document.querySelector(`#chat [data-id="${message.id}"]`);
+    if (!element) {
+        return;
+    }
+    renderBody(element.querySelector('.message-body'), message);
+    if (message.deleted) {
+        element.querySelectorAll('.message-actions, .reactions').forEach(child => child.remove());
+    }
+}
+
+// Everyone may react to a message. Authors may also edit or delete it for a while after
+// sending it; the server enforces the window.
+const quickReactions = ['👍', '❤️', '😂', '🎉', '😮', '😢'];
+
+function messageActions(id, own) {
+    const actions = document.createElement('span');
+    actions.classList.add('message-actions');
+    const reply = document.createElement('button');
+    reply.textContent = 'Reply';
+    reply.addEventListener('click', () => startReply(id));
+    actions.appendChild(reply);
+    quickReactions.forEach(emoji => {
+        const button = document.createElement('button');
+        button.textContent = emoji;
+        button.addEventListener('click', () => react(id, emoji));
+        actions.appendChild(button);
+    });
+    if (!own) {
+        return actions;
+    }
+    const edit = document.createElement('button');
+    edit.textContent = 'Edit';
+    edit.addEventListener('click', function() {
+        const element = document.querySelector(`#chat [data-id="${id}"] .message-body`);
+        const text = prompt('Edit message', element ? element.textContent.replace(/ \(edited\)$/, '').trim() : '');
+        if (text !== null && text.trim() !== '') {
+            ws.send(JSON.stringify({ type: "edit", id: id, message: text }));
+        }
+    });
+    const remove = document.createElement('button');
+    remove.textContent = 'Delete';
+    remove.addEventListener('click', function() {
+        if (confirm('Delete this message?')) {
+            ws.send(JSON.stringify({ type: "delete", id: id }));
+        }
+    });
+    actions.append(edit, remove);
+    return actions;
+}
+
+function react(id, emoji) {
+    if (ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: "react", id: id, emoji: emoji }));
+    }
+}
+
+// Show the count of one emoji under a message; clicking it toggles our own reaction
+function renderReaction(container, id, reaction) {
+    let button = Array.from(container.children).find(child => child.dataset.emoji === reaction.emoji);
+    if (reaction.count === 0) {
+        if (button) {
+            button.remove();
+        }
+        return;
+    }
+    if (!button) {
+        button = document.createElement('button');
+        button.dataset.emoji = reaction.emoji;
+        button.addEventListener('click', () => react(id, reaction.emoji));
+        container.appendChild(button);
+    }
+    button.textContent = `${reaction.emoji} ${reaction.count}`;
+    button.title = reaction.users.join(', ');
+    button.classList.toggle('mine', reaction.users.includes(username));
+}
+
+// Threads: replies carry the ID of the message they answer, and the first message of a thread
+// shows how many replies it has. Followed threads keep sending replies after we switch rooms.
+let replyTo = 0;
+const followed = new Set();
+
+function startReply(id) {
+    // Replies to a reply continue its thread
+    const element = document.querySelector(`#chat [data-id="${id}"]`);
+    replyTo = Number(element && element.dataset.parentId) || id;
+    const parent = document.querySelector(`#chat [data-id="${replyTo}"] > strong`);
+    document.getElementById('replyText').textContent = parent ? `Replying to ${parent.textContent.slice(0, -1)}` : 'Replying in thread';
+    document.getElementById('replyBar').style.display = 'flex';
+    document.getElementById('messageInput').focus();
+}
+
+function cancelReply() {
+    replyTo = 0;
+    document.getElementById('replyBar').style.display = 'none';
+}
+
+function renderThread(id, thread) {
+    const element = document.querySelector(`#chat [data-id="${id}"]`);
+    if (!element) {
+        return;
+    }
+    let summary = element.querySelector('.thread-summary');
+    if (!summary) {
+        summary = document.createElement('div');
+        summary.classList.add('thread-summary');
+        const text = document.createElement('span');
+        const follow = document.createElement('button');
+        follow.addEventListener('click', function() {
+            if (ws && ws.readyState === WebSocket.OPEN) {
+                ws.send(JSON.stringify({ type: followed.has(id) ? "unsubscribe" : "subscribe", id: id }));
+            }
+        });
+        summary.append(text, follow);
+        element.appendChild(summary);
+    }
+    if (thread) {
+        const replies = thread.reply_count === 1 ? '1 reply' : `${thread.reply_count} replies`;
+        const last = new Date(thread.last_reply).toLocaleTimeString([], { hour: '2-digit', minute: '2-digit' });
+        summary.firstChild.textContent = `${replies} · last at ${last} · ${thread.participants.join(', ')}`;
+    }
+    summary.lastChild.textContent = followed.has(id) ? 'Unfollow' : 'Follow';
+}
+
+// Add a line to the chat and scroll to it
+function appendToChat(element) {
+    const chat = document.getElementById('chat');
+    chat.appendChild(element);
+    chat.scrollTop = chat.scrollHeight;
+}
+
+// Read receipts: we report the last message shown while the page is visible, and show
+// under each message who has read up to it
+let lastShownId = 0;
+let lastReadId = 0;
+let readTimer;
+const seenBy = new Map();
+
+function markRead(id) {
+    lastShownId = Math.max(lastShownId, id);
+    if (document.hidden || lastShownId <= lastReadId) {
+        return;
+    }
+    clearTimeout(readTimer);
+    readTimer = setTimeout(() => {
+        if (ws && ws.readyState === WebSocket.OPEN && lastShownId > lastReadId) {
+            lastReadId = lastShownId;
+            ws.send(JSON.stringify({ type: "read", id: lastReadId }));
+        }
+    }, 1000);
+}
+
+function showReceipt(name, id) {
+    const previous = seenBy.get(name);
+    seenBy.set(name, id);
+    [previous, id].forEach(messageId => {
+        const element = messageId && document.querySelector(`#chat [data-id="${messageId}"]`);
+        if (!element) {
+            return;
+        }
+        let receipts = element.querySelector('.receipts');
+        if (!receipts) {
+            receipts = document.createElement('div');
+            receipts.classList.add('receipts');
+            element.appendChild(receipts);
+        }
+        const names = Array.from(seenBy.entries()).filter(([, seen]) => seen === messageId).map(([reader]) => reader);
+        receipts.textContent = names.length > 0 ? `Seen by ${names.join(', ')}` : '';
+    });
+}
+
+// Users typing in the room, with the timer that hides them if their typing_stop is lost
+const typers = new Map();
+const typingDisplayTimeout = 8000;
+
+function setTyping(name, isTyping) {
+    clearTimeout(typers.get(name));
+    typers.delete(name);
+    if (isTyping) {
+        typers.set(name, setTimeout(() => setTyping(name, false), typingDisplayTimeout));
+    }
+    const names = Array.from(typers.keys());
+    let text = '';
+    if (names.length === 1) {
+        text = `${names[0]} is typing…`;
+    } else if (names.length === 2) {
+        text = `${names[0]} and ${names[1]} are typing…`;
+    } else if (names.length > 2) {
+        text = 'Several people are typing…';
+    }
+    document.getElementById('typingIndicator').textContent = text;
+}
+
+// Tell the room we are typing: a typing_start every few seconds while keys are pressed,
+// and a typing_stop once the user pauses
+const typingRepeat = 3000;
+const typingPause = 4000;
+let lastTypingStart = 0;
+let typingStopTimer;
+
+function userTyping() {
+    if (!username || !ws || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    if (Date.now() - lastTypingStart > typingRepeat) {
+        lastTypingStart = Date.now();
+        ws.send(JSON.stringify({ type: "typing_start" }));
+    }
+    clearTimeout(typingStopTimer);
+    typingStopTimer = setTimeout(userStoppedTyping, typingPause);
+}
+
+function userStoppedTyping() {
+    clearTimeout(typingStopTimer);
+    if (lastTypingStart && ws && ws.readyState === WebSocket.OPEN) {
+        ws.send(JSON.stringify({ type: "typing_stop" }));
+    }
+    lastTypingStart = 0;
+}
+
+// Tell the server when the user stops using the page, so others see them as away
+const idleTimeout = 5 * 60 * 1000;
+let idleTimer;
+let away = false;
+
+function reportPresence(isAway) {
+    if (away === isAway || !username || !ws || ws.readyState !== WebSocket.OPEN) {
+        return;
+    }
+    away = isAway;
+    ws.send(JSON.stringify({ type: "presence", status: isAway ? "away" : "online" }));
+}
+
+function userActive() {
+    reportPresence(false);
+    clearTimeout(idleTimer);
+    idleTimer = setTimeout(() => reportPresence(true), idleTimeout);
+}
+
+['keydown', 'mousemove', 'mousedown', 'touchstart'].forEach(event => document.addEventListener(event, userActive, { passive: true }));
+document.addEventListener('visibilitychange', function() {
+    if (document.hidden) {
+        reportPresence(true);
+    } else {
+        userActive();
+        markRead(lastShownId);
+    }
+});
+
+document.addEventListener('DOMContentLoaded', function() {
+    const messageInput = document.getElementById('messageInput');
+    const usernameModal = document.getElementById('usernameModal');
+    const usernameInput = document.getElementById('usernameInput');
+    const passwordInput = document.getElementById('passwordInput');
+    const joinChatButton = document.getElementById('joinChatButton');
+    const loginButton = document.getElementById('loginButton');
+    const registerButton = document.getElementById('registerButton');
+    const ssoButton = document.getElementById('ssoButton');
+    const sendButton = document.getElementById('sendButton');
+    const resetSessionButton = document.getElementById('resetSessionButton');
+    const fontSelect = document.getElementById('fontSelect');
+    let selectedFont = fontSelect.value;
 
     joinChatButton.addEventListener('click', function() {
         setUsername(usernameInput.value.trim());
     });
 
+    loginButton.addEventListener('click', function() {
+        authenticate('/api/login', usernameInput.value.trim(), passwordInput.value);
+    });
+
+    registerButton.addEventListener('click', function() {
+        authenticate('/api/register', usernameInput.value.trim(), passwordInput.value);
+    });
+
+    ssoButton.addEventListener('click', function() {
+        window.location.href = '/auth/login';
+    });
+
+    // Handlers are attached here because the Content-Security-Policy forbids inline ones
+    sendButton.addEventListener('click', sendMessage);
+    resetSessionButton.addEventListener('click', resetSession);
+    document.getElementById('cancelReplyButton').addEventListener('click', cancelReply);
+
     fontSelect.addEventListener('change', function() {
         selectedFont = fontSelect.value;
         console.log("Selected font:", selectedFont);
     });
 
+    messageInput.addEventListener('input', function() {
+        if (messageInput.value) {
+            userTyping();
+        } else {
+            userStoppedTyping();
+        }
+    });
+
     // Handle keypress events for the textarea
     messageInput.addEventListener('keydown', function(event) {
         if (event.key === 'Enter' && !event.shiftKey) {
@@ -65,10 +481,52 @@ document.addEventListener('DOMContentLoaded', function() {
         }
     });
 
-    // Show modal on load
-    usernameModal.style.display = 'flex';
+    // Reuse an existing login, otherwise show the modal
+    fetch('/api/session')
+        .then(response => response.json())
+        .then(session => {
+            if (!session.guest_mode) {
+                joinChatButton.style.display = 'none';
+            }
+            if (session.sso) {
+                ssoButton.style.display = 'inline-block';
+            }
+            if (session.sso_required) {
+                // Only single sign-on is accepted
+                [usernameInput, passwordInput, loginButton, registerButton].forEach(el => el.style.display = 'none');
+            }
+            if (session.username) {
+                usernameModal.style.display = 'none';
+                openSocket(session.csrf_token);
+            } else {
+                usernameModal.style.display = 'flex';
+            }
+        })
+        .catch(error => {
+            console.error("Session check failed:", error);
+            usernameModal.style.display = 'flex';
+        });
 });
 
+// Log in or register, then connect with the new session cookie
+function authenticate(endpoint, name, password) {
+    fetch(endpoint, {
+        method: 'POST',
+        headers: { 'Content-Type': 'application/json' },
+        body: JSON.stringify({ username: name, password: password })
+    })
+        .then(response => response.json().then(body => ({ ok: response.ok, body: body })))
+        .then(result => {
+            if (!result.ok) {
+                alert(result.body.error);
+                return;
+            }
+            document.getElementById('usernameModal').style.display = 'none';
+            connect();
+        })
+        .catch(error => console.error("Authentication failed:", error));
+}
+
 function sendMessage() {
     const messageInput = document.getElementById('messageInput');
     if (!username) {
@@ -79,9 +537,15 @@ function sendMessage() {
         username: username,
         message: messageInput.value
     };
+    if (replyTo) {
+        message.parent_id = replyTo;
+        cancelReply();
+    }
     console.log("Sending message:", message);
     ws.send(JSON.stringify(message));
     messageInput.value = '';
+    clearTimeout(typingStopTimer); // The server ends typing when the message arrives
+    lastTypingStart = 0;
 }
 
 function setUsername(name) {
@@ -90,16 +554,21 @@ function setUsername(name) {
         const usernameModal = document.getElementById('usernameModal');
         usernameModal.style.display = 'none';
         console.log("Username set to:", username);
-        ws.send(JSON.stringify({ username: username, message: "joined" }));
+        const join = () => ws.send(JSON.stringify({ type: "join", username: username }));
+        if (ws && ws.readyState === WebSocket.OPEN) {
+            join();
+        } else {
+            connect(join);
+        }
     } else {
         alert("Username cannot be empty");
     }
 }
 
 function resetSession() {
-    if (ws.readyState === WebSocket.OPEN) {
+    if (ws && ws.readyState === WebSocket.OPEN) {
         const resetMessage = {
-            username: "System",
+            username: username,
             message: "/reset"
         };
         ws.send(JSON.stringify(resetMessage));
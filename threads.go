@@ -0,0 +1,162 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const maxThreadSubscriptions = 50 // Threads one connection may follow
+
+// Thread summarizes the replies to a message
+type Thread struct {
+	ReplyCount   int      `json:"reply_count"`
+	LastReply    int64    `json:"last_reply"`   // When the latest reply was sent, in Unix milliseconds
+	Participants []string `json:"participants"` // Users who replied, in the order they joined the thread
+}
+
+// findLocked returns the position of a message in the history of a room; the caller holds h.mu
+func (h *historyStore) findLocked(room string, id int64) (int, bool) {
+	stored := h.Rooms[room]
+	i := sort.Search(len(stored), func(i int) bool { return stored[i].ID >= id })
+	return i, i < len(stored) && stored[i].ID == id
+}
+
+// find returns a copy of a message of a room
+func (h *historyStore) find(room string, id int64) (Message, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	room = roomName(room)
+	i, found := h.findLocked(room, id)
+	if !found {
+		return Message{}, false
+	}
+	return *h.Rooms[room][i], true
+}
+
+// addReplyLocked updates the thread of the parent of a reply; the caller holds h.mu.
+// The thread is replaced rather than changed, as copies of the parent share it.
+func (h *historyStore) addReplyLocked(reply *Message) {
+	i, found := h.findLocked(reply.Room, reply.ParentID)
+	if !found {
+		return // Trimmed from the history
+	}
+	parent := *h.Rooms[reply.Room][i]
+	thread := Thread{LastReply: reply.Time}
+	if parent.Thread != nil {
+		thread.ReplyCount = parent.Thread.ReplyCount
+		thread.Participants = parent.Thread.Participants
+	}
+	thread.ReplyCount++
+	thread.Participants = append([]string(nil), thread.Participants...)
+	joined := false
+	for _, user := range thread.Participants {
+		joined = joined || strings.EqualFold(user, reply.Username)
+	}
+	if !joined {
+		thread.Participants = append(thread.Participants, reply.Username)
+	}
+	parent.Thread = &thread
+	h.Rooms[reply.Room][i] = &parent
+}
+
+// replies returns copies of the replies to a message, oldest first
+func (h *historyStore) replies(room string, id int64) []Message {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	replies := []Message{}
+	for _, msg := range h.Rooms[roomName(room)] {
+		if msg.ParentID == id {
+			replies = append(replies, *msg)
+		}
+	}
+	return replies
+}
+
+// threadRoot returns the message a reply to id belongs under. Threads are one level deep,
+// so replying to a reply continues the thread of its parent.
+func threadRoot(room string, id int64) (int64, bool) {
+	parent, found := history.find(room, id)
+	if !found || parent.Deleted {
+		return 0, false
+	}
+	if parent.ParentID != 0 {
+		return parent.ParentID, true
+	}
+	return parent.ID, true
+}
+
+// threadOf returns the thread a frame belongs to, or 0. Replies and changes to them belong to the
+// thread of their parent; changes to the first message of a thread belong to that thread.
+func threadOf(msg Message) int64 {
+	switch {
+	case msg.ParentID != 0:
+		return msg.ParentID
+	case msg.Type == "thread" || msg.Type == "edit" || msg.Type == "delete" || msg.Type == "reaction":
+		return msg.ID
+	}
+	return 0
+}
+
+// followsLocked reports whether a client follows the thread of a frame from outside its room; the caller holds clientsMu
+func (c *Client) followsLocked(msg Message) bool {
+	id := threadOf(msg)
+	return id != 0 && c.threads[id]
+}
+
+// threadFrame describes the thread of a message to the room and its followers
+func threadFrame(parent Message) Message {
+	return Message{Type: "thread", ID: parent.ID, Username: parent.Username, Room: parent.Room, Thread: parent.Thread}
+}
+
+// followThread handles subscribe and unsubscribe frames. Followers get the replies of a thread,
+// and changes to it, whichever room they are in.
+func followThread(client *Client, msg Message) {
+	room := client.room
+	if msg.Room != "" {
+		room = msg.Room
+	}
+	if msg.Type == "unsubscribe" {
+		clientsMu.Lock()
+		delete(client.threads, msg.ID)
+		clientsMu.Unlock()
+		client.writeJSON(Message{Type: "unsubscribed", Username: "System", ID: msg.ID, Room: roomName(room)})
+		return
+	}
+
+	parent, found := history.find(room, msg.ID)
+	if !found || parent.Deleted || parent.ParentID != 0 {
+		client.writeJSON(Message{Type: "error", Code: "thread_not_found", Username: "System", Message: "There is no such thread in this room", Room: client.room})
+		return
+	}
+	clientsMu.Lock()
+	if len(client.threads) >= maxThreadSubscriptions && !client.threads[parent.ID] {
+		clientsMu.Unlock()
+		client.writeJSON(Message{Type: "error", Code: "too_many_subscriptions", Username: "System", Message: "You follow too many threads", Room: client.room})
+		return
+	}
+	if client.threads == nil {
+		client.threads = make(map[int64]bool)
+	}
+	client.threads[parent.ID] = true
+	clientsMu.Unlock()
+	ack := threadFrame(parent)
+	ack.Type = "subscribed"
+	client.writeJSON(ack)
+}
+
+// handleRoomThread returns a message of a room with its replies
+func handleRoomThread(w http.ResponseWriter, r *http.Request, room, id string) {
+	parentID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		writeJSONError(w, http.StatusNotFound, "thread not found")
+		return
+	}
+	parent, found := history.find(room, parentID)
+	if !found || parent.ParentID != 0 {
+		writeJSONError(w, http.StatusNotFound, "thread not found")
+		return
+	}
+	writeJSONResponse(w, http.StatusOK, map[string]interface{}{"parent": parent, "replies": history.replies(room, parentID)})
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepliesUpdateTheirThread(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	ivy := joinTestClient(t, wsURL, "Ivy")
+	jack := joinTestClient(t, wsURL, "Jack")
+	sendTestMessage(t, ivy, Message{Message: "Lunch at noon?"})
+	parent := readTestMessage(t, jack)
+	readTestMessage(t, ivy)
+
+	sendTestMessage(t, jack, Message{Message: "Sure", ParentID: parent.ID})
+	reply := readTestMessage(t, ivy)
+	assert.Equal(t, "Sure", reply.Message)
+	assert.Equal(t, parent.ID, reply.ParentID)
+	summary := readTestMessage(t, ivy)
+	assert.Equal(t, Message{Type: "thread", ID: parent.ID, Username: "Ivy", Room: lobbyRoom, Thread: &Thread{ReplyCount: 1, LastReply: reply.Time, Participants: []string{"Jack"}}}, summary)
+	readTestMessage(t, jack)
+	readTestMessage(t, jack)
+
+	// Replying to a reply continues the same thread
+	sendTestMessage(t, ivy, Message{Message: "Great", ParentID: reply.ID})
+	assert.Equal(t, parent.ID, readTestMessage(t, jack).ParentID)
+	summary = readTestMessage(t, jack)
+	assert.Equal(t, 2, summary.Thread.ReplyCount)
+	assert.Equal(t, []string{"Jack", "Ivy"}, summary.Thread.Participants)
+
+	sendTestMessage(t, ivy, Message{Message: "Lost", ParentID: 999})
+	readTestMessage(t, ivy)
+	readTestMessage(t, ivy)
+	assert.Equal(t, "thread_not_found", readTestMessage(t, ivy).Code)
+
+	stored, _ := history.find(lobbyRoom, parent.ID)
+	assert.Equal(t, 2, stored.Thread.ReplyCount, "Expected the history to carry the thread")
+}
+
+func TestThreadSubscriptionsReachOtherRooms(t *testing.T) {
+	useTempAccounts(t)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	kate := joinTestAccount(t, wsURL, "Kate")
+	leo := joinTestClient(t, wsURL, "Leo")
+	sendTestMessage(t, leo, Message{Message: "Deploy thread"})
+	parent := readTestMessage(t, kate)
+	readTestMessage(t, leo)
+
+	sendTestMessage(t, kate, Message{Type: "subscribe", ID: parent.ID})
+	ack := readTestMessage(t, kate)
+	assert.Equal(t, "subscribed", ack.Type)
+	assert.Equal(t, parent.ID, ack.ID)
+	sendTestMessage(t, kate, Message{Message: "/join ops"})
+	assert.Equal(t, "You joined ops", readTestMessage(t, kate).Message)
+
+	// Kate left the lobby but still follows the thread, and nothing else of the room
+	sendTestMessage(t, leo, Message{Message: "Not in the thread"})
+	sendTestMessage(t, leo, Message{Message: "Deployed", ParentID: parent.ID})
+	reply := readTestMessage(t, kate)
+	assert.Equal(t, "Deployed", reply.Message)
+	assert.Equal(t, lobbyRoom, reply.Room)
+	assert.Equal(t, "thread", readTestMessage(t, kate).Type)
+
+	sendTestMessage(t, leo, Message{Type: "react", ID: reply.ID, Emoji: "👍"})
+	assert.Equal(t, "reaction", readTestMessage(t, kate).Type, "Expected changes to replies to reach followers")
+
+	sendTestMessage(t, kate, Message{Type: "unsubscribe", ID: parent.ID})
+	assert.Equal(t, "unsubscribed", readTestMessage(t, kate).Type)
+	sendTestMessage(t, leo, Message{Message: "Rolled back", ParentID: parent.ID})
+	sendTestMessage(t, kate, Message{Message: "still here"})
+	assert.Equal(t, "still here", readTestMessage(t, kate).Message, "Expected no replies after unsubscribing")
+
+	sendTestMessage(t, kate, Message{Type: "subscribe", ID: reply.ID, Room: lobbyRoom})
+	assert.Equal(t, "thread_not_found", readTestMessage(t, kate).Code, "Expected replies to not start threads")
+}
+
+func TestThreadEndpoint(t *testing.T) {
+	startTestHub(t)
+	parent := history.record(Message{Username: "Mia", Message: "Question", Room: lobbyRoom})
+	history.record(Message{Username: "Ned", Message: "Unrelated", Room: lobbyRoom})
+	reply := history.record(Message{Username: "Ned", Message: "Answer", Room: lobbyRoom, ParentID: parent.ID})
+
+	w := httptest.NewRecorder()
+	handleRooms(w, httptest.NewRequest(http.MethodGet, "/api/rooms/lobby/threads/1", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+	var thread struct {
+		Parent  Message   `json:"parent"`
+		Replies []Message `json:"replies"`
+	}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &thread))
+	assert.Equal(t, &Thread{ReplyCount: 1, LastReply: reply.Time, Participants: []string{"Ned"}}, thread.Parent.Thread)
+	if assert.Len(t, thread.Replies, 1) {
+		assert.Equal(t, "Answer", thread.Replies[0].Message)
+	}
+
+	for _, path := range []string{"/api/rooms/lobby/threads/3", "/api/rooms/lobby/threads/x", "/api/rooms/lobby/threads", "/api/rooms/lobby/messages/1"} {
+		w = httptest.NewRecorder()
+		handleRooms(w, httptest.NewRequest(http.MethodGet, path, nil))
+		assert.Equal(t, http.StatusNotFound, w.Code, path)
+	}
+}
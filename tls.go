@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Native TLS, for deployments without a proxy terminating it in front of the server
+var (
+	tlsCertFile           = envString("TLS_CERT_FILE", "")
+	tlsKeyFile            = envString("TLS_KEY_FILE", "")
+	tlsReloadInterval     = envDuration("TLS_RELOAD_INTERVAL", 30*time.Second) // How often the files are checked for changes
+	tlsRedirectPort       = envString("TLS_REDIRECT_PORT", "")                 // Plain HTTP port redirecting to HTTPS, e.g. "80"
+	tlsClientCAFile       = envString("TLS_CLIENT_CA_FILE", "")                // CA of the client certificates required by the admin endpoints
+	hstsMaxAge            = envDuration("HSTS_MAX_AGE", 180*24*time.Hour)
+	hstsIncludeSubdomains = envBool("HSTS_INCLUDE_SUBDOMAINS", false)
+)
+
+func tlsEnabled() bool {
+	return tlsCertFile != "" || tlsKeyFile != ""
+}
+
+// certReloader serves a certificate and its key, loading them again when either file changes
+type certReloader struct {
+	certPath string
+	keyPath  string
+
+	mu       sync.Mutex
+	cert     *tls.Certificate
+	modTimes [2]time.Time
+}
+
+func newCertReloader(certPath, keyPath string) (*certReloader, error) {
+	reloader := &certReloader{certPath: certPath, keyPath: keyPath}
+	if _, err := reloader.reloadIfChanged(); err != nil {
+		return nil, err
+	}
+	return reloader, nil
+}
+
+// reloadIfChanged loads the files again if they were modified, reporting whether it did.
+// On error the previous certificate is kept.
+func (c *certReloader) reloadIfChanged() (bool, error) {
+	var modTimes [2]time.Time
+	for i, path := range []string{c.certPath, c.keyPath} {
+		info, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != nil && modTimes == c.modTimes {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certPath, c.keyPath)
+	if err != nil {
+		return false, err
+	}
+	c.cert, c.modTimes = &cert, modTimes
+	return true, nil
+}
+
+// GetCertificate is used as the tls.Config callback, so every handshake gets the current certificate
+func (c *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cert, nil
+}
+
+// watch checks the files for changes until the process ends
+func (c *certReloader) watch(interval time.Duration) {
+	for range time.Tick(interval) {
+		reloaded, err := c.reloadIfChanged()
+		if err != nil {
+			log.Printf("Error reloading TLS certificate, keeping the previous one: %v", err)
+		} else if reloaded {
+			log.Printf("Reloaded TLS certificate from %s", c.certPath)
+		}
+	}
+}
+
+// newTLSConfig prepares the server side of TLS. With a client CA, browsers and tools may
+// present a client certificate, which requireClientCert then checks on the admin endpoints.
+func newTLSConfig(reloader *certReloader, clientCAFile string) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12, GetCertificate: reloader.GetCertificate}
+	if clientCAFile != "" {
+		pem, err := os.ReadFile(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("%s: no certificates found", clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return config, nil
+}
+
+// requireClientCert refuses requests without a verified client certificate when mutual TLS is configured
+func requireClientCert(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tlsClientCAFile != "" && (r.TLS == nil || len(r.TLS.VerifiedChains) == 0) {
+			writeJSONError(w, http.StatusForbidden, "client certificate required")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// withHSTS tells browsers to only use HTTPS for this host from now on
+func withHSTS(next http.Handler) http.Handler {
+	value := "max-age=" + strconv.Itoa(int(hstsMaxAge.Seconds()))
+	if hstsIncludeSubdomains {
+		value += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil && hstsMaxAge > 0 {
+			w.Header().Set("Strict-Transport-Security", value)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// redirectToHTTPS sends plain HTTP requests to the same URL on the HTTPS port
+func redirectToHTTPS(httpsPort string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	}
+}
+
+// serveTLS serves HTTPS with the configured certificate, and the redirect from HTTP if enabled
+func serveTLS(server *http.Server, port string) error {
+	if tlsCertFile == "" || tlsKeyFile == "" {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must both be set")
+	}
+	reloader, err := newCertReloader(tlsCertFile, tlsKeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %v", err)
+	}
+	server.TLSConfig, err = newTLSConfig(reloader, tlsClientCAFile)
+	if err != nil {
+		return fmt.Errorf("loading client CA: %v", err)
+	}
+	go reloader.watch(tlsReloadInterval)
+
+	if tlsRedirectPort != "" {
+		go func() {
+			log.Println("Redirecting HTTP to HTTPS on port:", tlsRedirectPort)
+			redirect := &http.Server{Addr: ":" + tlsRedirectPort, Handler: redirectToHTTPS(port), ReadHeaderTimeout: 10 * time.Second}
+			log.Fatalf("Error serving HTTP redirect: %v", redirect.ListenAndServe())
+		}()
+	}
+	return server.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testCert is a generated certificate with its key
+type testCert struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// generateTestCert creates a certificate for localhost, self-signed when parent is nil
+func generateTestCert(t *testing.T, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Minute),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	if isCA {
+		template.IsCA, template.BasicConstraintsValid = true, true
+		template.KeyUsage |= x509.KeyUsageCertSign
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDER, _ := x509.MarshalECPrivateKey(key)
+	return &testCert{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// writeTestCert writes a certificate and its key, dated so reloads see a change
+func writeTestCert(t *testing.T, dir string, cert *testCert, modTime time.Time) (string, string) {
+	certPath, keyPath := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	for path, data := range map[string][]byte{certPath: cert.certPEM, keyPath: cert.keyPEM} {
+		if err := os.WriteFile(path, data, 0600); err != nil {
+			t.Fatalf("Failed to write %s: %v", path, err)
+		}
+		os.Chtimes(path, modTime, modTime)
+	}
+	return certPath, keyPath
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	cert, _ := tls.X509KeyPair(c.certPEM, c.keyPEM)
+	return cert
+}
+
+func TestCertReloadOnFileChange(t *testing.T) {
+	dir := t.TempDir()
+	first := generateTestCert(t, "first", nil, false)
+	certPath, keyPath := writeTestCert(t, dir, first, time.Now().Add(-time.Hour))
+	reloader, err := newCertReloader(certPath, keyPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	served := func() string {
+		cert, err := reloader.GetCertificate(nil)
+		assert.NoError(t, err)
+		leaf, _ := x509.ParseCertificate(cert.Certificate[0])
+		return leaf.Subject.CommonName
+	}
+	assert.Equal(t, "first", served())
+
+	reloaded, err := reloader.reloadIfChanged()
+	assert.NoError(t, err)
+	assert.False(t, reloaded, "Expected unchanged files to be kept")
+
+	writeTestCert(t, dir, generateTestCert(t, "second", nil, false), time.Now())
+	reloaded, err = reloader.reloadIfChanged()
+	assert.NoError(t, err)
+	assert.True(t, reloaded)
+	assert.Equal(t, "second", served())
+
+	// A broken file keeps the previous certificate
+	assert.NoError(t, os.WriteFile(keyPath, []byte("garbage"), 0600))
+	os.Chtimes(keyPath, time.Now().Add(time.Minute), time.Now().Add(time.Minute))
+	_, err = reloader.reloadIfChanged()
+	assert.Error(t, err)
+	assert.Equal(t, "second", served())
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	w := httptest.NewRecorder()
+	redirectToHTTPS("443")(w, httptest.NewRequest(http.MethodGet, "http://chat.example.com:80/static/app.js?v=2", nil))
+	assert.Equal(t, http.StatusMovedPermanently, w.Code)
+	assert.Equal(t, "https://chat.example.com/static/app.js?v=2", w.Header().Get("Location"))
+
+	w = httptest.NewRecorder()
+	redirectToHTTPS("8443")(w, httptest.NewRequest(http.MethodGet, "http://chat.example.com/", nil))
+	assert.Equal(t, "https://chat.example.com:8443/", w.Header().Get("Location"))
+}
+
+func TestHSTSOnlyOverTLS(t *testing.T) {
+	handler := withHSTS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "http://chat.example.com/", nil))
+	assert.Empty(t, w.Header().Get("Strict-Transport-Security"), "Expected no HSTS over plain HTTP")
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "https://chat.example.com/", nil))
+	assert.Equal(t, "max-age=15552000", w.Header().Get("Strict-Transport-Security"))
+}
+
+func TestAdminEndpointsRequireClientCertificate(t *testing.T) {
+	dir := t.TempDir()
+	ca := generateTestCert(t, "admin CA", nil, true)
+	admin := generateTestCert(t, "admin", ca, false)
+	stranger := generateTestCert(t, "stranger", nil, false)
+	caPath := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, os.WriteFile(caPath, ca.certPEM, 0600))
+	originalCA := tlsClientCAFile
+	tlsClientCAFile = caPath
+	t.Cleanup(func() { tlsClientCAFile = originalCA })
+
+	serverCert := generateTestCert(t, "localhost", nil, true)
+	certPath, keyPath := writeTestCert(t, dir, serverCert, time.Now())
+	reloader, err := newCertReloader(certPath, keyPath)
+	assert.NoError(t, err)
+	config, err := newTLSConfig(reloader, caPath)
+	if !assert.NoError(t, err) {
+		return
+	}
+
+	// Clients send the name of the server, so the reloader rather than the httptest certificate is used
+	mux := http.NewServeMux()
+	mux.Handle("/api/admin/metrics", requireClientCert(handleAdminMetrics))
+	mux.Handle("/api/session", http.HandlerFunc(handleSession))
+	server := httptest.NewUnstartedServer(withHSTS(mux))
+	server.TLS = config
+	server.StartTLS()
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(serverCert.cert)
+	get := func(path string, clientCerts ...tls.Certificate) *http.Response {
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots, ServerName: "localhost", Certificates: clientCerts}}}
+		resp, err := client.Get(server.URL + path)
+		if err != nil {
+			t.Fatalf("Request failed: %v", err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := get("/api/session")
+	assert.Equal(t, http.StatusOK, resp.StatusCode, "Expected other endpoints to work without a client certificate")
+	assert.NotEmpty(t, resp.Header.Get("Strict-Transport-Security"))
+	assert.Equal(t, http.StatusForbidden, get("/api/admin/metrics").StatusCode)
+	assert.Equal(t, http.StatusOK, get("/api/admin/metrics", admin.tlsCertificate()).StatusCode)
+
+	assert.Equal(t, http.StatusForbidden, get("/api/admin/metrics", stranger.tlsCertificate()).StatusCode, "Expected certificates from another CA to be refused")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// Typing indicators are relayed to the room but never stored
+var (
+	typingThrottle = 3 * time.Second // A repeated typing_start is relayed at most this often
+	typingTimeout  = 6 * time.Second // Typing stops by itself when no typing_start arrives for this long
+	typingMu       sync.Mutex        // Guards the typing state of every client
+)
+
+// typingState is what the server remembers about a client that is typing
+type typingState struct {
+	room      string
+	expires   time.Time
+	lastRelay time.Time
+	timer     *time.Timer
+}
+
+// startTyping relays a typing_start frame of a client, throttled, and arms its expiry
+func startTyping(client *Client) {
+	now := time.Now()
+	typingMu.Lock()
+	state := client.typing // Switching rooms stops typing, so this is the current room
+	relay := state == nil || now.Sub(state.lastRelay) >= typingThrottle
+	if state == nil {
+		state = &typingState{room: client.room}
+		state.timer = time.AfterFunc(typingTimeout, func() { expireTyping(client) })
+		client.typing = state
+	}
+	state.expires = now.Add(typingTimeout)
+	if relay {
+		state.lastRelay = now
+	}
+	room := state.room
+	typingMu.Unlock()
+
+	if relay {
+		broadcast <- Message{Type: "typing_start", Username: client.username, Room: room, exceptSender: true}
+	}
+}
+
+// stopTyping relays a typing_stop frame if the client was typing
+func stopTyping(client *Client) {
+	typingMu.Lock()
+	state := client.typing
+	if state == nil {
+		typingMu.Unlock()
+		return
+	}
+	state.timer.Stop()
+	client.typing = nil
+	typingMu.Unlock()
+	broadcast <- Message{Type: "typing_stop", Username: client.username, Room: state.room, exceptSender: true}
+}
+
+// expireTyping stops the typing of a client that did not send typing_stop, or waits longer if it sent another typing_start
+func expireTyping(client *Client) {
+	typingMu.Lock()
+	state := client.typing
+	if state == nil {
+		typingMu.Unlock()
+		return
+	}
+	if left := time.Until(state.expires); left > 0 {
+		state.timer.Reset(left)
+		typingMu.Unlock()
+		return
+	}
+	typingMu.Unlock()
+	stopTyping(client)
+}
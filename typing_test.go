@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// useTypingTimes shortens the typing throttle and expiry for the duration of a test
+func useTypingTimes(t *testing.T, throttle, timeout time.Duration) {
+	originalThrottle, originalTimeout := typingThrottle, typingTimeout
+	typingThrottle, typingTimeout = throttle, timeout
+	t.Cleanup(func() { typingThrottle, typingTimeout = originalThrottle, originalTimeout })
+}
+
+func TestTypingIsRelayedToOthersInTheRoom(t *testing.T) {
+	useTempAccounts(t)
+	useTypingTimes(t, time.Hour, time.Hour)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	alice := joinTestClient(t, wsURL, "Alice")
+	bob := joinTestClient(t, wsURL, "Bob")
+
+	sendTestMessage(t, alice, Message{Type: "typing_start"})
+	assert.Equal(t, Message{Type: "typing_start", Username: "Alice", Room: lobbyRoom}, readTestMessage(t, bob))
+
+	// Repeated starts are throttled, and the sender never sees their own frames
+	sendTestMessage(t, alice, Message{Type: "typing_start"})
+	sendTestMessage(t, alice, Message{Type: "typing_stop"})
+	assert.Equal(t, Message{Type: "typing_stop", Username: "Alice", Room: lobbyRoom}, readTestMessage(t, bob))
+	sendTestMessage(t, alice, Message{Message: "hello"})
+	assert.Equal(t, "hello", readTestMessage(t, alice).Message, "Expected no typing frames for the sender")
+
+	// Sending a message ends typing
+	sendTestMessage(t, bob, Message{Type: "typing_start"})
+	assert.Equal(t, "typing_start", readTestMessage(t, alice).Type)
+	assert.Equal(t, "hello", readTestMessage(t, bob).Message)
+	sendTestMessage(t, bob, Message{Message: "hi"})
+	assert.Equal(t, Message{Type: "typing_stop", Username: "Bob", Room: lobbyRoom}, readTestMessage(t, alice))
+	assert.Equal(t, "hi", readTestMessage(t, alice).Message)
+}
+
+func TestTypingExpiresAndIsThrottled(t *testing.T) {
+	useTempAccounts(t)
+	useTypingTimes(t, 100*time.Millisecond, 300*time.Millisecond)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	carol := joinTestClient(t, wsURL, "Carol")
+	dave := joinTestClient(t, wsURL, "Dave")
+
+	start := time.Now()
+	sendTestMessage(t, carol, Message{Type: "typing_start"})
+	assert.Equal(t, "typing_start", readTestMessage(t, dave).Type)
+	sendTestMessage(t, carol, Message{Type: "typing_start"}) // Within the throttle
+	time.Sleep(150 * time.Millisecond)
+	sendTestMessage(t, carol, Message{Type: "typing_start"}) // Relayed again, and extends the expiry
+	assert.Equal(t, "typing_start", readTestMessage(t, dave).Type)
+
+	// No typing_stop ever arrives
+	assert.Equal(t, Message{Type: "typing_stop", Username: "Carol", Room: lobbyRoom}, readTestMessage(t, dave))
+	assert.GreaterOrEqual(t, time.Since(start), 450*time.Millisecond, "Expected the last typing_start to extend the expiry")
+}
+
+func TestTypingStaysInTheRoom(t *testing.T) {
+	useTempAccounts(t)
+	useTypingTimes(t, time.Hour, time.Hour)
+	startTestHub(t)
+	wsURL := startTestServer(t)
+
+	erin := joinTestAccount(t, wsURL, "Erin")
+	frank := joinTestClient(t, wsURL, "Frank")
+
+	sendTestMessage(t, erin, Message{Type: "typing_start"})
+	assert.Equal(t, "typing_start", readTestMessage(t, frank).Type)
+	sendTestMessage(t, erin, Message{Message: "/join games"})
+	assert.Equal(t, Message{Type: "typing_stop", Username: "Erin", Room: lobbyRoom}, readTestMessage(t, frank), "Expected typing to stop when leaving the room")
+
+	readTestMessage(t, erin) // You joined games
+	sendTestMessage(t, erin, Message{Type: "typing_start"})
+	sendTestMessage(t, frank, Message{Message: "anyone?"})
+	assert.Equal(t, "anyone?", readTestMessage(t, frank).Message, "Expected no typing frames from other rooms")
+	sendTestMessage(t, erin, Message{Type: "typing_stop"})
+}
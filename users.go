@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+var (
+	usernames       = make(map[string]*Client) // Online users by lowercased name, guarded by clientsMu
+	usernamePattern = regexp.MustCompile(`^[\p{L}\p{N}_.-]+( [\p{L}\p{N}_.-]+)*$`)
+	maxUsernameLen  = 24
+	reservedNames   = map[string]bool{"bot": true, "system": true, "server": true, "admin": true, "moderator": true}
+)
+
+// Errors returned when a username cannot be claimed; the code is sent to the client
+var (
+	errUsernameInvalid  = errors.New("username_invalid")
+	errUsernameReserved = errors.New("username_reserved")
+	errUsernameTaken    = errors.New("username_taken")
+	errUsernameAccount  = errors.New("username_registered")
+)
+
+// usernameErrorText explains a claim error to the user
+func usernameErrorText(err error, name string) string {
+	switch err {
+	case errUsernameReserved:
+		return "The name " + name + " is reserved. Please pick another one."
+	case errUsernameTaken:
+		return "The name " + name + " is already in use. Please pick another one."
+	case errUsernameAccount:
+		return "The name " + name + " belongs to a registered user. Please log in or pick another one."
+	default:
+		return "Usernames are 1 to 24 letters, digits, spaces, '.', '-' or '_'."
+	}
+}
+
+// validateUsername normalizes a requested username and checks it may be used
+func validateUsername(name string) (string, error) {
+	name = norm.NFC.String(strings.TrimSpace(name)) // One spelling per name, e.g. for accented letters
+	if name == "" || len([]rune(name)) > maxUsernameLen || !usernamePattern.MatchString(name) {
+		return name, errUsernameInvalid
+	}
+	if reservedNames[strings.ToLower(name)] {
+		return name, errUsernameReserved
+	}
+	return name, nil
+}
+
+// claimUsername binds a username to a client, releasing the name it had before.
+// Connections of the same account share its name; guests cannot take a registered name.
+func claimUsername(client *Client, name string) (string, error) {
+	name, err := validateUsername(name)
+	if err != nil {
+		return name, err
+	}
+	if _, registered := accounts.get(name); registered && !strings.EqualFold(client.account, name) {
+		return name, errUsernameAccount
+	}
+
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	key := strings.ToLower(name)
+	if owner, exists := usernames[key]; exists && owner != client && (client.account == "" || owner.account != client.account) {
+		return name, errUsernameTaken
+	}
+	if client.username != "" {
+		delete(usernames, strings.ToLower(client.username))
+	}
+	usernames[key] = client
+	client.username = name
+	return name, nil
+}
+
+// releaseUsername frees the username of a disconnecting client, unless
+// another connection of the same account still uses it
+func releaseUsername(client *Client) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	key := strings.ToLower(client.username)
+	if client.username == "" || usernames[key] != client {
+		return
+	}
+	delete(usernames, key)
+	for _, other := range clients {
+		if other != client && other.account != "" && other.account == client.account && strings.ToLower(other.username) == key {
+			usernames[key] = other
+			return
+		}
+	}
+}
+
+// joinChat binds the username of the first frame of a connection, reporting whether it succeeded.
+// The client is told the name it was given; the username field of later frames is ignored.
+func joinChat(client *Client, requested string) bool {
+	if client.username != "" {
+		// Already bound, e.g. by the session of a logged-in user
+		client.writeJSON(Message{Type: "joined", Username: client.username, Room: client.room})
+		return true
+	}
+	if client.account != "" {
+		requested = client.account // Logged-in users always chat under their account name
+	}
+	name, err := claimUsername(client, requested)
+	if err != nil {
+		client.writeJSON(Message{Type: "error", Code: err.Error(), Username: "System", Message: usernameErrorText(err, name)})
+		return false
+	}
+	client.writeJSON(Message{Type: "joined", Username: name, Room: client.room})
+	sendUnread(client)
+	enterRoom(client)
+	return true
+}
+
+func init() {
+	registerCommand(&Command{
+		Name: "nick",
+		Args: []ArgSpec{{Name: "name", Required: true, Rest: true}},
+		Help: "Change your username",
+		Run:  runNick,
+	})
+}
+
+func runNick(ctx *CommandContext) {
+	if ctx.Client.account != "" {
+		ctx.reply("Your name comes from your account and cannot be changed")
+		return
+	}
+	oldName := ctx.Client.username
+	name, err := claimUsername(ctx.Client, ctx.Args["name"])
+	if err != nil {
+		ctx.Client.writeJSON(Message{Type: "error", Code: err.Error(), Username: "System", Message: usernameErrorText(err, name), Room: ctx.Client.room})
+		return
+	}
+	if name == oldName {
+		return
+	}
+	ctx.Client.writeJSON(Message{Type: "joined", Username: name, Room: ctx.Client.room})
+	broadcast <- Message{Username: "System", Message: oldName + " is now known as " + name, Room: ctx.Client.room}
+	leaveRoom(ctx.Client, oldName, ctx.Client.room)
+	enterRoom(ctx.Client)
+}
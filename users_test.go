@@ -0,0 +1,56 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateUsername(t *testing.T) {
+	name, err := validateUsername("  Jane Doe ")
+	assert.NoError(t, err)
+	assert.Equal(t, "Jane Doe", name)
+
+	_, err = validateUsername("bOt")
+	assert.Equal(t, errUsernameReserved, err, "Expected reserved names to be rejected whatever the case")
+	_, err = validateUsername("<script>")
+	assert.Equal(t, errUsernameInvalid, err)
+	_, err = validateUsername("")
+	assert.Equal(t, errUsernameInvalid, err)
+	_, err = validateUsername("a-very-long-username-that-never-ends")
+	assert.Equal(t, errUsernameInvalid, err)
+}
+
+func TestUsernameIsBoundAtJoin(t *testing.T) {
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	ws := joinTestClient(t, wsURL, "Carol")
+
+	sendTestMessage(t, ws, Message{Username: "Bot", Message: "I am the bot now"})
+	msg := readTestMessage(t, ws)
+	assert.Equal(t, "Carol", msg.Username, "Expected the username of later frames to be ignored")
+
+	impostor := dialTestClient(t, wsURL)
+	sendTestMessage(t, impostor, Message{Type: "join", Username: "carol"})
+	msg = readTestMessage(t, impostor)
+	assert.Equal(t, "error", msg.Type)
+	assert.Equal(t, "username_taken", msg.Code, "Expected usernames to be unique among online users")
+}
+
+func TestNickCommand(t *testing.T) {
+	startTestHub(t)
+	wsURL := startTestServer(t)
+	ws := joinTestClient(t, wsURL, "Dave")
+
+	sendTestMessage(t, ws, Message{Message: "/nick System"})
+	assert.Equal(t, "username_reserved", readTestMessage(t, ws).Code)
+
+	sendTestMessage(t, ws, Message{Message: "/nick David"})
+	assert.Equal(t, Message{Type: "joined", Username: "David", Room: lobbyRoom}, readTestMessage(t, ws))
+	assert.Equal(t, "Dave is now known as David", readTestMessage(t, ws).Message)
+
+	// The old name is free again
+	other := joinTestClient(t, wsURL, "Dave")
+	sendTestMessage(t, other, Message{Message: "hello"})
+	assert.Equal(t, "Dave", readTestMessage(t, other).Username)
+}